@@ -1,11 +1,17 @@
 package api
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/raintank/tsdb-gw/auth"
@@ -18,23 +24,43 @@ var (
 	ssl      = flag.Bool("ssl", false, "use https")
 	certFile = flag.String("cert-file", "", "SSL certificate file")
 	keyFile  = flag.String("key-file", "", "SSL key file")
+
+	clientCAFile   = flag.String("client-ca-file", "", "CA bundle used to verify client certificates. setting it with ssl enables mutual TLS, so clients can authenticate with a certificate using the cert auth plugin")
+	clientCertMode = flag.String("client-cert-mode", "verify-if-given", "whether clients must present a certificate when mutual TLS is enabled. (verify-if-given|require)")
+
+	trustForwardedFor = flag.Bool("auth-trust-forwarded-for", false, "use the last address of the X-Forwarded-For header as the source of requests when tracking failed authentications. only enable behind a proxy setting this header")
+
+	drainDelay      = flag.Duration("shutdown-drain-delay", 5*time.Second, "time between failing the /ready check and closing the listener on shutdown, so load balancers stop sending requests")
+	shutdownTimeout = flag.Duration("shutdown-request-timeout", 30*time.Second, "max time to wait on shutdown for in-flight requests to complete. requests still running afterwards are abandoned")
 )
 
 type Api struct {
 	l          net.Listener
+	srv        *http.Server
 	done       chan struct{}
 	authPlugin auth.AuthPlugin
+	authGuard  *auth.FailureGuard
 	Router     *macaron.Macaron
+
+	draining int32 // set when shutting down, to fail the readiness check
+	inFlight int32 // number of requests being handled
 }
 
 func New(authPlugin string, appName string) *Api {
 	if *ssl && (*certFile == "" || *keyFile == "") {
 		log.Fatal("cert-file and key-file must be set when using SSL")
 	}
+	if *clientCAFile != "" && !*ssl {
+		log.Fatal("ssl must be enabled when client-ca-file is set")
+	}
+	if *clientCertMode != "verify-if-given" && *clientCertMode != "require" {
+		log.Fatalf("invalid client-cert-mode %q", *clientCertMode)
+	}
 
 	a := &Api{
 		done:       make(chan struct{}),
 		authPlugin: auth.GetAuthPlugin(authPlugin),
+		authGuard:  auth.NewFailureGuard("http"),
 	}
 
 	// define our own listner so we can call Close on it
@@ -50,6 +76,7 @@ func New(authPlugin string, appName string) *Api {
 	m.Use(Tracer(appName))
 	m.Use(GetContextHandler())
 	m.Get("/", index)
+	m.Get("/ready", a.ready)
 
 	a.Router = m
 	return a
@@ -57,11 +84,12 @@ func New(authPlugin string, appName string) *Api {
 
 func (a *Api) Start() *Api {
 	// write Request logs in Apache Combined Log Format
-	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, a.Router)
-	srv := http.Server{
+	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, a.trackInFlight(a.Router))
+	srv := &http.Server{
 		Addr:    *addr,
 		Handler: loggedRouter,
 	}
+	a.srv = srv
 
 	go func() {
 		defer close(a.done)
@@ -75,25 +103,80 @@ func (a *Api) Start() *Api {
 				Certificates: []tls.Certificate{cert},
 				NextProtos:   []string{"http/1.1"},
 			}
+			if *clientCAFile != "" {
+				if err := configureClientAuth(srv.TLSConfig); err != nil {
+					log.Fatalf("Fail to start server: %v", err)
+				}
+			}
 			tlsListener := tls.NewListener(a.l, srv.TLSConfig)
 			err = srv.Serve(tlsListener)
 		} else {
 			err = srv.Serve(a.l)
 		}
 
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			log.Info(err.Error())
 		}
 	}()
 	return a
 }
 
+// Stop drains the server: it fails the readiness check, waits for the drain
+// delay so load balancers stop sending requests, then stops accepting new
+// connections and waits for in-flight requests to complete.
 func (a *Api) Stop() {
-	a.l.Close()
+	atomic.StoreInt32(&a.draining, 1)
+	log.Infof("api: draining, waiting %s before closing the listener", *drainDelay)
+	time.Sleep(*drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := a.srv.Shutdown(ctx); err != nil {
+		log.Warnf("api: %d in-flight requests did not complete within %s and were abandoned", atomic.LoadInt32(&a.inFlight), *shutdownTimeout)
+		a.srv.Close()
+	} else {
+		log.Info("api: all in-flight requests completed")
+	}
 	<-a.done
 	a.authPlugin.Stop()
 }
 
+// configureClientAuth enables mutual TLS, verifying client certificates
+// against the CA bundle in client-ca-file.
+func configureClientAuth(cfg *tls.Config) error {
+	pem, err := ioutil.ReadFile(*clientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in client-ca-file %s", *clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if *clientCertMode == "require" {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	log.Infof("api: mutual TLS enabled, client certificates %s", *clientCertMode)
+	return nil
+}
+
+func (a *Api) trackInFlight(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&a.inFlight, 1)
+		defer atomic.AddInt32(&a.inFlight, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *Api) ready(ctx *macaron.Context) {
+	if atomic.LoadInt32(&a.draining) == 1 {
+		ctx.JSON(503, "shutting down")
+		return
+	}
+	ctx.JSON(200, "ok")
+}
+
 func index(ctx *macaron.Context) {
 	ctx.JSON(200, "ok")
 }
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/raintank/tsdb-gw/api/models"
+	"github.com/raintank/tsdb-gw/auth"
+	"github.com/raintank/tsdb-gw/auth/gcom"
+	"gopkg.in/macaron.v1"
+)
+
+type stopAuth struct{}
+
+func (stopAuth) Auth(username, password string) (*auth.User, error) { return nil, auth.ErrUnknownKey }
+func (stopAuth) Stop()                                              {}
+
+func TestApiStop(t *testing.T) {
+	origDrain, origTimeout := *drainDelay, *shutdownTimeout
+	*drainDelay, *shutdownTimeout = 500*time.Millisecond, 5*time.Second
+	defer func() { *drainDelay, *shutdownTimeout = origDrain, origTimeout }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Api{
+		l:          l,
+		done:       make(chan struct{}),
+		authPlugin: stopAuth{},
+		Router:     macaron.New(),
+	}
+	a.Router.Use(macaron.Renderer())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	a.Router.Get("/ready", a.ready)
+	a.Router.Get("/slow", func(ctx *macaron.Context) {
+		close(started)
+		<-release
+		ctx.PlainText(200, []byte("done"))
+	})
+	a.Start()
+	base := "http://" + l.Addr().String()
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	if resp, err := client.Get(base + "/ready"); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("GET /ready before Stop() = %v, %v, want 200", resp, err)
+	}
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := client.Get(base + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		slow <- result{code: resp.StatusCode, body: string(body), err: err}
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		a.Stop()
+		close(stopped)
+	}()
+
+	// the readiness check fails while draining, before the listener is closed
+	deadline := time.Now().Add(*drainDelay)
+	for {
+		resp, err := client.Get(base + "/ready")
+		if err != nil {
+			t.Fatalf("GET /ready while draining error = %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == 503 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET /ready while draining = %d, want 503", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stop waits for the in-flight request
+	select {
+	case <-stopped:
+		t.Fatal("Stop() returned before the in-flight request completed")
+	case <-time.After(*drainDelay + 200*time.Millisecond):
+	}
+	close(release)
+	r := <-slow
+	if r.err != nil || r.code != 200 || r.body != "done" {
+		t.Errorf("in-flight request = %d %q, %v, want 200 \"done\"", r.code, r.body, r.err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop() did not return after the in-flight request completed")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler macaron.Handler
+		user    auth.User
+		want    int
+	}{
+		{name: "publisher", handler: RequirePublisher(), user: auth.User{Role: gcom.ROLE_METRICS_PUBLISHER}, want: 200},
+		{name: "not a publisher", handler: RequirePublisher(), user: auth.User{Role: gcom.ROLE_VIEWER}, want: 401},
+		{name: "viewer", handler: RequireViewer(), user: auth.User{Role: gcom.ROLE_VIEWER}, want: 200},
+		{name: "not a viewer", handler: RequireViewer(), user: auth.User{Role: gcom.ROLE_METRICS_PUBLISHER}, want: 403},
+		{name: "admin", handler: RequireAdmin(), user: auth.User{IsAdmin: true}, want: 200},
+		{name: "not an admin", handler: RequireAdmin(), user: auth.User{Role: gcom.ROLE_ADMIN}, want: 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := macaron.New()
+			m.Use(macaron.Renderer())
+			m.Use(GetContextHandler())
+			m.Use(func(ctx *models.Context) {
+				user := tt.user
+				ctx.User = &user
+			})
+			m.Get("/", tt.handler, func(ctx *macaron.Context) {
+				ctx.PlainText(200, []byte("ok"))
+			})
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
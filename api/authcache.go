@@ -0,0 +1,51 @@
+package api
+
+import (
+	"github.com/raintank/tsdb-gw/api/models"
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+// InitAuthCacheRoutes adds the routes to inspect and invalidate the caches of
+// the grafana auth plugins. They require the admin key.
+func (a *Api) InitAuthCacheRoutes(enforceRoles bool) {
+	a.Router.Get("/admin/auth/cache", a.GenerateHandlers("admin", enforceRoles, false, RequireAdminKey(), AuthCacheStats)...)
+	a.Router.Delete("/admin/auth/cache", a.GenerateHandlers("admin", enforceRoles, false, RequireAdminKey(), AuthCacheClear)...)
+	a.Router.Delete("/admin/auth/cache/tokens/:hash", a.GenerateHandlers("admin", enforceRoles, false, RequireAdminKey(), AuthCacheInvalidateToken)...)
+	a.Router.Delete("/admin/auth/cache/instances/:id", a.GenerateHandlers("admin", enforceRoles, false, RequireAdminKey(), AuthCacheInvalidateInstance)...)
+	a.Router.Post("/admin/auth/cache/revalidate", a.GenerateHandlers("admin", enforceRoles, false, RequireAdminKey(), AuthCacheRevalidate)...)
+}
+
+// AuthCacheStats responds with the number of entries of the auth caches
+func AuthCacheStats(ctx *models.Context) {
+	ctx.JSON(200, gcom.Stats())
+}
+
+// AuthCacheClear removes all entries of the auth caches
+func AuthCacheClear(ctx *models.Context) {
+	gcom.ClearCaches()
+	ctx.JSON(200, "ok")
+}
+
+// AuthCacheInvalidateToken removes the token with the sha256 hash, in hex,
+// given by the hash parameter from the auth caches, e.g. the output of
+// `echo -n $key | sha256sum` or the key of `hash-key -hash sha256`.
+func AuthCacheInvalidateToken(ctx *models.Context) {
+	removed := gcom.InvalidateToken(ctx.Params(":hash"))
+	ctx.JSON(200, map[string]int{"removed": removed})
+}
+
+// AuthCacheInvalidateInstance removes the instance given by the id parameter
+// from the auth caches, for all tokens.
+func AuthCacheInvalidateInstance(ctx *models.Context) {
+	removed := gcom.InvalidateInstance(ctx.Params(":id"))
+	ctx.JSON(200, map[string]int{"removed": removed})
+}
+
+// AuthCacheRevalidate starts the revalidation of all cached tokens and instances
+func AuthCacheRevalidate(ctx *models.Context) {
+	if !gcom.Revalidate() {
+		ctx.JSON(409, "revalidation already running")
+		return
+	}
+	ctx.JSON(202, "revalidation started")
+}
@@ -2,9 +2,12 @@ package api
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"path"
 	"strconv"
@@ -61,51 +64,88 @@ func GetContextHandler() macaron.Handler {
 	}
 }
 
+// routeScopes maps the kinds of routes to the scope they require
+var routeScopes = map[string]auth.Scope{
+	"read":   auth.ScopeMetricsRead,
+	"write":  auth.ScopeMetricsWrite,
+	"delete": auth.ScopeMetricsDelete,
+	"admin":  auth.ScopeAdmin,
+}
+
+// RequireAdmin rejects users who are not admins.
 func RequireAdmin() macaron.Handler {
-	return func(ctx *models.Context) {
-		if !ctx.IsAdmin {
-			ctx.JSON(403, "Permision denied")
-		}
-	}
+	return RequireScope(auth.ScopeAdmin, true)
 }
 
+// RequirePublisher rejects users who are not allowed to publish metrics.
 func RequirePublisher() macaron.Handler {
+	return RequireScope(auth.ScopeMetricsWrite, true)
+}
+
+// RequireViewer rejects users who are not allowed to read metrics.
+func RequireViewer() macaron.Handler {
+	return RequireScope(auth.ScopeMetricsRead, true)
+}
+
+// RequireScope rejects users who are not granted scope. Unless enforceRoles
+// is set, only the scopes set explicitly for a user, e.g. per key, are
+// enforced. The admin scope is always enforced. Users who may not publish
+// are rejected with a 401, as they always were, all others with a 403.
+func RequireScope(scope auth.Scope, enforceRoles bool) macaron.Handler {
 	return func(ctx *models.Context) {
-		if !ctx.Role.IsPublisher() {
-			log.Infof("user %v with role %v attempting to publish at %v", ctx.ID, ctx.Role, ctx.Req.RequestURI)
-			ctx.JSON(401, "Unauthorized to publish")
+		if !enforceRoles && scope != auth.ScopeAdmin && len(ctx.Scopes) == 0 {
+			return
+		}
+		if !ctx.HasScope(scope) {
+			log.Infof("user %v with role %v attempting to access %v without scope %v", ctx.ID, ctx.Role, ctx.Req.RequestURI, scope)
+			auditDenied(ctx, fmt.Sprintf("missing scope %s", scope))
+			status := 403
+			if scope == auth.ScopeMetricsWrite {
+				status = 401
+			}
+			ctx.JSON(status, fmt.Sprintf("Permission denied, %s scope required", scope))
 			return
 		}
 	}
 }
 
-func RequireViewer() macaron.Handler {
+// auditDenied writes the denial of an authenticated request to the audit log
+func auditDenied(ctx *models.Context, reason string) {
+	ev := ctx.Audit
+	ev.Decision = auth.AuditDeny
+	ev.Reason = reason
+	auth.Audit(ev)
+}
+
+// RequireAdminKey rejects requests which were not authenticated with the
+// admin key, including users granted the admin scope otherwise.
+func RequireAdminKey() macaron.Handler {
 	return func(ctx *models.Context) {
-		if !ctx.Role.IsViewer() {
-			log.Infof("user %v with role %v attempting to view at %v", ctx.ID, ctx.Role, ctx.Req.RequestURI)
-			ctx.JSON(403, "Unauthorized to view")
+		_, key := getAuthCreds(ctx.Req.Request)
+		if key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(auth.AdminKey)) != 1 {
+			log.Infof("user %v attempting to access %v without the admin key", ctx.ID, ctx.Req.RequestURI)
+			auditDenied(ctx, "admin key required")
+			ctx.JSON(403, "Permission denied, the admin key is required")
 			return
 		}
 	}
 }
 
+// GenerateHandlers returns the handlers for a route of the given kind, which
+// is one of read, write, delete or admin, authenticating the user and
+// requiring the scope of the kind.
 func (a *Api) GenerateHandlers(kind string, enforceRoles bool, datadog bool, handlers ...macaron.Handler) []macaron.Handler {
+	scope, ok := routeScopes[kind]
+	if !ok {
+		log.Fatalf("invalid route kind %q", kind)
+	}
 	combinedHandlers := []macaron.Handler{}
-	if kind == "write" {
-		if datadog {
-			combinedHandlers = append(combinedHandlers, a.DDAuth())
-		} else {
-			combinedHandlers = append(combinedHandlers, a.Auth())
-		}
-		if enforceRoles {
-			combinedHandlers = append(combinedHandlers, RequirePublisher())
-		}
+	if datadog {
+		combinedHandlers = append(combinedHandlers, a.DDAuth())
 	} else {
 		combinedHandlers = append(combinedHandlers, a.Auth())
-		if enforceRoles {
-			combinedHandlers = append(combinedHandlers, RequirePublisher())
-		}
 	}
+	combinedHandlers = append(combinedHandlers, RequireScope(scope, enforceRoles))
 	return append(combinedHandlers, handlers...)
 }
 
@@ -129,87 +169,180 @@ func getAuthCreds(req *http.Request) (user, password string) {
 	return username, key
 }
 
+// authCert authenticates the request with its verified client certificate,
+// if there is one and the auth plugin supports certificates. Otherwise
+// ErrUnknownKey is returned, so the credentials of the request are used.
+func (a *Api) authCert(req *http.Request) (*auth.User, error) {
+	p, ok := a.authPlugin.(auth.CertAuthPlugin)
+	if !ok || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, auth.ErrUnknownKey
+	}
+	return p.AuthCert(req.TLS.VerifiedChains[0][0])
+}
+
+// sourceAddr returns the address of the client sending req, used to track
+// failed authentications.
+func sourceAddr(req *http.Request) string {
+	if *trustForwardedFor {
+		if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+			addrs := strings.Split(fwd, ",")
+			return strings.TrimSpace(addrs[len(addrs)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// blocked rejects the request if its source is locked out after too many
+// failed authentications.
+func (a *Api) blocked(ctx *models.Context, source string) bool {
+	blocked, retryAfter := a.authGuard.Blocked(source)
+	if !blocked {
+		return false
+	}
+	log.Debugf("rejecting request from %s, locked out for %s after too many failed authentications", source, retryAfter)
+	ev := auth.NewAuditEvent("http", source, "", "")
+	ev.Route = ctx.Req.URL.Path
+	ev.Decision = auth.AuditDeny
+	ev.Reason = "source locked out"
+	auth.Audit(ev)
+	ctx.Resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	ctx.JSON(429, "Too many failed authentications")
+	return true
+}
+
 func (a *Api) Auth() macaron.Handler {
 	return func(ctx *models.Context) {
-		username, key := getAuthCreds(ctx.Req.Request)
-		if key == "" {
-			log.Debugf("no key specified")
-			ctx.JSON(401, "Unauthorized")
+		source := sourceAddr(ctx.Req.Request)
+		if a.blocked(ctx, source) {
 			return
 		}
 
-		user, err := a.authPlugin.Auth(username, key)
-		if err != nil {
-			if err == auth.ErrInvalidCredentials || err == auth.ErrInvalidOrgId || err == auth.ErrInvalidInstanceID {
-				ctx.JSON(401, err.Error())
+		ev := a.certAuditEvent(ctx.Req.Request, source)
+		user, err := a.authCert(ctx.Req.Request)
+		if err == auth.ErrUnknownKey {
+			username, key := getAuthCreds(ctx.Req.Request)
+			ev = auth.NewAuditEvent("http", source, username, key)
+			if key == "" {
+				log.Debugf("no key specified")
+				ev.Route = ctx.Req.URL.Path
+				ev.Decision = auth.AuditDeny
+				ev.Reason = "no key specified"
+				auth.Audit(ev)
+				ctx.JSON(401, "Unauthorized")
 				return
 			}
-			log.Errorf("failed to perform authentication: %q", err.Error())
-			ctx.JSON(500, err.Error())
-			return
-		}
-
-		// allow admin users to impersonate other orgs.
-		if user.IsAdmin {
-			header := ctx.Req.Header.Get("X-Tsdb-Org")
-			if header != "" {
-				orgId, err := strconv.ParseInt(header, 10, 64)
-				if err == nil && orgId != 0 {
-					user.ID = int(orgId)
-				}
-			}
+			user, err = a.authPlugin.Auth(username, key)
 		}
-		ctx.User = user
+		a.authenticated(ctx, source, ev, user, err)
 	}
 }
 
 func (a *Api) DDAuth() macaron.Handler {
 	return func(ctx *models.Context) {
-		var key string
-		var username string
-
-		header := ctx.Req.Header.Get("Dd-Api-Key")
-		parts := strings.SplitN(header, ":", 2)
-		if len(parts) == 1 {
-			key = parts[0]
-			username = "api_key"
-		} else if len(parts) == 2 && parts[1] == "" {
-			key = parts[1]
-			username = "api_key"
-		} else {
-			key = parts[1]
-			username = parts[0]
-		}
-
-		if key == "" {
-			log.Debugf("no key specified")
-			ctx.JSON(401, "Unauthorized")
+		source := sourceAddr(ctx.Req.Request)
+		if a.blocked(ctx, source) {
 			return
 		}
 
-		user, err := a.authPlugin.Auth(username, key)
-		if err != nil {
-			if err == auth.ErrInvalidCredentials || err == auth.ErrInvalidOrgId || err == auth.ErrInvalidInstanceID {
-				ctx.JSON(401, err.Error())
+		ev := a.certAuditEvent(ctx.Req.Request, source)
+		user, err := a.authCert(ctx.Req.Request)
+		if err == auth.ErrUnknownKey {
+			var key string
+			var username string
+
+			header := ctx.Req.Header.Get("Dd-Api-Key")
+			parts := strings.SplitN(header, ":", 2)
+			if len(parts) == 1 {
+				key = parts[0]
+				username = "api_key"
+			} else if len(parts) == 2 && parts[1] == "" {
+				key = parts[1]
+				username = "api_key"
+			} else {
+				key = parts[1]
+				username = parts[0]
+			}
+
+			ev = auth.NewAuditEvent("http", source, username, key)
+			if key == "" {
+				log.Debugf("no key specified")
+				ev.Route = ctx.Req.URL.Path
+				ev.Decision = auth.AuditDeny
+				ev.Reason = "no key specified"
+				auth.Audit(ev)
+				ctx.JSON(401, "Unauthorized")
 				return
 			}
-			log.Errorf("failed to perform authentication: %q", err.Error())
-			ctx.JSON(500, err.Error())
-			return
+
+			user, err = a.authPlugin.Auth(username, key)
 		}
+		a.authenticated(ctx, source, ev, user, err)
+	}
+}
+
+// certAuditEvent returns the audit event of an authentication with the
+// client certificate of the request.
+func (a *Api) certAuditEvent(req *http.Request, source string) auth.AuditEvent {
+	ev := auth.NewAuditEvent("http", source, "", "")
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		cert := req.TLS.VerifiedChains[0][0]
+		ev.Username = cert.Subject.CommonName
+		ev.KeyID = "cert:" + auth.KeyID(cert.Raw)
+	}
+	return ev
+}
 
-		// allow admin users to impersonate other orgs.
-		if user.IsAdmin {
-			header := ctx.Req.Header.Get("X-Tsdb-Org")
-			if header != "" {
-				orgId, err := strconv.ParseInt(header, 10, 64)
-				if err == nil && orgId != 0 {
-					user.ID = int(orgId)
-				}
+// authenticated handles the result of the authentication of a request by
+// Auth or DDAuth, and writes it to the audit log.
+func (a *Api) authenticated(ctx *models.Context, source string, ev auth.AuditEvent, user *auth.User, err error) {
+	ev.Route = ctx.Req.URL.Path
+	if err != nil {
+		ev.Reason = err.Error()
+		if err == auth.ErrInvalidCredentials || err == auth.ErrUnknownKey || err == auth.ErrInvalidOrgId || err == auth.ErrInvalidInstanceID {
+			ev.Decision = auth.AuditDeny
+			auth.Audit(ev)
+			a.authGuard.Failure(source)
+			ctx.JSON(401, err.Error())
+			return
+		}
+		ev.Decision = auth.AuditError
+		auth.Audit(ev)
+		log.Errorf("failed to perform authentication: %q", err.Error())
+		ctx.JSON(500, err.Error())
+		return
+	}
+	ev.SetUser(user)
+
+	// allow admin users to impersonate other orgs. the user is copied, as
+	// plugins may return the same admin user for every request.
+	if user.IsAdmin {
+		header := ctx.Req.Header.Get("X-Tsdb-Org")
+		if header != "" {
+			orgId, err := strconv.ParseInt(header, 10, 64)
+			if err == nil && orgId != 0 {
+				impersonated := *user
+				impersonated.ID = int(orgId)
+				user = &impersonated
+				ev.ImpersonatedOrgID = int(orgId)
 			}
 		}
-		ctx.User = user
 	}
+	if !user.AllowsRoute(ctx.Req.URL.Path) {
+		log.Infof("user %v attempting to access %v, which its key is not allowed to", user.ID, ctx.Req.URL.Path)
+		ev.Decision = auth.AuditDeny
+		ev.Reason = "route not allowed"
+		auth.Audit(ev)
+		ctx.JSON(403, "Permission denied for this route")
+		return
+	}
+	ev.Decision = auth.AuditAllow
+	auth.Audit(ev)
+	ctx.User = user
+	ctx.Audit = ev
 }
 
 type requestStats struct {
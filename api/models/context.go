@@ -11,4 +11,7 @@ type Context struct {
 	*macaron.Context
 	*auth.User
 	Body io.ReadCloser
+	// Audit is the audit event of the authentication of the request, for
+	// the authorization decisions made after it
+	Audit auth.AuditEvent
 }
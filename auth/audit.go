@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/raintank/tsdb-gw/auth/gcom"
+	log "github.com/sirupsen/logrus"
+)
+
+// decisions of audit events
+const (
+	AuditAllow = "allow"
+	AuditDeny  = "deny"
+	AuditError = "error"
+)
+
+var (
+	auditLogPath           string
+	auditSuccessSampleRate float64
+
+	auditLog *auditWriter
+
+	auditEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "auth_audit_events_total",
+		Help:      "Number of authentication decisions written to the audit log.",
+	}, []string{"input", "decision"})
+	auditErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "auth_audit_write_errors_total",
+		Help:      "Number of audit events which could not be written.",
+	})
+)
+
+func init() {
+	flag.StringVar(&auditLogPath, "auth-audit-log", "", "file the authentication decisions are logged to as JSON lines, or - for stdout. (empty disables)")
+	flag.Float64Var(&auditSuccessSampleRate, "auth-audit-success-sample-rate", 0.01, "fraction of successful authentications written to the audit log. denied authentications and impersonations are always written")
+}
+
+// AuditEvent is an authentication decision written to the audit log
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Input    string    `json:"input"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+	// KeyID is the sha256 of the key, in hex, or of the client certificate
+	KeyID    string        `json:"keyId,omitempty"`
+	Username string        `json:"username,omitempty"`
+	OrgID    int           `json:"orgId,omitempty"`
+	Role     gcom.RoleType `json:"role,omitempty"`
+	IsAdmin  bool          `json:"isAdmin,omitempty"`
+	Source   string        `json:"source,omitempty"`
+	Route    string        `json:"route,omitempty"`
+	// ImpersonatedOrgID is the org an admin acts as with the X-Tsdb-Org header
+	ImpersonatedOrgID int `json:"impersonatedOrgId,omitempty"`
+
+	// key is hashed into KeyID only when the event is written
+	key string
+}
+
+// NewAuditEvent returns an event for the authentication of key by a client
+// at source. The key is only hashed if the event is written.
+func NewAuditEvent(input, source, username, key string) AuditEvent {
+	return AuditEvent{
+		Input:    input,
+		Source:   source,
+		Username: username,
+		key:      key,
+	}
+}
+
+// SetUser records the authenticated user in the event
+func (e *AuditEvent) SetUser(u *User) {
+	e.OrgID = u.ID
+	e.Role = u.Role
+	e.IsAdmin = u.IsAdmin
+}
+
+// KeyID returns the id of a key in the audit log, which is its sha256 in
+// hex. It is the hash used to invalidate a key in the auth caches.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+type auditWriter struct {
+	sync.Mutex
+	enc        *json.Encoder
+	sampleRate float64
+}
+
+// InitAuditLog opens the audit log, if one is configured.
+func InitAuditLog() error {
+	var w io.Writer
+	switch auditLogPath {
+	case "":
+		return nil
+	case "-":
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	auditLog = newAuditWriter(w, auditSuccessSampleRate)
+	log.Infof("auth: writing the audit log to %s, sampling %v of successful authentications", auditLogPath, auditSuccessSampleRate)
+	return nil
+}
+
+func newAuditWriter(w io.Writer, sampleRate float64) *auditWriter {
+	return &auditWriter{
+		enc:        json.NewEncoder(w),
+		sampleRate: sampleRate,
+	}
+}
+
+// Audit writes the event to the audit log, unless it is a successful
+// authentication which is not sampled.
+func Audit(e AuditEvent) {
+	auditLog.write(e)
+}
+
+func (a *auditWriter) write(e AuditEvent) {
+	if a == nil {
+		return
+	}
+	if e.Decision == AuditAllow && e.ImpersonatedOrgID == 0 && (a.sampleRate <= 0 || a.sampleRate < 1 && rand.Float64() >= a.sampleRate) {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.KeyID == "" && e.key != "" {
+		e.KeyID = KeyID([]byte(e.key))
+	}
+	a.Lock()
+	err := a.enc.Encode(&e)
+	a.Unlock()
+	if err != nil {
+		auditErrors.Inc()
+		log.Errorf("auth: could not write audit event: %s", err)
+		return
+	}
+	auditEvents.WithLabelValues(e.Input, e.Decision).Inc()
+}
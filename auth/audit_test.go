@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+func TestAudit(t *testing.T) {
+	user := &User{ID: 3, Role: gcom.ROLE_EDITOR}
+	tests := []struct {
+		name         string
+		sampleRate   float64
+		decision     string
+		impersonated int
+		written      bool
+	}{
+		{"denied", 0, AuditDeny, 0, true},
+		{"error", 0, AuditError, 0, true},
+		{"allowed not sampled", 0, AuditAllow, 0, false},
+		{"allowed sampled", 1, AuditAllow, 0, true},
+		{"impersonation", 0, AuditAllow, 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newAuditWriter(&buf, tt.sampleRate)
+			ev := NewAuditEvent("http", "10.0.0.1", "api_key", "secret")
+			ev.Route = "/metrics"
+			ev.SetUser(user)
+			ev.Decision = tt.decision
+			ev.ImpersonatedOrgID = tt.impersonated
+			w.write(ev)
+
+			if !tt.written {
+				if buf.Len() != 0 {
+					t.Errorf("event written: %s", buf.String())
+				}
+				return
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("invalid audit event %q: %v", buf.String(), err)
+			}
+			if bytes.Contains(buf.Bytes(), []byte("secret")) {
+				t.Errorf("audit event contains the key: %s", buf.String())
+			}
+			want := map[string]interface{}{
+				"input":    "http",
+				"decision": tt.decision,
+				"keyId":    KeyID([]byte("secret")),
+				"username": "api_key",
+				"orgId":    float64(3),
+				"role":     string(gcom.ROLE_EDITOR),
+				"source":   "10.0.0.1",
+				"route":    "/metrics",
+			}
+			if tt.impersonated != 0 {
+				want["impersonatedOrgId"] = float64(tt.impersonated)
+			}
+			if got["time"] == nil {
+				t.Errorf("audit event has no time: %s", buf.String())
+			}
+			delete(got, "time")
+			if len(got) != len(want) {
+				t.Errorf("audit event = %v, want %v", got, want)
+			}
+			for k, v := range want {
+				if got[k] != v {
+					t.Errorf("audit event %s = %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package auth
 import (
 	"errors"
 	"flag"
+	"strings"
 
 	"github.com/raintank/tsdb-gw/auth/gcom"
 	log "github.com/sirupsen/logrus"
@@ -10,6 +11,7 @@ import (
 
 var (
 	ErrInvalidCredentials = errors.New("invalid authentication credentials")
+	ErrUnknownKey         = errors.New("invalid authentication credentials, unknown key")
 	ErrInvalidOrgId       = errors.New("invalid orgId")
 	ErrInvalidInstanceID  = errors.New("invalid instanceID")
 	ErrInvalidRole        = errors.New("invalid authentication credentials, role unable to publish")
@@ -30,24 +32,57 @@ type User struct {
 	ID      int
 	IsAdmin bool
 	Role    gcom.RoleType
+	// Routes limits the routes the user may access, all routes are
+	// allowed when empty. A trailing '*' matches any suffix.
+	Routes []string
+	// Scopes overrides the scopes granted by the role of the user
+	Scopes []Scope
+}
+
+// AllowsRoute returns whether the user may access the route with the given path
+func (u *User) AllowsRoute(path string) bool {
+	if len(u.Routes) == 0 {
+		return true
+	}
+	for _, r := range u.Routes {
+		if strings.HasSuffix(r, "*") {
+			if strings.HasPrefix(path, strings.TrimSuffix(r, "*")) {
+				return true
+			}
+		} else if path == r {
+			return true
+		}
+	}
+	return false
 }
 
 // AuthPlugin is used to validate access
 type AuthPlugin interface {
-	// Auth returns whether a api_key is a valid and if the user has access to a certain instance
+	// Auth returns whether a api_key is a valid and if the user has access to a certain instance.
+	// ErrUnknownKey is returned when the plugin does not know the key, so the next plugin of a
+	// chain can be tried.
 	Auth(username, password string) (*User, error)
 	Stop()
 }
 
+// GetAuthPlugin returns the named plugin. A comma separated list of names,
+// such as "file,grafana", returns a chain trying each plugin in order.
 func GetAuthPlugin(name string) AuthPlugin {
+	if strings.Contains(name, ",") {
+		return NewChainAuth(strings.Split(name, ","))
+	}
 	log.Debugf("initializing auth plugin %s", name)
-	switch name {
+	switch strings.TrimSpace(name) {
 	case "grafana":
 		return NewGrafanaComAuth()
 	case "grafana-instance":
 		return NewGrafanaComInstanceAuth()
 	case "file":
 		return NewFileAuth()
+	case "jwt":
+		return NewJWTAuth()
+	case "cert":
+		return NewCertAuth()
 	default:
 		log.Fatalf("invalid auth plugin specified, %s", name)
 	}
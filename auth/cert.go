@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+	"github.com/raintank/tsdb-gw/util"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ini.v1"
+)
+
+/*
+Reads an ini file containing a section for each client certificate identity.
+A section matches a verified client certificate when all of its cn, san and ou
+settings match the certificate; the first matching section is used. san
+matches any of the DNS, email or URI subject alternative names.
+
+role defaults to MetricsPublisher, scopes overrides the scopes granted by the
+role. When instance is set the user is the instance, like with the
+grafana-instance plugin.
+
+example:
+------------------
+[metrics-writer]
+cn = metrics-writer.monitoring.svc
+ou = monitoring
+orgId = 1
+role = MetricsPublisher
+
+[cortex-writer]
+san = spiffe://cluster.local/ns/cortex/sa/writer
+orgId = 12
+instance = 1234
+-------------------
+*/
+
+var certAuthFile string
+
+func init() {
+	flag.StringVar(&certAuthFile, "cert-auth-file", "/etc/gw/cert-auth.ini", "path to ini file mapping client certificates to users, for the cert auth plugin")
+}
+
+// CertAuthPlugin is implemented by auth plugins which can authenticate users
+// with the verified certificate they presented when using mutual TLS.
+type CertAuthPlugin interface {
+	// AuthCert returns the user of a verified client certificate.
+	// ErrUnknownKey is returned for certificates the plugin does not know.
+	AuthCert(cert *x509.Certificate) (*User, error)
+}
+
+// CertAuth authenticates users with their client certificate
+type CertAuth struct {
+	sync.RWMutex
+	identities []certIdentity
+	filePath   string
+}
+
+type certIdentity struct {
+	name string
+	cn   string
+	san  string
+	ou   string
+	user User
+}
+
+func NewCertAuth() *CertAuth {
+	log.Infof("loading cert auth file from %s", certAuthFile)
+	a := &CertAuth{
+		filePath: path.Clean(certAuthFile),
+	}
+	if err := a.Load(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	util.WatchFile("cert-auth", a.filePath, a.Load)
+	return a
+}
+
+// Load reads the cert auth file, replacing the current identities if it is valid.
+func (a *CertAuth) Load() error {
+	conf, err := ini.Load(a.filePath)
+	if err != nil {
+		return fmt.Errorf("could not load cert auth file %v: %v", a.filePath, err)
+	}
+
+	var identities []certIdentity
+	for _, section := range conf.Sections() {
+		if section.Name() == "" || section.Name() == "DEFAULT" {
+			continue
+		}
+		id, err := parseCertIdentity(section)
+		if err != nil {
+			return fmt.Errorf("cert auth file %v: %s: %v", a.filePath, section.Name(), err)
+		}
+		identities = append(identities, id)
+	}
+	if len(identities) == 0 {
+		return fmt.Errorf("no certificate identities found in cert-auth-file %v", a.filePath)
+	}
+
+	a.Lock()
+	a.identities = identities
+	a.Unlock()
+	log.Infof("loaded %d certificate identities", len(identities))
+	return nil
+}
+
+func parseCertIdentity(section *ini.Section) (certIdentity, error) {
+	id := certIdentity{
+		name: section.Name(),
+		cn:   section.Key("cn").String(),
+		san:  section.Key("san").String(),
+		ou:   section.Key("ou").String(),
+		user: User{
+			IsAdmin: section.Key("isAdmin").MustBool(false),
+			Role:    gcom.RoleType(section.Key("role").MustString(string(gcom.ROLE_METRICS_PUBLISHER))),
+		},
+	}
+	if id.cn == "" && id.san == "" && id.ou == "" {
+		return id, fmt.Errorf("one of cn, san or ou is required")
+	}
+	if !id.user.Role.IsValid() {
+		return id, fmt.Errorf("invalid role '%v'", id.user.Role)
+	}
+	orgID, err := section.Key("orgId").Int()
+	if err != nil || orgID < 1 {
+		return id, fmt.Errorf("invalid or missing orgId")
+	}
+	id.user.ID = orgID
+	if section.HasKey("instance") {
+		instance, err := section.Key("instance").Int()
+		if err != nil || instance < 1 {
+			return id, fmt.Errorf("invalid instance '%v'", section.Key("instance").String())
+		}
+		id.user.ID = instance
+	}
+	if section.HasKey("scopes") {
+		id.user.Scopes, err = ParseScopes(section.Key("scopes").Strings(","))
+		if err != nil {
+			return id, err
+		}
+	}
+	if section.HasKey("routes") {
+		id.user.Routes = section.Key("routes").Strings(",")
+	}
+	return id, nil
+}
+
+func (id *certIdentity) matches(cert *x509.Certificate) bool {
+	if id.cn != "" && cert.Subject.CommonName != id.cn {
+		return false
+	}
+	if id.ou != "" && !contains(cert.Subject.OrganizationalUnit, id.ou) {
+		return false
+	}
+	if id.san != "" {
+		sans := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+		for _, u := range cert.URIs {
+			sans = append(sans, u.String())
+		}
+		if !contains(sans, id.san) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *CertAuth) AuthCert(cert *x509.Certificate) (*User, error) {
+	a.RLock()
+	defer a.RUnlock()
+	for _, id := range a.identities {
+		if id.matches(cert) {
+			user := id.user
+			return &user, nil
+		}
+	}
+	log.Debugf("auth.cert: no identity matches certificate with subject %q", cert.Subject)
+	return nil, ErrUnknownKey
+}
+
+// Auth only accepts the admin key, users are authenticated with AuthCert.
+func (a *CertAuth) Auth(username, password string) (*User, error) {
+	if password == AdminKey {
+		return AdminUser, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (a *CertAuth) Stop() {
+	return
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+func TestCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cert-auth.ini")
+	content := `
+[writer]
+cn = writer.monitoring.svc
+ou = monitoring
+orgId = 1
+
+[reader]
+cn = reader.monitoring.svc
+orgId = 1
+role = Viewer
+
+[cortex]
+san = spiffe://cluster.local/ns/cortex/sa/writer
+orgId = 12
+instance = 1234
+`
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := &CertAuth{filePath: file}
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/cortex/sa/writer")
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		want    *User
+		wantErr error
+	}{
+		{
+			name: "cn and ou",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "writer.monitoring.svc", OrganizationalUnit: []string{"infra", "monitoring"}}},
+			want: &User{ID: 1, Role: gcom.ROLE_METRICS_PUBLISHER},
+		},
+		{
+			name:    "cn without ou",
+			cert:    &x509.Certificate{Subject: pkix.Name{CommonName: "writer.monitoring.svc"}},
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name: "cn with role",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "reader.monitoring.svc"}},
+			want: &User{ID: 1, Role: gcom.ROLE_VIEWER},
+		},
+		{
+			name: "uri san with instance",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "other"}, URIs: []*url.URL{spiffe}},
+			want: &User{ID: 1234, Role: gcom.ROLE_METRICS_PUBLISHER},
+		},
+		{
+			name:    "unknown",
+			cert:    &x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}, DNSNames: []string{"writer.monitoring.svc"}},
+			wantErr: ErrUnknownKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.AuthCert(tt.cert)
+			if err != tt.wantErr {
+				t.Fatalf("AuthCert() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AuthCert() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := a.Auth("api_key", "writer"); err != ErrUnknownKey {
+		t.Errorf("Auth() error = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestCertAuthInvalidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"no match", "[a]\norgId = 1\n"},
+		{"no org", "[a]\ncn = a\n"},
+		{"invalid role", "[a]\ncn = a\norgId = 1\nrole = Superuser\n"},
+		{"invalid instance", "[a]\ncn = a\norgId = 1\ninstance = x\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "cert-auth.ini")
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			a := &CertAuth{filePath: file}
+			if err := a.Load(); err == nil {
+				t.Errorf("Load() should fail")
+			}
+		})
+	}
+}
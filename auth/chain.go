@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/x509"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChainAuth tries a list of auth plugins in order. The first plugin that
+// accepts or definitively rejects the credentials decides; plugins that
+// return ErrUnknownKey pass the credentials on to the next plugin.
+//
+// This allows, for example, keeping a few internal service keys in the auth
+// file while other users are authenticated by grafana.com, with "file,grafana".
+type ChainAuth struct {
+	plugins []AuthPlugin
+	names   []string
+}
+
+func NewChainAuth(names []string) *ChainAuth {
+	a := &ChainAuth{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		a.plugins = append(a.plugins, GetAuthPlugin(name))
+		a.names = append(a.names, name)
+	}
+	if len(a.plugins) == 0 {
+		log.Fatal("auth.chain: no auth plugins specified")
+	}
+	log.Infof("auth.chain: using auth plugins %s", strings.Join(a.names, ","))
+	return a
+}
+
+func (a *ChainAuth) Auth(username, password string) (*User, error) {
+	for i, p := range a.plugins {
+		user, err := p.Auth(username, password)
+		if err == ErrUnknownKey {
+			continue
+		}
+		if err != nil {
+			log.Debugf("auth.chain: credentials rejected by %s plugin: %v", a.names[i], err)
+			return nil, err
+		}
+		return user, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// AuthCert tries the plugins supporting client certificates in order.
+func (a *ChainAuth) AuthCert(cert *x509.Certificate) (*User, error) {
+	for i, p := range a.plugins {
+		cp, ok := p.(CertAuthPlugin)
+		if !ok {
+			continue
+		}
+		user, err := cp.AuthCert(cert)
+		if err == ErrUnknownKey {
+			continue
+		}
+		if err != nil {
+			log.Debugf("auth.chain: certificate rejected by %s plugin: %v", a.names[i], err)
+			return nil, err
+		}
+		return user, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (a *ChainAuth) Stop() {
+	for _, p := range a.plugins {
+		p.Stop()
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+// staticAuth accepts a single key, and returns err for all other keys
+type staticAuth struct {
+	key     string
+	user    *User
+	err     error
+	stopped bool
+}
+
+func (a *staticAuth) Auth(username, password string) (*User, error) {
+	if password == a.key {
+		return a.user, nil
+	}
+	return nil, a.err
+}
+
+func (a *staticAuth) Stop() {
+	a.stopped = true
+}
+
+func TestChainAuth(t *testing.T) {
+	errBackend := errors.New("backend unavailable")
+	fileUser := &User{ID: 1, Role: gcom.ROLE_ADMIN}
+	gcomUser := &User{ID: 2, Role: gcom.ROLE_EDITOR}
+
+	tests := []struct {
+		name    string
+		plugins []AuthPlugin
+		key     string
+		want    *User
+		wantErr error
+	}{
+		{
+			name: "first plugin accepts",
+			plugins: []AuthPlugin{
+				&staticAuth{key: "service", user: fileUser, err: ErrUnknownKey},
+				&staticAuth{key: "service", user: gcomUser, err: ErrUnknownKey},
+			},
+			key:  "service",
+			want: fileUser,
+		},
+		{
+			name: "falls through on unknown key",
+			plugins: []AuthPlugin{
+				&staticAuth{key: "service", user: fileUser, err: ErrUnknownKey},
+				&staticAuth{key: "customer", user: gcomUser, err: ErrUnknownKey},
+			},
+			key:  "customer",
+			want: gcomUser,
+		},
+		{
+			name: "stops on definitive rejection",
+			plugins: []AuthPlugin{
+				&staticAuth{key: "service", user: fileUser, err: ErrInvalidInstanceID},
+				&staticAuth{key: "customer", user: gcomUser, err: ErrUnknownKey},
+			},
+			key:     "customer",
+			wantErr: ErrInvalidInstanceID,
+		},
+		{
+			name: "stops on error",
+			plugins: []AuthPlugin{
+				&staticAuth{key: "service", user: fileUser, err: errBackend},
+				&staticAuth{key: "customer", user: gcomUser, err: ErrUnknownKey},
+			},
+			key:     "customer",
+			wantErr: errBackend,
+		},
+		{
+			name: "unknown to all plugins",
+			plugins: []AuthPlugin{
+				&staticAuth{key: "service", user: fileUser, err: ErrUnknownKey},
+				&staticAuth{key: "customer", user: gcomUser, err: ErrUnknownKey},
+			},
+			key:     "other",
+			wantErr: ErrUnknownKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &ChainAuth{plugins: tt.plugins, names: []string{"first", "second"}}
+			got, err := a.Auth("api_key", tt.key)
+			if err != tt.wantErr {
+				t.Fatalf("Auth() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Auth() = %+v, want %+v", got, tt.want)
+			}
+			a.Stop()
+			for i, p := range tt.plugins {
+				if !p.(*staticAuth).stopped {
+					t.Errorf("plugin %d not stopped", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+// HashKeyCmd implements the hash-key subcommand, which prints an auth file
+// section with a hashed api key. A random key is generated unless -key is set.
+// pbkdf2-sha256 keys are generated in the form <keyId>_<secret>.
+func HashKeyCmd(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("hash-key", flag.ContinueOnError)
+	fs.SetOutput(out)
+	name := fs.String("name", "", "name of the auth file section (required)")
+	key := fs.String("key", "", "api key to hash, of the form <keyId>_<secret> for pbkdf2-sha256. a random key is generated when empty")
+	org := fs.Int("org", 0, "orgId of the key (required)")
+	role := fs.String("role", string(gcom.ROLE_ADMIN), "role of the key. (Viewer|Editor|MetricsPublisher|Admin)")
+	isAdmin := fs.Bool("admin", false, "whether the key is an admin key")
+	scopes := fs.String("scopes", "", "comma separated list of scopes overriding the scopes of the role. (metrics:read|metrics:write|metrics:delete|admin)")
+	expires := fs.String("expires", "", "RFC3339 timestamp or date after which the key is rejected")
+	routes := fs.String("routes", "", "comma separated list of routes the key may access. a trailing '*' matches any suffix")
+	instances := fs.String("instances", "", "comma separated list of instances of the org")
+	alg := fs.String("hash", hashPBKDF2SHA256, "hash algorithm. (sha256|pbkdf2-sha256)")
+	iterations := fs.Int("iterations", defaultPBKDF2Iterations, "number of pbkdf2 iterations")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	if *org == 0 {
+		return fmt.Errorf("-org is required")
+	}
+	if !gcom.RoleType(*role).IsValid() {
+		return fmt.Errorf("invalid role %q", *role)
+	}
+	if _, err := ParseScopes(splitList(*scopes)); err != nil {
+		return err
+	}
+	if *expires != "" {
+		if _, err := parseExpires(*expires); err != nil {
+			return err
+		}
+	}
+
+	generated := *key == ""
+	if generated {
+		b := make([]byte, 28)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		*key = hex.EncodeToString(b[4:])
+		if *alg == hashPBKDF2SHA256 {
+			*key = hex.EncodeToString(b[:4]) + "_" + *key
+		}
+	}
+	var keyId string
+	if *alg == hashPBKDF2SHA256 {
+		if i := strings.IndexByte(*key, '_'); i > 0 {
+			keyId = (*key)[:i]
+		}
+		if !validKeyId.MatchString(keyId) {
+			return fmt.Errorf("%s keys must have the form <keyId>_<secret>, with a keyId of letters, digits and '-'", hashPBKDF2SHA256)
+		}
+	}
+	h, err := newKeyHash(*alg, *key, *iterations)
+	if err != nil {
+		return err
+	}
+
+	if generated {
+		fmt.Fprintf(out, "# api key: %s\n", *key)
+	}
+	fmt.Fprintf(out, "[%s]\n", *name)
+	if keyId != "" {
+		fmt.Fprintf(out, "keyId = %s\n", keyId)
+	}
+	fmt.Fprintf(out, "key = %s\n", h)
+	fmt.Fprintf(out, "orgId = %d\n", *org)
+	fmt.Fprintf(out, "role = %s\n", *role)
+	if *isAdmin {
+		fmt.Fprintln(out, "isAdmin = true")
+	}
+	if *scopes != "" {
+		fmt.Fprintf(out, "scopes = %s\n", strings.Join(splitList(*scopes), ","))
+	}
+	if *expires != "" {
+		fmt.Fprintf(out, "expires = %s\n", *expires)
+	}
+	if *routes != "" {
+		fmt.Fprintf(out, "routes = %s\n", strings.Join(splitList(*routes), ", "))
+	}
+	if *instances != "" {
+		fmt.Fprintf(out, "instances = %s\n", strings.Join(splitList(*instances), ","))
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -1,10 +1,18 @@
 package auth
 
 import (
+	"container/list"
+	"crypto/sha256"
 	"flag"
+	"fmt"
 	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/raintank/tsdb-gw/auth/gcom"
+	"github.com/raintank/tsdb-gw/util"
 
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/ini.v1"
@@ -14,6 +22,18 @@ import (
 Reads an ini file containing a section for each auth Key.  Each section contains
 the user details associated with that key.
 
+Without a key setting the section name is the key. With a key setting the
+section name is only a label, and the key is the sha256 or pbkdf2-sha256 hash
+of the api key, as generated by the hash-key subcommand.
+
+pbkdf2-sha256 keys have the form <keyId>_<secret>, and the keyId setting holds
+their non-secret keyId, so only the single matching key has to be hashed.
+
+role defaults to Admin. scopes overrides the scopes granted by the role, e.g.
+metrics:read for a key only used to query. expires is an RFC3339 timestamp or
+a date after which the key is rejected. routes limits the key to the listed
+routes, a trailing '*' matches any suffix.
+
 example:
 ------------------
 [aaeipgnq]
@@ -24,14 +44,55 @@ isAdmin = true
 orgId = 23
 isAdmin = false
 instances = 1,2,4
+
+[grafana-agent]
+keyId = 5f3a9c01
+key = pbkdf2-sha256:100000:xTzJgU0ZbjRMPCB4mKDs3g:4kp0L2iM6j8EdqS6+7W3s5Ei0FuCVR4Mv2bj2WLFEAo
+orgId = 23
+role = MetricsPublisher
+scopes = metrics:write
+expires = 2027-01-01
+routes = /metrics, /prometheus/write
 -------------------
 */
 type FileAuth struct {
-	keys        map[string]*User //map auth key to orgId
+	sync.RWMutex
+	keys        map[string]*fileKey // map plaintext auth key to its details
+	sha256Keys  map[[sha256.Size]byte]*fileKey
+	pbkdf2Keys  map[string]*fileKey // by keyId
 	instanceMap map[string]int
 	filePath    string
+
+	// verified caches the result of checking keys against the pbkdf2 hashes,
+	// which is too slow to do for every request. The least recently used
+	// results are evicted.
+	verifiedMu  sync.Mutex
+	verified    map[[sha256.Size]byte]*list.Element
+	verifiedLRU *list.List // of *verifiedKey, the most recently used first
+	verifiedGen int        // incremented on load, so results of checks against removed keys are not cached
+
+	now func() time.Time
+}
+
+type fileKey struct {
+	name    string
+	keyId   string
+	user    User
+	hash    *keyHash
+	expires time.Time
+}
+
+type verifiedKey struct {
+	sum [sha256.Size]byte
+	key *fileKey // nil if the key did not match
 }
 
+// maxVerifiedKeys bounds the cache of verified keys, which also holds keys
+// which did not match the pbkdf2 hash of their keyId.
+var maxVerifiedKeys = 10000
+
+var validKeyId = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
 var filePath string
 
 func init() {
@@ -41,14 +102,26 @@ func init() {
 func NewFileAuth() *FileAuth {
 	log.Infof("loading carbon auth file from %s", filePath)
 	a := &FileAuth{
-		keys:        make(map[string]*User),
-		instanceMap: make(map[string]int),
-		filePath:    path.Clean(filePath),
+		filePath: path.Clean(filePath),
+		now:      time.Now,
 	}
+	if err := a.Load(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	util.WatchFile("auth", a.filePath, a.Load)
+	return a
+}
+
+// Load reads the auth file, replacing the current keys if it is valid.
+func (a *FileAuth) Load() error {
+	keys := make(map[string]*fileKey)
+	sha256Keys := make(map[[sha256.Size]byte]*fileKey)
+	pbkdf2Keys := make(map[string]*fileKey)
+	instanceMap := make(map[string]int)
 
-	conf, err := ini.Load(filePath)
+	conf, err := ini.Load(a.filePath)
 	if err != nil {
-		log.Fatalf("could not load auth file: %v", filePath)
+		return fmt.Errorf("could not load auth file %v: %v", a.filePath, err)
 	}
 
 	for _, section := range conf.Sections() {
@@ -56,70 +129,199 @@ func NewFileAuth() *FileAuth {
 			continue
 		}
 
-		orgKey, err := section.GetKey("orgId")
+		k, err := parseFileKey(section)
 		if err != nil {
-			log.Errorf("auth.file: no orgID defined for org %s", section.Name())
+			return fmt.Errorf("auth file %v: %s: %v", a.filePath, section.Name(), err)
+		}
+		switch {
+		case k.hash == nil:
+			keys[section.Name()] = k
+		case k.hash.alg == hashSHA256:
+			var sum [sha256.Size]byte
+			copy(sum[:], k.hash.sum)
+			sha256Keys[sum] = k
+		default:
+			if _, ok := pbkdf2Keys[k.keyId]; ok {
+				return fmt.Errorf("auth file %v: %s: duplicate keyId '%v'", a.filePath, section.Name(), k.keyId)
+			}
+			pbkdf2Keys[k.keyId] = k
+		}
+
+		if !section.Haskey("instances") {
 			continue
 		}
 
-		orgID, err := orgKey.Int()
+		instanceKey, err := section.GetKey("instances")
 		if err != nil {
-			log.Errorf("auth.file: orgID '%v' is not a int", orgKey.String())
-			continue
+			return fmt.Errorf("auth file %v: %s: error decoding instances: '%v'", a.filePath, section.Name(), err)
+		}
+		instances := instanceKey.Strings(",")
+		for _, i := range instances {
+			instanceMap[i] = k.user.ID
 		}
+	}
+	total := len(keys) + len(sha256Keys) + len(pbkdf2Keys)
+	if total == 0 {
+		return fmt.Errorf("no auth credentials found in auth-file %v", a.filePath)
+	}
 
-		var isAdmin bool
-		if section.Haskey("isadmin") {
-			isAdminKey, err := section.GetKey("isadmin")
-			if err != nil {
-				log.Errorf("auth.file: error decoding isadmin: '%v'", err)
-			}
-			isAdmin = isAdminKey.MustBool(false)
+	a.Lock()
+	a.keys = keys
+	a.sha256Keys = sha256Keys
+	a.pbkdf2Keys = pbkdf2Keys
+	a.instanceMap = instanceMap
+	a.Unlock()
+
+	a.verifiedMu.Lock()
+	a.verified = make(map[[sha256.Size]byte]*list.Element)
+	a.verifiedLRU = list.New()
+	a.verifiedGen++
+	a.verifiedMu.Unlock()
+
+	log.Infof("loaded %d auth keys (%d hashed)", total, len(sha256Keys)+len(pbkdf2Keys))
+	return nil
+}
+
+func parseFileKey(section *ini.Section) (*fileKey, error) {
+	k := &fileKey{
+		name: section.Name(),
+		user: User{Role: gcom.ROLE_ADMIN},
+	}
+
+	orgKey, err := section.GetKey("orgId")
+	if err != nil {
+		return nil, fmt.Errorf("no orgID defined")
+	}
+	k.user.ID, err = orgKey.Int()
+	if err != nil {
+		return nil, fmt.Errorf("orgID '%v' is not a int", orgKey.String())
+	}
+
+	if section.Haskey("isadmin") {
+		k.user.IsAdmin = section.Key("isadmin").MustBool(false)
+	}
+
+	if section.Haskey("role") {
+		k.user.Role = gcom.RoleType(section.Key("role").String())
+		if !k.user.Role.IsValid() {
+			return nil, fmt.Errorf("invalid role '%v'", k.user.Role)
 		}
+	}
 
-		a.keys[section.Name()] = &User{
-			ID:      orgID,
-			IsAdmin: isAdmin,
-			Role:    gcom.ROLE_ADMIN,
+	if section.Haskey("scopes") {
+		k.user.Scopes, err = ParseScopes(section.Key("scopes").Strings(","))
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		if !section.Haskey("instances") {
-			continue
+	if section.Haskey("expires") {
+		k.expires, err = parseExpires(section.Key("expires").String())
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		instanceKey, err := section.GetKey("instances")
+	if section.Haskey("routes") {
+		k.user.Routes = section.Key("routes").Strings(",")
+	}
+
+	if section.Haskey("key") {
+		k.hash, err = parseKeyHash(section.Key("key").String())
 		if err != nil {
-			log.Errorf("auth.file: error decoding instances: '%v'", err)
-			continue
+			return nil, err
 		}
-		instances := instanceKey.Strings(",")
-		for _, i := range instances {
-			a.instanceMap[i] = orgID
+	}
+	if k.hash != nil && k.hash.alg == hashPBKDF2SHA256 {
+		k.keyId = section.Key("keyId").String()
+		if !validKeyId.MatchString(k.keyId) {
+			return nil, fmt.Errorf("invalid keyId '%v', %s keys require a keyId of letters, digits and '-'", k.keyId, hashPBKDF2SHA256)
 		}
 	}
-	if len(a.keys) == 0 {
-		log.Fatalf("no auth credentials found in auth-file.")
+	return k, nil
+}
+
+func parseExpires(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("invalid expires '%v', must be a RFC3339 timestamp or a date", s)
 	}
+	return t, nil
+}
 
-	return a
+// lookup returns the details of the key matching password, or nil. Only the
+// pbkdf2 key with the keyId of password is checked.
+func (a *FileAuth) lookup(password string) (*fileKey, map[string]int) {
+	sum := sha256.Sum256([]byte(password))
+
+	a.verifiedMu.Lock()
+	gen := a.verifiedGen
+	a.verifiedMu.Unlock()
+
+	a.RLock()
+	k, ok := a.keys[password]
+	if !ok {
+		k, ok = a.sha256Keys[sum]
+	}
+	var candidate *fileKey
+	if i := strings.IndexByte(password, '_'); !ok && i > 0 {
+		candidate = a.pbkdf2Keys[password[:i]]
+	}
+	instanceMap := a.instanceMap
+	a.RUnlock()
+	if ok || candidate == nil {
+		return k, instanceMap
+	}
+
+	a.verifiedMu.Lock()
+	if e, ok := a.verified[sum]; ok {
+		a.verifiedLRU.MoveToFront(e)
+		k = e.Value.(*verifiedKey).key
+		a.verifiedMu.Unlock()
+		return k, instanceMap
+	}
+	a.verifiedMu.Unlock()
+
+	if candidate.hash.matches(password) {
+		k = candidate
+	}
+	a.verifiedMu.Lock()
+	if gen == a.verifiedGen {
+		a.verified[sum] = a.verifiedLRU.PushFront(&verifiedKey{sum: sum, key: k})
+		for a.verifiedLRU.Len() > maxVerifiedKeys {
+			oldest := a.verifiedLRU.Remove(a.verifiedLRU.Back()).(*verifiedKey)
+			delete(a.verified, oldest.sum)
+		}
+	}
+	a.verifiedMu.Unlock()
+	return k, instanceMap
 }
 
 func (a *FileAuth) Auth(instanceID, password string) (*User, error) {
 	if password == AdminKey {
 		return AdminUser, nil
 	}
-	user, ok := a.keys[password]
-	if !ok {
-		log.Debugf("key not found: %v", password)
+	k, instanceMap := a.lookup(password)
+	if k == nil {
+		log.Debugf("auth.file: key %s not found", KeyID([]byte(password)))
+		return nil, ErrUnknownKey
+	}
+	if !k.expires.IsZero() && a.now().After(k.expires) {
+		log.Debugf("auth.file: key %s expired at %s", k.name, k.expires)
 		return nil, ErrInvalidCredentials
 	}
 
+	// return a copy, as callers may modify the user
+	user := k.user
 	if user.IsAdmin {
-		return user, nil
+		return &user, nil
 	}
 
 	if instanceID != "api_key" {
-		ID, ok := a.instanceMap[instanceID]
+		ID, ok := instanceMap[instanceID]
 		if !ok {
 			return nil, ErrInvalidInstanceID
 		}
@@ -128,7 +330,7 @@ func (a *FileAuth) Auth(instanceID, password string) (*User, error) {
 		}
 	}
 
-	return user, nil
+	return &user, nil
 }
 
 func (a *FileAuth) Stop() {
@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+func TestFileAuth(t *testing.T) {
+	sha, err := newKeyHash(hashSHA256, "sha-key", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbkdf, err := newKeyHash(hashPBKDF2SHA256, "agent_pbkdf2-key", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "file-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "auth.ini")
+	content := `
+[plain-key]
+orgId = 1
+
+[instance-key]
+orgId = 2
+instances = 10,11
+
+[sha]
+key = ` + sha.String() + `
+orgId = 3
+role = Viewer
+
+[pbkdf2]
+keyId = agent
+key = ` + pbkdf.String() + `
+orgId = 4
+role = MetricsPublisher
+scopes = metrics:write
+routes = /metrics, /prometheus/*
+
+[expired]
+key = sha256:` + strings.Repeat("ab", 32) + `
+orgId = 5
+expires = 2026-01-01
+`
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &FileAuth{filePath: file, now: func() time.Time { return time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC) }}
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.sha256Keys) != 2 || len(a.pbkdf2Keys) != 1 {
+		t.Fatalf("loaded %d sha256 and %d pbkdf2 keys, want 2 and 1", len(a.sha256Keys), len(a.pbkdf2Keys))
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		key      string
+		want     *User
+		wantErr  error
+	}{
+		{name: "plaintext key", username: "api_key", key: "plain-key", want: &User{ID: 1, Role: gcom.ROLE_ADMIN}},
+		{name: "instance", username: "10", key: "instance-key", want: &User{ID: 2, Role: gcom.ROLE_ADMIN}},
+		{name: "wrong instance", username: "12", key: "instance-key", wantErr: ErrInvalidInstanceID},
+		{name: "sha256 key", username: "api_key", key: "sha-key", want: &User{ID: 3, Role: gcom.ROLE_VIEWER}},
+		{name: "section name of hashed key", username: "api_key", key: "sha", wantErr: ErrUnknownKey},
+		{name: "pbkdf2 key", username: "api_key", key: "agent_pbkdf2-key", want: &User{ID: 4, Role: gcom.ROLE_METRICS_PUBLISHER, Scopes: []Scope{ScopeMetricsWrite}, Routes: []string{"/metrics", "/prometheus/*"}}},
+		{name: "pbkdf2 key cached", username: "api_key", key: "agent_pbkdf2-key", want: &User{ID: 4, Role: gcom.ROLE_METRICS_PUBLISHER, Scopes: []Scope{ScopeMetricsWrite}, Routes: []string{"/metrics", "/prometheus/*"}}},
+		{name: "pbkdf2 key wrong secret", username: "api_key", key: "agent_other", wantErr: ErrUnknownKey},
+		{name: "unknown key", username: "api_key", key: "other", wantErr: ErrUnknownKey},
+		{name: "admin key", username: "api_key", key: AdminKey, want: AdminUser},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.Auth(tt.username, tt.key)
+			if err != tt.wantErr {
+				t.Fatalf("Auth() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Auth() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileAuthLoadInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "auth.ini")
+	if err := ioutil.WriteFile(file, []byte("[plain-key]\norgId = 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := &FileAuth{filePath: file, now: time.Now}
+	if err := a.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := newKeyHash(hashPBKDF2SHA256, "agent_secret", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := []string{
+		"[plain-key]\norgId = 1\n\n[bad-role]\norgId = 6\nrole = Superuser\n",
+		"[plain-key]\norgId = 1\n\n[no-org]\nrole = Viewer\n",
+		"[plain-key]\norgId = 1\n\n[no-key-id]\nkey = " + h.String() + "\norgId = 2\n",
+	}
+	for _, content := range invalid {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Load(); err == nil {
+			t.Errorf("Load() of %q should fail", content)
+		}
+		if _, err := a.Auth("api_key", "plain-key"); err != nil {
+			t.Errorf("Auth() after invalid Load() error = %v, the previous keys should be kept", err)
+		}
+		if _, err := a.Auth("api_key", "bad-role"); err != ErrUnknownKey {
+			t.Errorf("Auth() of key in invalid file error = %v, want %v", err, ErrUnknownKey)
+		}
+	}
+}
+
+func TestFileAuthExpires(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	a := &FileAuth{
+		keys: map[string]*fileKey{
+			"valid":   {user: User{ID: 1, Role: gcom.ROLE_ADMIN}, expires: now.Add(time.Second)},
+			"expired": {user: User{ID: 1, Role: gcom.ROLE_ADMIN}, expires: now.Add(-time.Second)},
+		},
+		now: func() time.Time { return now },
+	}
+	if _, err := a.Auth("api_key", "valid"); err != nil {
+		t.Errorf("Auth() of valid key error = %v", err)
+	}
+	if _, err := a.Auth("api_key", "expired"); err != ErrInvalidCredentials {
+		t.Errorf("Auth() of expired key error = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestUserAllowsRoute(t *testing.T) {
+	u := &User{Routes: []string{"/metrics", "/prometheus/*"}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/metrics", true},
+		{"/metrics/delete", false},
+		{"/prometheus/write", true},
+		{"/prometheus", false},
+		{"/graphite/render", false},
+	}
+	for _, tt := range tests {
+		if got := u.AllowsRoute(tt.path); got != tt.want {
+			t.Errorf("AllowsRoute(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if !(&User{}).AllowsRoute("/graphite/render") {
+		t.Errorf("user without routes should be allowed all routes")
+	}
+}
+
+func TestHashKeyCmd(t *testing.T) {
+	var out bytes.Buffer
+	err := HashKeyCmd([]string{"-name", "agent", "-org", "7", "-role", "Viewer", "-key", "secret", "-hash", "sha256", "-routes", "/metrics, /graphite/*"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[agent]
+key = sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b
+orgId = 7
+role = Viewer
+routes = /metrics, /graphite/*
+`
+	if out.String() != want {
+		t.Errorf("HashKeyCmd() output =\n%s\nwant\n%s", out.String(), want)
+	}
+
+	if err := HashKeyCmd([]string{"-name", "agent", "-org", "7", "-role", "Superuser"}, &out); err == nil {
+		t.Errorf("HashKeyCmd() with invalid role should fail")
+	}
+}
+
+func TestFileAuthPBKDF2Lookup(t *testing.T) {
+	h, err := newKeyHash(hashPBKDF2SHA256, "agent_secret", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := maxVerifiedKeys
+	maxVerifiedKeys = 2
+	defer func() { maxVerifiedKeys = orig }()
+
+	k := &fileKey{name: "agent", keyId: "agent", hash: h, user: User{ID: 1, Role: gcom.ROLE_ADMIN}}
+	a := &FileAuth{
+		pbkdf2Keys:  map[string]*fileKey{"agent": k},
+		verified:    make(map[[sha256.Size]byte]*list.Element),
+		verifiedLRU: list.New(),
+		now:         time.Now,
+	}
+
+	// keys without a known keyId are not checked against any pbkdf2 hash
+	for _, key := range []string{"random", "other_secret", "_secret"} {
+		if got, _ := a.lookup(key); got != nil {
+			t.Errorf("lookup(%q) = %v, want nil", key, got)
+		}
+	}
+	if len(a.verified) != 0 {
+		t.Errorf("keys without a known keyId were verified")
+	}
+
+	// the least recently used results are evicted
+	a.lookup("agent_secret")
+	a.lookup("agent_wrong1")
+	a.lookup("agent_secret")
+	a.lookup("agent_wrong2")
+	if len(a.verified) != 2 || a.verifiedLRU.Len() != 2 {
+		t.Fatalf("verified cache holds %d keys and %d list entries, want 2", len(a.verified), a.verifiedLRU.Len())
+	}
+	for key, want := range map[string]bool{"agent_secret": true, "agent_wrong1": false, "agent_wrong2": true} {
+		if _, ok := a.verified[sha256.Sum256([]byte(key))]; ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+	if got, _ := a.lookup("agent_secret"); got != k {
+		t.Errorf("lookup(agent_secret) = %v, want %v", got, k)
+	}
+}
+
+func TestHashKeyCmdPBKDF2(t *testing.T) {
+	var out bytes.Buffer
+	if err := HashKeyCmd([]string{"-name", "agent", "-org", "7", "-key", "agent_secret", "-iterations", "1000"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\nkeyId = agent\n") {
+		t.Errorf("HashKeyCmd() output has no keyId:\n%s", out.String())
+	}
+	if err := HashKeyCmd([]string{"-name", "agent", "-org", "7", "-key", "secret"}, &out); err == nil {
+		t.Errorf("HashKeyCmd() of pbkdf2 key without keyId should fail")
+	}
+
+	out.Reset()
+	if err := HashKeyCmd([]string{"-name", "agent", "-org", "7", "-iterations", "1000"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	key := strings.TrimPrefix(lines[0], "# api key: ")
+	if want := "keyId = " + strings.SplitN(key, "_", 2)[0]; lines[2] != want {
+		t.Errorf("HashKeyCmd() generated key %q with %q, want %q", key, lines[2], want)
+	}
+}
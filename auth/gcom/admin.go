@@ -0,0 +1,216 @@
+package gcom
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// revalidating is set while a revalidation triggered by Revalidate runs
+var revalidating int32
+
+// CacheStats describes the entries of the token or instance cache
+type CacheStats struct {
+	Enabled bool `json:"enabled"`
+	Size    int  `json:"size"`
+	MaxSize int  `json:"maxSize,omitempty"`
+	Valid   int  `json:"valid"`
+	Invalid int  `json:"invalid"`
+	// Stale entries are due to be revalidated
+	Stale int `json:"stale"`
+	// Grace entries are taken from the auth cache snapshot
+	Grace int `json:"grace"`
+}
+
+// SnapshotStats describes the last known good entries of the auth cache snapshot
+type SnapshotStats struct {
+	Enabled   bool   `json:"enabled"`
+	File      string `json:"file,omitempty"`
+	Grace     string `json:"grace,omitempty"`
+	Tokens    int    `json:"tokens"`
+	Instances int    `json:"instances"`
+}
+
+// AuthCacheStats describes the auth caches
+type AuthCacheStats struct {
+	Tokens       CacheStats    `json:"tokens"`
+	Instances    CacheStats    `json:"instances"`
+	Snapshot     SnapshotStats `json:"snapshot"`
+	Revalidating bool          `json:"revalidating"`
+}
+
+// Stats returns the stats of the auth caches.
+func Stats() AuthCacheStats {
+	now := time.Now()
+	stats := AuthCacheStats{
+		Revalidating: atomic.LoadInt32(&revalidating) == 1,
+	}
+	if c := tokenCache; c != nil {
+		stats.Tokens.Enabled = true
+		stats.Tokens.MaxSize = c.maxSize
+		c.Lock()
+		stats.Tokens.Size = len(c.items)
+		for _, i := range c.items {
+			if i.User == nil {
+				stats.Tokens.Invalid++
+				continue
+			}
+			stats.Tokens.Valid++
+			if now.Sub(i.retrieved) >= c.cacheTTL {
+				stats.Tokens.Stale++
+			}
+			if !i.graceUntil.IsZero() {
+				stats.Tokens.Grace++
+			}
+		}
+		c.Unlock()
+	}
+	if c := instanceCache; c != nil {
+		stats.Instances.Enabled = true
+		c.RLock()
+		stats.Instances.Size = len(c.items)
+		for _, i := range c.items {
+			if !i.valid {
+				stats.Instances.Invalid++
+			} else {
+				stats.Instances.Valid++
+			}
+			if now.Sub(i.retrieved) >= c.cacheTTL {
+				stats.Instances.Stale++
+			}
+			if !i.graceUntil.IsZero() {
+				stats.Instances.Grace++
+			}
+		}
+		c.RUnlock()
+	}
+	if s := lastKnownGood; s != nil {
+		stats.Snapshot.Enabled = true
+		stats.Snapshot.File = snapshotFile
+		stats.Snapshot.Grace = snapshotGrace.String()
+		s.Lock()
+		stats.Snapshot.Tokens = len(s.tokens)
+		stats.Snapshot.Instances = len(s.instances)
+		s.Unlock()
+	}
+	return stats
+}
+
+// InvalidateToken removes the token with the given sha256 hash, in hex, from
+// the caches and the auth cache snapshot, along with the instances checked
+// with it. It returns the number of entries removed. The snapshot file is
+// saved straight away, so the token is not restored on restart.
+func InvalidateToken(hash string) int {
+	hash = strings.ToLower(strings.TrimPrefix(hash, "sha256:"))
+	removed := 0
+	if c := tokenCache; c != nil {
+		c.Lock()
+		for k, i := range c.items {
+			if hashKey(k) == hash {
+				c.remove(k, i)
+				removed++
+			}
+		}
+		c.Unlock()
+	}
+	if c := instanceCache; c != nil {
+		c.Lock()
+		for k := range c.items {
+			if idKey := strings.SplitN(k, ":", 2); len(idKey) == 2 && hashKey(idKey[1]) == hash {
+				delete(c.items, k)
+				removed++
+			}
+		}
+		c.Unlock()
+	}
+	if s := lastKnownGood; s != nil {
+		s.Lock()
+		if _, ok := s.tokens[hash]; ok {
+			delete(s.tokens, hash)
+			removed++
+		}
+		for h, i := range s.instances {
+			if i.Token == hash {
+				delete(s.instances, h)
+				removed++
+			}
+		}
+		s.Unlock()
+	}
+	saveSnapshot()
+	log.Infof("Auth: invalidated token %s, removed %d cache entries", hash, removed)
+	return removed
+}
+
+// InvalidateInstance removes the instance from the caches and the auth cache
+// snapshot, for all tokens. It returns the number of entries removed.
+func InvalidateInstance(instanceID string) int {
+	removed := 0
+	if c := instanceCache; c != nil {
+		c.Lock()
+		for k := range c.items {
+			if strings.HasPrefix(k, instanceID+":") {
+				delete(c.items, k)
+				removed++
+			}
+		}
+		c.Unlock()
+	}
+	if s := lastKnownGood; s != nil {
+		s.Lock()
+		for h, i := range s.instances {
+			if i.Instance == instanceID {
+				delete(s.instances, h)
+				removed++
+			}
+		}
+		s.Unlock()
+	}
+	saveSnapshot()
+	log.Infof("Auth: invalidated instance %s, removed %d cache entries", instanceID, removed)
+	return removed
+}
+
+// ClearCaches removes all entries of the caches and of the auth cache
+// snapshot, so every token and instance is validated by grafana.com again.
+func ClearCaches() {
+	if tokenCache != nil {
+		tokenCache.Clear()
+	}
+	if instanceCache != nil {
+		instanceCache.Clear()
+	}
+	if s := lastKnownGood; s != nil {
+		s.Lock()
+		s.tokens = make(map[string]snapshotToken)
+		s.instances = make(map[string]snapshotInstance)
+		s.Unlock()
+	}
+	saveSnapshot()
+	log.Infof("Auth: cleared the auth caches")
+}
+
+// Revalidate revalidates all cached valid tokens and instances in the
+// background, and drops the cached invalid tokens. It returns false if a
+// revalidation is already running.
+func Revalidate() bool {
+	if !atomic.CompareAndSwapInt32(&revalidating, 0, 1) {
+		return false
+	}
+	go func() {
+		defer atomic.StoreInt32(&revalidating, 0)
+		now := time.Now()
+		log.Infof("Auth: revalidating the auth caches")
+		if tokenCache != nil {
+			tokenCache.validateBefore(now, now, now)
+		}
+		if instanceCache != nil {
+			instanceCache.validateBefore(now, now)
+		}
+		saveSnapshot()
+		log.Infof("Auth: revalidated the auth caches in %s", time.Since(now))
+	}()
+	return true
+}
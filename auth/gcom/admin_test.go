@@ -0,0 +1,108 @@
+package gcom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func setupAdminCaches(t *testing.T) {
+	origStore, origFile, origTokens, origInstances := lastKnownGood, snapshotFile, tokenCache, instanceCache
+	t.Cleanup(func() {
+		lastKnownGood, snapshotFile, tokenCache, instanceCache = origStore, origFile, origTokens, origInstances
+	})
+	lastKnownGood, _ = newSnapshotStore([]byte("secret"))
+	snapshotFile = t.TempDir() + "/auth-cache"
+	tokenCache = newTokenCache(time.Hour, time.Minute, 10)
+	instanceCache = &InstanceCache{items: make(map[string]*InstanceResp), cacheTTL: time.Hour}
+
+	tokenCache.Set("a", &SignedInUser{OrgId: 1})
+	tokenCache.Set("b", &SignedInUser{OrgId: 2})
+	tokenCache.Set("c", nil)
+	instanceCache.Set("10:a", true)
+	instanceCache.Set("11:a", true)
+	instanceCache.Set("10:b", false)
+	validated := time.Now().Add(-time.Hour)
+	lastKnownGood.tokens[hashKey("a")] = snapshotToken{Hash: hashKey("a"), Validated: validated}
+	lastKnownGood.instances[hashKey("10:a")] = snapshotInstance{Hash: hashKey("10:a"), Instance: "10", Token: hashKey("a"), Validated: validated}
+}
+
+func TestAuthCacheStats(t *testing.T) {
+	setupAdminCaches(t)
+	stats := Stats()
+	want := AuthCacheStats{
+		Tokens:    CacheStats{Enabled: true, Size: 3, MaxSize: 10, Valid: 2, Invalid: 1},
+		Instances: CacheStats{Enabled: true, Size: 3, Valid: 2, Invalid: 1},
+		Snapshot:  SnapshotStats{Enabled: true, File: snapshotFile, Grace: snapshotGrace.String(), Tokens: 1, Instances: 1},
+	}
+	if stats != want {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+}
+
+func TestAuthCacheInvalidate(t *testing.T) {
+	setupAdminCaches(t)
+
+	if removed := InvalidateToken("sha256:" + hashKey("a")); removed != 5 {
+		t.Errorf("InvalidateToken() removed %d entries, want 5", removed)
+	}
+	if _, ok := tokenCache.Get("a"); ok {
+		t.Errorf("invalidated token still cached")
+	}
+	if _, ok := tokenCache.Get("b"); !ok {
+		t.Errorf("other token not cached")
+	}
+	if len(instanceCache.items) != 1 || len(lastKnownGood.tokens) != 0 || len(lastKnownGood.instances) != 0 {
+		t.Errorf("instances of the invalidated token still cached")
+	}
+
+	if removed := InvalidateInstance("10"); removed != 1 {
+		t.Errorf("InvalidateInstance() removed %d entries, want 1", removed)
+	}
+	if len(instanceCache.items) != 0 {
+		t.Errorf("invalidated instance still cached")
+	}
+
+	ClearCaches()
+	if len(tokenCache.items) != 0 {
+		t.Errorf("ClearCaches() left %d tokens", len(tokenCache.items))
+	}
+}
+
+func TestAuthCacheRevalidate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every key was revoked
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	origEndpoint, origTransport := authEndpoint, client.Transport
+	authEndpoint, client.Transport = srv.URL, http.DefaultTransport
+	defer func() { authEndpoint, client.Transport = origEndpoint, origTransport }()
+	setupAdminCaches(t)
+	// the tokens were used since they were cached
+	tokenCache.items["a"].retrieved = time.Now().Add(-time.Minute)
+	tokenCache.items["b"].retrieved = time.Now().Add(-time.Minute)
+
+	if !Revalidate() {
+		t.Fatal("Revalidate() did not start")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for Stats().Revalidating {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the revalidation")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, key := range []string{"a", "b"} {
+		if user, ok := tokenCache.Get(key); !ok || user != nil {
+			t.Errorf("Get(%s) after revalidation = %v, %v, want nil, true", key, user, ok)
+		}
+	}
+	if _, ok := tokenCache.Get("c"); ok {
+		t.Errorf("invalid token still cached after revalidation")
+	}
+	if valid, _ := instanceCache.Get("10:a"); valid {
+		t.Errorf("revoked instance still valid after revalidation")
+	}
+}
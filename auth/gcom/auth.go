@@ -27,7 +27,9 @@ var validationFailed = promauto.NewCounterVec(prometheus.CounterOpts{
 
 func init() {
 	flag.StringVar(&authEndpoint, "auth-endpoint", authEndpoint, "Endpoint to authenticate users on")
-	flag.DurationVar(&defaultCacheTTL, "auth-cache-ttl", defaultCacheTTL, "how long auth responses should be cached")
+	flag.DurationVar(&defaultCacheTTL, "auth-cache-ttl", defaultCacheTTL, "how long auth responses should be cached. valid tokens are revalidated in the background after this time, and served from the cache meanwhile")
+	flag.DurationVar(&negativeCacheTTL, "auth-negative-cache-ttl", negativeCacheTTL, "how long responses for invalid tokens should be cached")
+	flag.IntVar(&cacheMaxSize, "auth-cache-max-size", cacheMaxSize, "max number of tokens to cache, the least recently used tokens are evicted. (0 disables the limit)")
 	flag.Var(&validOrgIds, "auth-valid-org-id", "restrict authentication to the listed orgId (comma separated list)")
 	flag.StringVar(&validInstanceType, "auth-valid-instance-type", "", "if set, instance validation while fail if the type attribute of an instance does not match. (graphite|graphite-shared|prometheus|logs)")
 	flag.IntVar(&validClusterID, "auth-valid-cluster-id", 0, "if set, instance validation while fail if the cluster id attribute of an instance does not match.")
@@ -168,8 +170,17 @@ func Auth(adminKey, keyString string) (*SignedInUser, error) {
 	// dont return them here.  Instead we cache the response so that
 	// if the token is used again we can reject it straight away.
 	if err != nil && err != ErrInvalidApiKey && err != ErrInvalidOrgId {
+		if user, graceUntil, ok := lastKnownGood.token(keyString, time.Now()); ok {
+			log.Warnf("Auth: could not validate token, using the auth cache snapshot until %s. %s", graceUntil.Format(time.RFC3339), err)
+			lastKnownGoodUsed.WithLabelValues("token").Inc()
+			tokenCache.SetGrace(keyString, user, graceUntil)
+			return user, nil
+		}
 		return nil, err
 	}
+	if err != nil {
+		forgetToken(keyString)
+	}
 
 	// add the user to the cache.
 	tokenCache.Set(keyString, user)
@@ -213,7 +224,7 @@ func validateInstance(instanceID, token string) error {
 	log.Debugf("Auth: %s response was: %s", instanceUrl, body)
 
 	if res.StatusCode >= 500 {
-		return err
+		return fmt.Errorf("Instance could not be validated: %s", res.Status)
 	}
 
 	if res.StatusCode != 200 {
@@ -275,8 +286,17 @@ func (u *SignedInUser) CheckInstance(instanceID string) error {
 	// dont return them here.  Instead we cache the response so that
 	// if the token is used again we can reject it straight away.
 	if err != nil && err != ErrInvalidInstanceID {
+		if graceUntil, ok := lastKnownGood.instance(cachekey, time.Now()); ok {
+			log.Warnf("Auth: could not validate instance, using the auth cache snapshot until %s. %s", graceUntil.Format(time.RFC3339), err)
+			lastKnownGoodUsed.WithLabelValues("instance").Inc()
+			instanceCache.SetGrace(cachekey, graceUntil)
+			return nil
+		}
 		return err
 	}
+	if err != nil {
+		forgetInstance(cachekey)
+	}
 
 	instanceCache.Set(cachekey, (err == nil))
 	return err
@@ -84,7 +84,7 @@ func TestAuth(t *testing.T) {
 		key:       "foo",
 	}
 
-	tokenCache = &TokenCache{items: make(map[string]*TokenResp), cacheTTL: time.Millisecond * 10}
+	tokenCache = newTokenCache(time.Millisecond*10, time.Millisecond*10, 0)
 
 	Convey("When authenticating with adminKey", t, func() {
 		user, err := Auth("key", "key")
@@ -182,11 +182,7 @@ func TestAuth(t *testing.T) {
 	})
 
 	Convey("When cached entry is expired", t, func() {
-		tc := &TokenCache{
-			items:    make(map[string]*TokenResp),
-			stop:     make(chan struct{}),
-			cacheTTL: time.Millisecond * 10,
-		}
+		tc := newTokenCache(time.Millisecond*10, time.Millisecond*10, 0)
 		tc.Set("bar", &testUser)
 		newUser := SignedInUser{
 			Id:        3,
@@ -239,11 +235,7 @@ func TestAuth(t *testing.T) {
 	})
 
 	Convey("When token has not been seen for more than cachettl", t, func() {
-		tc := &TokenCache{
-			items:    make(map[string]*TokenResp),
-			stop:     make(chan struct{}),
-			cacheTTL: time.Millisecond * 10,
-		}
+		tc := newTokenCache(time.Millisecond*10, time.Millisecond*10, 0)
 		tc.Set("bar", &testUser)
 		tokenCache.stop = make(chan struct{})
 		mockTransport.RegisterResponder("POST", "https://grafana.com/api/api-keys/check",
@@ -350,10 +342,7 @@ func TestCheckInstance(t *testing.T) {
 		InstanceType: "graphite",
 	}
 
-	tokenCache = &TokenCache{
-		items:    make(map[string]*TokenResp),
-		cacheTTL: time.Millisecond * 10,
-	}
+	tokenCache = newTokenCache(time.Millisecond*10, time.Millisecond*10, 0)
 	instanceCache = &InstanceCache{
 		items:    make(map[string]*InstanceResp),
 		cacheTTL: time.Millisecond * 10,
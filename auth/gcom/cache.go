@@ -1,33 +1,48 @@
 package gcom
 
 import (
+	"container/list"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	defaultCacheTTL = time.Hour
-	tokenCache      *TokenCache
-	instanceCache   *InstanceCache
+	defaultCacheTTL  = time.Hour
+	negativeCacheTTL = time.Minute
+	cacheMaxSize     = 100000
+	tokenCache       *TokenCache
+	instanceCache    *InstanceCache
+
+	tokenCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "auth_token_cache_evictions_total",
+		Help:      "Number of tokens evicted from the auth cache because it was full.",
+	})
 )
 
 func InitTokenCache() {
 	if tokenCache == nil {
-		tokenCache = &TokenCache{
-			items: make(map[string]*TokenResp),
-			stop:  make(chan struct{}),
-
-			cacheTTL: defaultCacheTTL,
-		}
+		initSnapshot()
+		tokenCache = newTokenCache(defaultCacheTTL, negativeCacheTTL, cacheMaxSize)
 		go tokenCache.backgroundValidation()
 	}
 }
 
+// StopTokenCache stops the background validation of the token cache and
+// saves the auth cache snapshot. It is safe to call more than once, as it is
+// shared by all grafana auth plugins.
 func StopTokenCache() {
-	close(tokenCache.stop)
+	if tokenCache != nil {
+		tokenCache.stopOnce.Do(func() {
+			close(tokenCache.stop)
+			saveSnapshot()
+		})
+	}
 }
 
 func InitInstanceCache() {
@@ -42,54 +57,170 @@ func InitInstanceCache() {
 	}
 }
 
+// StopInstanceCache stops the background validation of the instance cache.
+// It is safe to call more than once, or when the cache was never initialized.
 func StopInstanceCache() {
-	close(instanceCache.stop)
+	if instanceCache != nil {
+		instanceCache.stopOnce.Do(func() { close(instanceCache.stop) })
+	}
 }
 
+// TokenCache caches the responses of grafana.com to token validations.
+// Valid tokens are cached for cacheTTL, after which they are still served
+// while being revalidated in the background. Invalid tokens are cached for
+// the shorter negativeTTL, so keys created after being tried are accepted
+// soon. When the cache holds maxSize tokens, the least recently used token
+// is evicted.
 type TokenCache struct {
-	sync.RWMutex
-	items map[string]*TokenResp
-	stop  chan struct{}
+	sync.Mutex
+	items      map[string]*TokenResp
+	lru        *list.List // of token keys, the most recently used first
+	refreshing map[string]struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
 
-	cacheTTL time.Duration
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+	maxSize     int
 }
 
 type TokenResp struct {
 	User      *SignedInUser
 	retrieved time.Time
 	lastRead  int64
+	elem      *list.Element
+
+	// graceUntil is set for responses taken from the auth cache snapshot
+	// while grafana.com was unreachable, they expire at that time.
+	graceUntil time.Time
 }
 
+func newTokenCache(cacheTTL, negativeTTL time.Duration, maxSize int) *TokenCache {
+	return &TokenCache{
+		items:       make(map[string]*TokenResp),
+		lru:         list.New(),
+		refreshing:  make(map[string]struct{}),
+		stop:        make(chan struct{}),
+		cacheTTL:    cacheTTL,
+		negativeTTL: negativeTTL,
+		maxSize:     maxSize,
+	}
+}
+
+// Get returns the cached user of the token, which is nil for invalid
+// tokens. Expired invalid tokens are not returned, expired valid tokens are
+// returned while they are revalidated asynchronously.
 func (c *TokenCache) Get(key string) (*SignedInUser, bool) {
-	var user *SignedInUser
-	c.RLock()
+	now := time.Now()
+	c.Lock()
 	i, ok := c.items[key]
-	if ok {
-		atomic.StoreInt64(&i.lastRead, time.Now().Unix())
-		user = i.User
+	if !ok {
+		c.Unlock()
+		return nil, false
 	}
-	c.RUnlock()
-	return user, ok
+	if i.User == nil && now.Sub(i.retrieved) >= c.negativeTTL || i.graceExpired(now) {
+		c.remove(key, i)
+		c.Unlock()
+		return nil, false
+	}
+	i.lastRead = now.Unix()
+	c.lru.MoveToFront(i.elem)
+	user := i.User
+	_, refreshing := c.refreshing[key]
+	refresh := user != nil && !refreshing && now.Sub(i.retrieved) >= c.cacheTTL
+	if refresh {
+		c.refreshing[key] = struct{}{}
+	}
+	c.Unlock()
+
+	if refresh {
+		go c.refresh(key)
+	}
+	return user, true
 }
 
 func (c *TokenCache) Set(key string, u *SignedInUser) {
-	log.Debugf("Auth: Caching token validation response for %s", c.cacheTTL.String())
+	ttl := c.cacheTTL
+	if u == nil {
+		ttl = c.negativeTTL
+	}
+	log.Debugf("Auth: Caching token validation response for %s", ttl.String())
+	c.set(key, u, time.Time{})
+}
+
+// SetGrace caches a user taken from the auth cache snapshot, until graceUntil
+// or until the token is validated by grafana.com again.
+func (c *TokenCache) SetGrace(key string, u *SignedInUser, graceUntil time.Time) {
+	c.set(key, u, graceUntil)
+}
+
+func (c *TokenCache) set(key string, u *SignedInUser, graceUntil time.Time) {
 	now := time.Now()
 	c.Lock()
+	if i, ok := c.items[key]; ok {
+		i.User = u
+		i.retrieved = now
+		i.lastRead = now.Unix()
+		i.graceUntil = graceUntil
+		c.lru.MoveToFront(i.elem)
+		c.Unlock()
+		return
+	}
 	c.items[key] = &TokenResp{
-		User:      u,
-		retrieved: now,
-		lastRead:  now.Unix(),
+		User:       u,
+		retrieved:  now,
+		lastRead:   now.Unix(),
+		elem:       c.lru.PushFront(key),
+		graceUntil: graceUntil,
+	}
+	for c.maxSize > 0 && len(c.items) > c.maxSize {
+		oldest := c.lru.Back().Value.(string)
+		c.remove(oldest, c.items[oldest])
+		tokenCacheEvictions.Inc()
 	}
 	c.Unlock()
 }
 
+func (i *TokenResp) graceExpired(now time.Time) bool {
+	return !i.graceUntil.IsZero() && now.After(i.graceUntil)
+}
+
+// remove removes a token from the cache. It must be called with the lock held.
+func (c *TokenCache) remove(key string, i *TokenResp) {
+	c.lru.Remove(i.elem)
+	delete(c.items, key)
+}
+
 func (c *TokenCache) Clear() {
 	c.Lock()
 	c.items = make(map[string]*TokenResp)
+	c.lru.Init()
 	c.Unlock()
 }
 
+// refresh revalidates a token. If grafana.com can not be reached, the cached
+// response is kept.
+func (c *TokenCache) refresh(key string) {
+	user, err := ValidateToken(key)
+	if err == ErrInvalidApiKey || err == ErrInvalidOrgId {
+		// the snapshot must be updated without holding the lock, as
+		// saving it reads the cache
+		forgetToken(key)
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.refreshing, key)
+	if err != nil && err != ErrInvalidApiKey && err != ErrInvalidOrgId {
+		log.Warnf("Could not revalidate token. %s", err)
+		return
+	}
+	if i, ok := c.items[key]; ok {
+		i.User = user
+		i.retrieved = time.Now()
+		i.graceUntil = time.Time{}
+	}
+}
+
 func (c *TokenCache) backgroundValidation() {
 	ticker := time.NewTicker(c.cacheTTL / 2)
 	for {
@@ -98,62 +229,82 @@ func (c *TokenCache) backgroundValidation() {
 			return
 		case t := <-ticker.C:
 			c.validate(t)
+			saveSnapshot()
 		}
 	}
 }
 
 func (c *TokenCache) validate(now time.Time) {
-	oldestAllowed := now.Add(-1 * c.cacheTTL)
-	// We want to hold the ReadLock for as short a time as possible,
+	c.validateBefore(now, now.Add(-1*c.cacheTTL), now.Add(-1*c.negativeTTL))
+}
+
+// validateBefore revalidates the valid tokens retrieved before oldestAllowed,
+// and drops the invalid tokens retrieved before oldestNegative.
+func (c *TokenCache) validateBefore(now, oldestAllowed, oldestNegative time.Time) {
+	// We want to hold the lock for as short a time as possible,
 	// so we lock, then get all of the keys in the cache in one go.
-	c.RLock()
+	// invalid tokens are not revalidated, but dropped once expired.
+	c.Lock()
 	var keys []string
 	for k, v := range c.items {
+		if v.graceExpired(now) {
+			c.remove(k, v)
+			continue
+		}
+		if v.User == nil {
+			if v.retrieved.Before(oldestNegative) {
+				c.remove(k, v)
+			}
+			continue
+		}
 		// if we are past our expiryTime we want this item.
 		if v.retrieved.Before(oldestAllowed) {
 			keys = append(keys, k)
 		}
 	}
-	c.RUnlock()
+	c.Unlock()
 
 	for _, k := range keys {
 		user, err := ValidateToken(k)
-		if err != nil && err != ErrInvalidApiKey {
+		if err != nil && err != ErrInvalidApiKey && err != ErrInvalidOrgId {
 			// we failed to validate the token.  Grafana.com might be down.
 			// The current TokenResp is kept, and we will try to validate it
 			// again in (cacheTTL/2)
 			log.Warnf("Could not validate token. %s", err)
 			continue
 		}
+		if err != nil {
+			forgetToken(k)
+		}
 		c.Lock()
 		v, ok := c.items[k]
 		if !ok {
 			// this can only happen if a.Clear() was called after releasing the
-			// ReadLock and before acquiring the writeLock
+			// lock and before acquiring it again
 			c.Unlock()
 			continue
 		}
 
 		// if lastRead is older than retrieved, then this key has not been used
 		// since it was last validated, so we should drop it from the cache.
-		// we dont need to use atomic.LoadInt64 for lastRead as we are already holding
-		// a writeLock
 		if v.lastRead < v.retrieved.Unix() {
-			delete(c.items, k)
+			c.remove(k, v)
 			c.Unlock()
 			continue
 		}
 
 		v.retrieved = now
 		v.User = user
+		v.graceUntil = time.Time{}
 		c.Unlock()
 	}
 }
 
 type InstanceCache struct {
 	sync.RWMutex
-	items map[string]*InstanceResp
-	stop  chan struct{}
+	items    map[string]*InstanceResp
+	stop     chan struct{}
+	stopOnce sync.Once
 
 	cacheTTL time.Duration
 }
@@ -162,11 +313,18 @@ type InstanceResp struct {
 	valid     bool
 	retrieved time.Time
 	lastRead  int64
+
+	// graceUntil is set for responses taken from the auth cache snapshot
+	// while grafana.com was unreachable, they expire at that time.
+	graceUntil time.Time
 }
 
 func (c *InstanceCache) Get(key string) (bool, bool) {
 	c.RLock()
 	i, ok := c.items[key]
+	if ok && !i.graceUntil.IsZero() && time.Now().After(i.graceUntil) {
+		ok = false
+	}
 	if ok {
 		atomic.StoreInt64(&i.lastRead, time.Now().Unix())
 	}
@@ -179,12 +337,23 @@ func (c *InstanceCache) Get(key string) (bool, bool) {
 }
 
 func (c *InstanceCache) Set(key string, valid bool) {
+	c.set(key, valid, time.Time{})
+}
+
+// SetGrace caches an instance known to be valid from the auth cache snapshot,
+// until graceUntil or until it is validated by grafana.com again.
+func (c *InstanceCache) SetGrace(key string, graceUntil time.Time) {
+	c.set(key, true, graceUntil)
+}
+
+func (c *InstanceCache) set(key string, valid bool, graceUntil time.Time) {
 	now := time.Now()
 	c.Lock()
 	c.items[key] = &InstanceResp{
-		valid:     valid,
-		retrieved: now,
-		lastRead:  now.Unix(),
+		valid:      valid,
+		retrieved:  now,
+		lastRead:   now.Unix(),
+		graceUntil: graceUntil,
 	}
 	c.Unlock()
 }
@@ -208,14 +377,18 @@ func (c *InstanceCache) backgroundValidation() {
 }
 
 func (c *InstanceCache) validate(now time.Time) {
-	oldestAllowed := now.Add(-1 * c.cacheTTL)
+	c.validateBefore(now, now.Add(-1*c.cacheTTL))
+}
+
+// validateBefore revalidates the instances retrieved before oldestAllowed.
+func (c *InstanceCache) validateBefore(now, oldestAllowed time.Time) {
 	// We want to hold the ReadLock for as short a time as possible,
 	// so we lock, then get all of the keys in the cache.
 	c.RLock()
 	var keys []string
 	for k, v := range c.items {
-		// if we are past our expiryTime we want this item.
-		if v.retrieved.Before(oldestAllowed) {
+		// if we are past our expiryTime or grace period we want this item.
+		if v.retrieved.Before(oldestAllowed) || !v.graceUntil.IsZero() && now.After(v.graceUntil) {
 			keys = append(keys, k)
 		}
 	}
@@ -228,8 +401,16 @@ func (c *InstanceCache) validate(now time.Time) {
 			// The current TokenResp is kept, and we will try to validate it
 			// again in (cacheTTL/2)
 			log.Warnf("Could not validate instanceID. %s", err)
+			c.Lock()
+			if v, ok := c.items[k]; ok && !v.graceUntil.IsZero() && now.After(v.graceUntil) {
+				delete(c.items, k)
+			}
+			c.Unlock()
 			continue
 		}
+		if err != nil {
+			forgetInstance(k)
+		}
 		c.Lock()
 		v, ok := c.items[k]
 		if !ok {
@@ -249,6 +430,7 @@ func (c *InstanceCache) validate(now time.Time) {
 
 		v.retrieved = now
 		v.valid = (err == nil)
+		v.graceUntil = time.Time{}
 		c.Unlock()
 	}
 }
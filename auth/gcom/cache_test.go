@@ -0,0 +1,96 @@
+package gcom
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenCacheNegativeTTL(t *testing.T) {
+	tc := newTokenCache(time.Hour, time.Minute, 0)
+	tc.Set("invalid", nil)
+	tc.Set("valid", &SignedInUser{OrgId: 1})
+
+	if user, ok := tc.Get("invalid"); !ok || user != nil {
+		t.Fatalf("Get() of invalid token = %v, %v, want nil, true", user, ok)
+	}
+
+	// expire both, only the invalid token should be dropped
+	tc.items["invalid"].retrieved = time.Now().Add(-2 * time.Minute)
+	tc.items["valid"].retrieved = time.Now().Add(-2 * time.Minute)
+	if _, ok := tc.Get("invalid"); ok {
+		t.Errorf("Get() of expired invalid token should miss")
+	}
+	if _, ok := tc.items["invalid"]; ok {
+		t.Errorf("expired invalid token not removed")
+	}
+	if user, ok := tc.Get("valid"); !ok || user == nil {
+		t.Errorf("Get() of valid token = %v, %v, want user, true", user, ok)
+	}
+}
+
+func TestTokenCacheLRU(t *testing.T) {
+	tc := newTokenCache(time.Hour, time.Minute, 2)
+	tc.Set("a", &SignedInUser{OrgId: 1})
+	tc.Set("b", &SignedInUser{OrgId: 2})
+	tc.Get("a")
+	tc.Set("c", &SignedInUser{OrgId: 3})
+
+	if len(tc.items) != 2 || tc.lru.Len() != 2 {
+		t.Fatalf("cache holds %d items and %d list entries, want 2", len(tc.items), tc.lru.Len())
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := tc.Get(key); ok != want {
+			t.Errorf("Get(%q) cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	tc.Clear()
+	if len(tc.items) != 0 || tc.lru.Len() != 0 {
+		t.Errorf("Clear() left %d items and %d list entries", len(tc.items), tc.lru.Len())
+	}
+}
+
+func TestTokenCacheStaleWhileRevalidate(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		json.NewEncoder(w).Encode(&SignedInUser{OrgId: 2, Role: ROLE_VIEWER})
+	}))
+	defer srv.Close()
+	origEndpoint, origTransport := authEndpoint, client.Transport
+	authEndpoint, client.Transport = srv.URL, http.DefaultTransport
+	defer func() { authEndpoint, client.Transport = origEndpoint, origTransport }()
+
+	tc := newTokenCache(time.Hour, time.Minute, 0)
+	tc.Set("key", &SignedInUser{OrgId: 1, Role: ROLE_EDITOR})
+	tc.items["key"].retrieved = time.Now().Add(-2 * time.Hour)
+
+	// the stale user is returned straight away
+	user, ok := tc.Get("key")
+	if !ok || user.OrgId != 1 {
+		t.Fatalf("Get() of stale token = %v, %v, want the stale user", user, ok)
+	}
+
+	select {
+	case <-requests:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the token to be revalidated")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		user, _ = tc.Get("key")
+		if user.OrgId == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the revalidated user")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(requests) != 0 {
+		t.Errorf("token revalidated %d more times, want once", len(requests))
+	}
+}
@@ -0,0 +1,385 @@
+package gcom
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+The auth cache snapshot holds the tokens and instances validated by
+grafana.com, so a gateway restarting while grafana.com is unreachable can still
+authenticate its users. Tokens are only stored as sha256 hashes, and the
+snapshot is encrypted with AES-GCM using the sha256 of the contents of
+auth-cache-snapshot-key-file as key.
+
+The snapshot is loaded on startup and saved from the caches periodically and on
+shutdown. Its entries are only used when grafana.com can not be reached, and
+only until auth-cache-snapshot-grace after they were last validated. Tokens and
+instances grafana.com reports as invalid are removed from it straight away, so
+revoked keys are not accepted during an outage.
+*/
+
+var (
+	snapshotFile    string
+	snapshotKeyFile string
+	snapshotGrace   = 6 * time.Hour
+
+	snapshotMagic = []byte("GAC1")
+
+	lastKnownGood *snapshotStore
+	// saveMu serializes the saving of snapshots, so an older snapshot
+	// never replaces a newer one
+	saveMu sync.Mutex
+
+	lastKnownGoodUsed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "auth_last_known_good_total",
+		Help:      "Number of validations answered from the auth cache snapshot because grafana.com was unreachable.",
+	}, []string{"type"})
+)
+
+func init() {
+	flag.StringVar(&snapshotFile, "auth-cache-snapshot-file", "", "file the validated tokens are saved to, to authenticate users when grafana.com is unreachable after a restart. (empty disables)")
+	flag.StringVar(&snapshotKeyFile, "auth-cache-snapshot-key-file", "", "file containing the secret the auth cache snapshot is encrypted with. required when auth-cache-snapshot-file is set")
+	flag.DurationVar(&snapshotGrace, "auth-cache-snapshot-grace", snapshotGrace, "max time since a token was last validated by grafana.com for it to be accepted from the auth cache snapshot")
+}
+
+type authSnapshot struct {
+	Saved     time.Time          `json:"saved"`
+	Tokens    []snapshotToken    `json:"tokens"`
+	Instances []snapshotInstance `json:"instances"`
+}
+
+type snapshotToken struct {
+	Hash      string    `json:"hash"`
+	Validated time.Time `json:"validated"`
+	Id        int64     `json:"id"`
+	OrgName   string    `json:"orgName"`
+	OrgId     int64     `json:"orgId"`
+	OrgSlug   string    `json:"orgSlug"`
+	Name      string    `json:"name"`
+	Role      RoleType  `json:"role"`
+}
+
+type snapshotInstance struct {
+	Hash      string    `json:"hash"`
+	Instance  string    `json:"instance"`
+	Token     string    `json:"token"` // the hash of the token
+	Validated time.Time `json:"validated"`
+}
+
+// snapshotStore holds the last known good validations loaded from the
+// snapshot, by the hash of their cache key.
+type snapshotStore struct {
+	sync.Mutex
+	cipher    cipher.AEAD
+	tokens    map[string]snapshotToken
+	instances map[string]snapshotInstance
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// initSnapshot loads the snapshot if one is configured. A missing or
+// unreadable snapshot is logged, as it is only needed during outages.
+func initSnapshot() {
+	if snapshotFile == "" || lastKnownGood != nil {
+		return
+	}
+	if snapshotKeyFile == "" {
+		log.Fatal("auth-cache-snapshot-key-file is required when auth-cache-snapshot-file is set")
+	}
+	secret, err := ioutil.ReadFile(snapshotKeyFile)
+	if err != nil {
+		log.Fatalf("could not read auth-cache-snapshot-key-file: %s", err)
+	}
+	s, err := newSnapshotStore(bytes.TrimSpace(secret))
+	if err != nil {
+		log.Fatalf("invalid auth-cache-snapshot-key-file: %s", err)
+	}
+	lastKnownGood = s
+
+	err = s.loadFile(snapshotFile, time.Now())
+	if os.IsNotExist(err) {
+		log.Infof("Auth: no auth cache snapshot found at %s", snapshotFile)
+		return
+	}
+	if err != nil {
+		log.Errorf("Auth: could not load auth cache snapshot: %s", err)
+		return
+	}
+	log.Infof("Auth: loaded %d tokens and %d instances from the auth cache snapshot", len(s.tokens), len(s.instances))
+}
+
+func newSnapshotStore(secret []byte) (*snapshotStore, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotStore{
+		cipher:    aead,
+		tokens:    make(map[string]snapshotToken),
+		instances: make(map[string]snapshotInstance),
+	}, nil
+}
+
+func (s *snapshotStore) loadFile(file string, now time.Time) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, snapshotMagic) || len(data) < len(snapshotMagic)+s.cipher.NonceSize() {
+		return errors.New("not an auth cache snapshot")
+	}
+	data = data[len(snapshotMagic):]
+	nonce, sealed := data[:s.cipher.NonceSize()], data[s.cipher.NonceSize():]
+	plain, err := s.cipher.Open(nil, nonce, sealed, snapshotMagic)
+	if err != nil {
+		return fmt.Errorf("could not decrypt the snapshot, the key may have changed: %s", err)
+	}
+	var snap authSnapshot
+	if err := json.Unmarshal(plain, &snap); err != nil {
+		return err
+	}
+
+	oldest := now.Add(-snapshotGrace)
+	s.Lock()
+	for _, t := range snap.Tokens {
+		if t.Validated.After(oldest) {
+			s.tokens[t.Hash] = t
+		}
+	}
+	for _, i := range snap.Instances {
+		if i.Validated.After(oldest) {
+			s.instances[i.Hash] = i
+		}
+	}
+	s.Unlock()
+	return nil
+}
+
+// saveFile writes the snapshot atomically, by renaming a temporary file.
+func (s *snapshotStore) saveFile(file string, snap *authSnapshot) error {
+	plain, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, s.cipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := append(append([]byte{}, snapshotMagic...), nonce...)
+	data = s.cipher.Seal(data, nonce, plain, snapshotMagic)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// token returns the last known good user of the token, and until when it may be used.
+func (s *snapshotStore) token(key string, now time.Time) (*SignedInUser, time.Time, bool) {
+	if s == nil {
+		return nil, time.Time{}, false
+	}
+	s.Lock()
+	t, ok := s.tokens[hashKey(key)]
+	s.Unlock()
+	graceUntil := t.Validated.Add(snapshotGrace)
+	if !ok || now.After(graceUntil) {
+		return nil, time.Time{}, false
+	}
+	return &SignedInUser{
+		Id:      t.Id,
+		OrgName: t.OrgName,
+		OrgId:   t.OrgId,
+		OrgSlug: t.OrgSlug,
+		Name:    t.Name,
+		Role:    t.Role,
+		key:     key,
+	}, graceUntil, true
+}
+
+// instance returns whether the instance cache key was last known to be
+// valid, and until when this may be used.
+func (s *snapshotStore) instance(cacheKey string, now time.Time) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	s.Lock()
+	i, ok := s.instances[hashKey(cacheKey)]
+	s.Unlock()
+	graceUntil := i.Validated.Add(snapshotGrace)
+	if !ok || now.After(graceUntil) {
+		return time.Time{}, false
+	}
+	return graceUntil, true
+}
+
+// forgetToken removes a token grafana.com reported as invalid from the last
+// known good entries, along with the instances checked with it, and saves the
+// snapshot if it held the token.
+func forgetToken(key string) {
+	s := lastKnownGood
+	if s == nil {
+		return
+	}
+	hash := hashKey(key)
+	s.Lock()
+	_, found := s.tokens[hash]
+	delete(s.tokens, hash)
+	for h, i := range s.instances {
+		if i.Token == hash {
+			delete(s.instances, h)
+			found = true
+		}
+	}
+	s.Unlock()
+	if found {
+		log.Infof("Auth: removed invalid token %s from the auth cache snapshot", hash)
+		saveSnapshot()
+	}
+}
+
+// forgetInstance removes an instance grafana.com reported as invalid from the
+// last known good entries, and saves the snapshot if it held the instance.
+func forgetInstance(cacheKey string) {
+	s := lastKnownGood
+	if s == nil {
+		return
+	}
+	hash := hashKey(cacheKey)
+	s.Lock()
+	_, found := s.instances[hash]
+	delete(s.instances, hash)
+	s.Unlock()
+	if found {
+		log.Infof("Auth: removed invalid instance %s from the auth cache snapshot", strings.SplitN(cacheKey, ":", 2)[0])
+		saveSnapshot()
+	}
+}
+
+// saveSnapshot saves the valid entries of the caches which are within their
+// grace period, along with the last known good entries loaded from the
+// snapshot which are not cached. Tokens and instances grafana.com reported
+// as invalid, or which were invalidated, were already removed from both.
+func saveSnapshot() {
+	s := lastKnownGood
+	if s == nil {
+		return
+	}
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	now := time.Now()
+	snap := &authSnapshot{Saved: now}
+	oldest := now.Add(-snapshotGrace)
+	saved := make(map[string]struct{})
+
+	if tokenCache != nil {
+		tokenCache.Lock()
+		for key, r := range tokenCache.items {
+			if r.User == nil {
+				continue
+			}
+			validated := r.retrieved
+			if !r.graceUntil.IsZero() {
+				validated = r.graceUntil.Add(-snapshotGrace)
+			}
+			if !validated.After(oldest) {
+				continue
+			}
+			h := hashKey(key)
+			saved[h] = struct{}{}
+			snap.Tokens = append(snap.Tokens, snapshotToken{
+				Hash:      h,
+				Validated: validated,
+				Id:        r.User.Id,
+				OrgName:   r.User.OrgName,
+				OrgId:     r.User.OrgId,
+				OrgSlug:   r.User.OrgSlug,
+				Name:      r.User.Name,
+				Role:      r.User.Role,
+			})
+		}
+		tokenCache.Unlock()
+	}
+	if instanceCache != nil {
+		instanceCache.RLock()
+		for key, r := range instanceCache.items {
+			if !r.valid {
+				continue
+			}
+			validated := r.retrieved
+			if !r.graceUntil.IsZero() {
+				validated = r.graceUntil.Add(-snapshotGrace)
+			}
+			if !validated.After(oldest) {
+				continue
+			}
+			h := hashKey(key)
+			saved[h] = struct{}{}
+			idKey := strings.SplitN(key, ":", 2)
+			snap.Instances = append(snap.Instances, snapshotInstance{Hash: h, Instance: idKey[0], Token: hashKey(idKey[1]), Validated: validated})
+		}
+		instanceCache.RUnlock()
+	}
+
+	// the cache entries are newer than those loaded from the snapshot
+	s.Lock()
+	for h, t := range s.tokens {
+		if _, ok := saved[h]; !ok && t.Validated.After(oldest) {
+			snap.Tokens = append(snap.Tokens, t)
+		}
+	}
+	for h, i := range s.instances {
+		if _, ok := saved[h]; !ok && i.Validated.After(oldest) {
+			snap.Instances = append(snap.Instances, i)
+		}
+	}
+	s.Unlock()
+
+	if err := s.saveFile(snapshotFile, snap); err != nil {
+		log.Errorf("Auth: could not save auth cache snapshot: %s", err)
+		return
+	}
+	log.Debugf("Auth: saved %d tokens and %d instances to the auth cache snapshot %s", len(snap.Tokens), len(snap.Instances), snapshotFile)
+}
@@ -0,0 +1,220 @@
+package gcom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSaveLoad(t *testing.T) {
+	store, err := newSnapshotStore([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "auth-cache")
+
+	origStore, origFile, origTokens, origInstances := lastKnownGood, snapshotFile, tokenCache, instanceCache
+	defer func() {
+		lastKnownGood, snapshotFile, tokenCache, instanceCache = origStore, origFile, origTokens, origInstances
+	}()
+	lastKnownGood, snapshotFile = store, file
+	tokenCache = newTokenCache(time.Hour, time.Minute, 0)
+	tokenCache.Set("valid", &SignedInUser{Id: 3, OrgId: 2, OrgSlug: "org", Role: ROLE_EDITOR})
+	tokenCache.Set("invalid", nil)
+	tokenCache.Set("expired", &SignedInUser{OrgId: 4})
+	tokenCache.items["expired"].retrieved = time.Now().Add(-snapshotGrace - time.Minute)
+	instanceCache = &InstanceCache{items: make(map[string]*InstanceResp)}
+	instanceCache.Set("10:valid", true)
+	instanceCache.Set("11:valid", false)
+	saveSnapshot()
+
+	loaded, _ := newSnapshotStore([]byte("secret"))
+	if err := loaded.loadFile(file, time.Now()); err != nil {
+		t.Fatalf("loadFile() error = %v", err)
+	}
+	now := time.Now()
+	user, _, ok := loaded.token("valid", now)
+	if !ok || user.Id != 3 || user.OrgId != 2 || user.OrgSlug != "org" || user.Role != ROLE_EDITOR || user.key != "valid" {
+		t.Errorf("token(valid) = %+v, %v", user, ok)
+	}
+	for _, key := range []string{"invalid", "expired", "unknown"} {
+		if _, _, ok := loaded.token(key, now); ok {
+			t.Errorf("token(%s) found in the snapshot", key)
+		}
+	}
+	if _, _, ok := loaded.token("valid", now.Add(snapshotGrace+time.Minute)); ok {
+		t.Errorf("token(valid) found after the grace period")
+	}
+	if _, ok := loaded.instance("10:valid", now); !ok {
+		t.Errorf("instance(10:valid) not found in the snapshot")
+	}
+	if _, ok := loaded.instance("11:valid", now); ok {
+		t.Errorf("instance(11:valid) found in the snapshot")
+	}
+
+	other, _ := newSnapshotStore([]byte("other secret"))
+	if err := other.loadFile(file, time.Now()); err == nil {
+		t.Errorf("loadFile() with another secret succeeded")
+	}
+}
+
+func TestSnapshotGraceFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	origEndpoint, origTransport := authEndpoint, client.Transport
+	authEndpoint, client.Transport = srv.URL, http.DefaultTransport
+	origStore, origTokens, origInstances := lastKnownGood, tokenCache, instanceCache
+	defer func() {
+		authEndpoint, client.Transport = origEndpoint, origTransport
+		lastKnownGood, tokenCache, instanceCache = origStore, origTokens, origInstances
+	}()
+
+	lastKnownGood, _ = newSnapshotStore([]byte("secret"))
+	validated := time.Now().Add(-time.Hour)
+	lastKnownGood.tokens[hashKey("known")] = snapshotToken{Hash: hashKey("known"), Validated: validated, OrgId: 5, Role: ROLE_VIEWER}
+	lastKnownGood.tokens[hashKey("old")] = snapshotToken{Hash: hashKey("old"), Validated: time.Now().Add(-snapshotGrace - time.Minute), OrgId: 6}
+	lastKnownGood.instances[hashKey("10:known")] = snapshotInstance{Hash: hashKey("10:known"), Validated: validated}
+	tokenCache = newTokenCache(time.Hour, time.Minute, 0)
+	instanceCache = &InstanceCache{items: make(map[string]*InstanceResp)}
+
+	user, err := Auth("admin", "known")
+	if err != nil || user.OrgId != 5 {
+		t.Fatalf("Auth() of known token = %+v, %v, want the user of the snapshot", user, err)
+	}
+	if got, want := tokenCache.items["known"].graceUntil, validated.Add(snapshotGrace); !got.Equal(want) {
+		t.Errorf("cached token grace until %s, want %s", got, want)
+	}
+	if err := user.CheckInstance("10"); err != nil {
+		t.Errorf("CheckInstance() of known instance error = %v", err)
+	}
+	if err := user.CheckInstance("11"); err == nil {
+		t.Errorf("CheckInstance() of unknown instance succeeded")
+	}
+	if _, err := Auth("admin", "old"); err == nil || err == ErrInvalidApiKey {
+		t.Errorf("Auth() of token validated before the grace period error = %v, want the validation error", err)
+	}
+	if _, err := Auth("admin", "unknown"); err == nil || err == ErrInvalidApiKey {
+		t.Errorf("Auth() of unknown token error = %v, want the validation error", err)
+	}
+
+	// once the grace period is over, the cached token is dropped
+	tokenCache.items["known"].graceUntil = time.Now().Add(-time.Second)
+	if _, ok := tokenCache.Get("known"); ok {
+		t.Errorf("Get() of token past its grace period should miss")
+	}
+}
+
+func TestSnapshotRevokedKey(t *testing.T) {
+	var down int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// the key was revoked
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	origEndpoint, origTransport := authEndpoint, client.Transport
+	authEndpoint, client.Transport = srv.URL, http.DefaultTransport
+	origStore, origFile, origTokens, origInstances := lastKnownGood, snapshotFile, tokenCache, instanceCache
+	defer func() {
+		authEndpoint, client.Transport = origEndpoint, origTransport
+		lastKnownGood, snapshotFile, tokenCache, instanceCache = origStore, origFile, origTokens, origInstances
+	}()
+
+	file := filepath.Join(t.TempDir(), "auth-cache")
+	lastKnownGood, _ = newSnapshotStore([]byte("secret"))
+	snapshotFile = file
+	validated := time.Now().Add(-time.Hour)
+	lastKnownGood.tokens[hashKey("revoked")] = snapshotToken{Hash: hashKey("revoked"), Validated: validated, OrgId: 5}
+	lastKnownGood.tokens[hashKey("other")] = snapshotToken{Hash: hashKey("other"), Validated: validated, OrgId: 6}
+	lastKnownGood.instances[hashKey("10:revoked")] = snapshotInstance{Hash: hashKey("10:revoked"), Instance: "10", Token: hashKey("revoked"), Validated: validated}
+	tokenCache = newTokenCache(time.Hour, time.Minute, 0)
+	instanceCache = &InstanceCache{items: make(map[string]*InstanceResp)}
+
+	if _, err := Auth("admin", "revoked"); err != ErrInvalidApiKey {
+		t.Fatalf("Auth() of revoked key error = %v, want %v", err, ErrInvalidApiKey)
+	}
+
+	// grafana.com goes down once the negative cache entry expired
+	atomic.StoreInt32(&down, 1)
+	tokenCache.Clear()
+	if _, err := Auth("admin", "revoked"); err == nil || err == ErrInvalidApiKey {
+		t.Errorf("Auth() of revoked key during an outage error = %v, want the validation error", err)
+	}
+	if _, ok := lastKnownGood.instance("10:revoked", time.Now()); ok {
+		t.Errorf("instance of the revoked key still in the snapshot")
+	}
+
+	// the saved snapshot holds the unused key, but not the revoked key
+	loaded, _ := newSnapshotStore([]byte("secret"))
+	if err := loaded.loadFile(file, time.Now()); err != nil {
+		t.Fatalf("loadFile() error = %v", err)
+	}
+	if _, _, ok := loaded.token("revoked", time.Now()); ok {
+		t.Errorf("revoked key found in the saved snapshot")
+	}
+	if user, _, ok := loaded.token("other", time.Now()); !ok || user.OrgId != 6 {
+		t.Errorf("token(other) = %+v, %v, want the unused key to be kept", user, ok)
+	}
+	if len(loaded.instances) != 0 {
+		t.Errorf("saved snapshot holds %d instances, want none", len(loaded.instances))
+	}
+}
+
+func TestSnapshotKeepsUnusedEntries(t *testing.T) {
+	origStore, origFile, origTokens, origInstances := lastKnownGood, snapshotFile, tokenCache, instanceCache
+	defer func() {
+		lastKnownGood, snapshotFile, tokenCache, instanceCache = origStore, origFile, origTokens, origInstances
+	}()
+	file := filepath.Join(t.TempDir(), "auth-cache")
+	lastKnownGood, _ = newSnapshotStore([]byte("secret"))
+	snapshotFile = file
+	validated := time.Now().Add(-time.Hour)
+	lastKnownGood.tokens[hashKey("unused")] = snapshotToken{Hash: hashKey("unused"), Validated: validated, OrgId: 5}
+	lastKnownGood.tokens[hashKey("cached")] = snapshotToken{Hash: hashKey("cached"), Validated: validated, OrgId: 6}
+	lastKnownGood.tokens[hashKey("expired")] = snapshotToken{Hash: hashKey("expired"), Validated: time.Now().Add(-snapshotGrace - time.Minute), OrgId: 7}
+	lastKnownGood.instances[hashKey("10:unused")] = snapshotInstance{Hash: hashKey("10:unused"), Instance: "10", Token: hashKey("unused"), Validated: validated}
+	tokenCache = newTokenCache(time.Hour, time.Minute, 0)
+	tokenCache.Set("cached", &SignedInUser{OrgId: 8})
+	instanceCache = &InstanceCache{items: make(map[string]*InstanceResp)}
+	saveSnapshot()
+
+	loaded, _ := newSnapshotStore([]byte("secret"))
+	if err := loaded.loadFile(file, time.Now()); err != nil {
+		t.Fatalf("loadFile() error = %v", err)
+	}
+	now := time.Now()
+	if user, _, ok := loaded.token("unused", now); !ok || user.OrgId != 5 {
+		t.Errorf("token(unused) = %+v, %v", user, ok)
+	}
+	// the cached entry is saved instead of the one loaded from the snapshot
+	if user, _, ok := loaded.token("cached", now); !ok || user.OrgId != 8 {
+		t.Errorf("token(cached) = %+v, %v, want the cached user", user, ok)
+	}
+	if len(loaded.tokens) != 2 {
+		t.Errorf("saved snapshot holds %d tokens, want 2", len(loaded.tokens))
+	}
+	if _, ok := loaded.instance("10:unused", now); !ok {
+		t.Errorf("instance(10:unused) not found in the snapshot")
+	}
+
+	// forgotten entries are not saved again
+	forgetToken("unused")
+	loaded, _ = newSnapshotStore([]byte("secret"))
+	if err := loaded.loadFile(file, time.Now()); err != nil {
+		t.Fatalf("loadFile() error = %v", err)
+	}
+	if _, _, ok := loaded.token("unused", now); ok {
+		t.Errorf("forgotten token(unused) found in the snapshot")
+	}
+	if len(loaded.instances) != 0 {
+		t.Errorf("saved snapshot holds %d instances, want none", len(loaded.instances))
+	}
+}
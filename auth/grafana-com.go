@@ -18,7 +18,7 @@ func (a *GrafanaComAuth) Auth(username, password string) (*User, error) {
 	u, err := gcom.Auth(AdminKey, password)
 	if err != nil {
 		if err == gcom.ErrInvalidApiKey {
-			return nil, ErrInvalidCredentials
+			return nil, ErrUnknownKey
 		}
 		if err == gcom.ErrInvalidOrgId {
 			return nil, ErrInvalidOrgId
@@ -26,7 +26,7 @@ func (a *GrafanaComInstanceAuth) Auth(username, password string) (*User, error)
 	if err != nil {
 		if err == gcom.ErrInvalidApiKey {
 			log.Debugf("failed to authenticate request: %v", err)
-			return nil, ErrInvalidCredentials
+			return nil, ErrUnknownKey
 		}
 		if err == gcom.ErrInvalidOrgId {
 			log.Debugf("failed to authenticate request: %v", err)
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	failureLimit       int
+	failureWindow      time.Duration
+	lockoutDuration    time.Duration
+	globalFailureLimit int
+
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "auth_failures_total",
+		Help:      "Number of failed authentications.",
+	}, []string{"input"})
+	authBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "auth_blocked_total",
+		Help:      "Number of authentications rejected because the source is locked out.",
+	}, []string{"input"})
+	authLockouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "auth_lockouts_total",
+		Help:      "Number of sources locked out after too many failed authentications.",
+	}, []string{"input", "reason"})
+	authLockedSources = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "auth_locked_sources",
+		Help:      "Number of sources currently locked out.",
+	}, []string{"input"})
+)
+
+func init() {
+	flag.IntVar(&failureLimit, "auth-failure-limit", 20, "number of failed authentications from a source address within auth-failure-window after which it is locked out. (0 disables)")
+	flag.DurationVar(&failureWindow, "auth-failure-window", time.Minute, "window in which failed authentications are counted")
+	flag.DurationVar(&lockoutDuration, "auth-lockout-duration", 5*time.Minute, "duration for which a source address is locked out")
+	flag.IntVar(&globalFailureLimit, "auth-global-failure-limit", 1000, "number of failed authentications from all sources within auth-failure-window after which every source failing to authenticate is locked out, to defend against distributed attacks. (0 disables)")
+}
+
+// FailureGuard locks out source addresses with too many failed
+// authentications, to protect against brute-force attacks on api keys.
+// Requests from locked out sources must be rejected without authenticating.
+type FailureGuard struct {
+	sync.Mutex
+	input   string
+	sources map[string]*sourceFailures
+
+	globalStart    time.Time
+	globalFailures int
+	lastSweep      time.Time
+
+	limit       int
+	globalLimit int
+	window      time.Duration
+	lockout     time.Duration
+	now         func() time.Time
+}
+
+type sourceFailures struct {
+	windowStart time.Time
+	failures    int
+	lockedUntil time.Time
+}
+
+// NewFailureGuard returns a FailureGuard for the given input, e.g. http or carbon.
+func NewFailureGuard(input string) *FailureGuard {
+	return &FailureGuard{
+		input:       input,
+		sources:     make(map[string]*sourceFailures),
+		limit:       failureLimit,
+		globalLimit: globalFailureLimit,
+		window:      failureWindow,
+		lockout:     lockoutDuration,
+		now:         time.Now,
+	}
+}
+
+// Blocked returns whether source is locked out and for how much longer.
+func (g *FailureGuard) Blocked(source string) (bool, time.Duration) {
+	now := g.now()
+	g.Lock()
+	var remaining time.Duration
+	if s, ok := g.sources[source]; ok {
+		remaining = s.lockedUntil.Sub(now)
+	}
+	g.Unlock()
+	if remaining <= 0 {
+		return false, 0
+	}
+	authBlocked.WithLabelValues(g.input).Inc()
+	return true, remaining
+}
+
+// Failure records a failed authentication from source, locking it out when
+// it exceeded its limit, or when all sources together exceeded theirs.
+func (g *FailureGuard) Failure(source string) {
+	authFailures.WithLabelValues(g.input).Inc()
+	now := g.now()
+
+	g.Lock()
+	defer g.Unlock()
+
+	if now.Sub(g.globalStart) >= g.window {
+		g.globalStart = now
+		g.globalFailures = 0
+	}
+	g.globalFailures++
+	g.sweep(now)
+
+	if source == "" {
+		return
+	}
+	s, ok := g.sources[source]
+	if !ok {
+		s = &sourceFailures{windowStart: now}
+		g.sources[source] = s
+	}
+	if now.Sub(s.windowStart) >= g.window {
+		s.windowStart = now
+		s.failures = 0
+	}
+	s.failures++
+	if now.Before(s.lockedUntil) {
+		return
+	}
+
+	switch {
+	case g.limit > 0 && s.failures >= g.limit:
+		log.Warnf("auth: locking out %s source %s for %s after %d failed authentications", g.input, source, g.lockout, s.failures)
+		authLockouts.WithLabelValues(g.input, "source").Inc()
+	case g.globalLimit > 0 && g.globalFailures > g.globalLimit:
+		log.Warnf("auth: locking out %s source %s for %s, as %d authentications failed from all sources", g.input, source, g.lockout, g.globalFailures)
+		authLockouts.WithLabelValues(g.input, "global").Inc()
+	default:
+		return
+	}
+	s.lockedUntil = now.Add(g.lockout)
+}
+
+// sweep removes the sources which are neither locked out nor have recent
+// failures, at most once per window. It must be called with the lock held.
+func (g *FailureGuard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.window {
+		return
+	}
+	g.lastSweep = now
+	locked := 0
+	for source, s := range g.sources {
+		if now.Before(s.lockedUntil) {
+			locked++
+			continue
+		}
+		if now.Sub(s.windowStart) >= g.window {
+			delete(g.sources, source)
+		}
+	}
+	authLockedSources.WithLabelValues(g.input).Set(float64(locked))
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureGuard(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	g := &FailureGuard{
+		input:       "test",
+		sources:     make(map[string]*sourceFailures),
+		limit:       3,
+		globalLimit: 5,
+		window:      time.Minute,
+		lockout:     5 * time.Minute,
+		now:         func() time.Time { return now },
+	}
+	blocked := func(source string) bool {
+		b, _ := g.Blocked(source)
+		return b
+	}
+
+	// failures spread over several windows don't lock out the source
+	for i := 0; i < 4; i++ {
+		g.Failure("10.0.0.1")
+		now = now.Add(40 * time.Second)
+	}
+	if blocked("10.0.0.1") {
+		t.Fatalf("source locked out by failures in different windows")
+	}
+
+	// the limit within a window locks out the source
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		g.Failure("10.0.0.2")
+	}
+	if !blocked("10.0.0.2") {
+		t.Fatalf("source not locked out after reaching the limit")
+	}
+	if blocked("10.0.0.3") {
+		t.Fatalf("other source locked out")
+	}
+	if _, retryAfter := g.Blocked("10.0.0.2"); retryAfter != 5*time.Minute {
+		t.Errorf("Blocked() retry after = %s, want %s", retryAfter, 5*time.Minute)
+	}
+
+	// exceeding the global limit locks out every failing source
+	g.Failure("10.0.0.3")
+	g.Failure("10.0.0.4")
+	if blocked("10.0.0.3") {
+		t.Fatalf("source locked out before the global limit was exceeded")
+	}
+	g.Failure("10.0.0.5")
+	if !blocked("10.0.0.5") {
+		t.Fatalf("source not locked out after exceeding the global limit")
+	}
+
+	// lockouts expire, and expired sources are removed
+	now = now.Add(5 * time.Minute)
+	if blocked("10.0.0.2") {
+		t.Fatalf("source still locked out after the lockout duration")
+	}
+	g.Failure("10.0.0.6")
+	if _, ok := g.sources["10.0.0.2"]; ok {
+		t.Errorf("expired source not removed")
+	}
+}
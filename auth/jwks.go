@@ -0,0 +1,249 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// minJWKSRefresh is the minimum time between fetching the JWKS because of
+// tokens signed with an unknown key id.
+const minJWKSRefresh = time.Minute
+
+// jwk is a single JSON Web Key, as defined in RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// jwks fetches and caches the keys of a JSON Web Key Set URL
+type jwks struct {
+	sync.RWMutex
+	url         string
+	client      *http.Client
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+	refreshMu   sync.Mutex
+	done        chan struct{}
+}
+
+func newJWKS(url string, refreshInterval time.Duration) *jwks {
+	j := &jwks{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]crypto.PublicKey),
+		done:   make(chan struct{}),
+	}
+	if err := j.refresh(); err != nil {
+		log.Errorf("auth.jwt: failed to fetch JWKS from %s: %v", url, err)
+	}
+	if refreshInterval > 0 {
+		go j.run(refreshInterval)
+	}
+	return j
+}
+
+func (j *jwks) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.refresh(); err != nil {
+				log.Errorf("auth.jwt: failed to refresh JWKS from %s, keeping current keys: %v", j.url, err)
+			}
+		case <-j.done:
+			return
+		}
+	}
+}
+
+func (j *jwks) stop() {
+	close(j.done)
+}
+
+func (j *jwks) refresh() error {
+	j.refreshMu.Lock()
+	defer j.refreshMu.Unlock()
+	return j.fetch()
+}
+
+// fetch replaces the keys with those fetched from the url. refreshMu must be held.
+func (j *jwks) fetch() error {
+	j.lastRefresh = time.Now()
+
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Warnf("auth.jwt: ignoring JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return errors.New("no usable keys found")
+	}
+	j.Lock()
+	j.keys = keys
+	j.Unlock()
+	return nil
+}
+
+// get returns the key with the given key id. Unknown key ids trigger a
+// refresh, at most once per minJWKSRefresh, to pick up rotated keys.
+// Concurrent requests wait for the refresh instead of starting their own.
+func (j *jwks) get(kid string) (crypto.PublicKey, bool) {
+	j.RLock()
+	key, ok := j.keys[kid]
+	j.RUnlock()
+	if ok {
+		return key, true
+	}
+	j.refreshMu.Lock()
+	defer j.refreshMu.Unlock()
+	// the keys may have been refreshed while waiting for the lock
+	j.RLock()
+	key, ok = j.keys[kid]
+	j.RUnlock()
+	if ok || time.Since(j.lastRefresh) <= minJWKSRefresh {
+		return key, ok
+	}
+	if err := j.fetch(); err != nil {
+		log.Errorf("auth.jwt: failed to refresh JWKS from %s: %v", j.url, err)
+		return nil, false
+	}
+	j.RLock()
+	key, ok = j.keys[kid]
+	j.RUnlock()
+	return key, ok
+}
+
+// all returns all keys, without triggering a refresh.
+func (j *jwks) all() []crypto.PublicKey {
+	j.RLock()
+	defer j.RUnlock()
+	keys := make([]crypto.PublicKey, 0, len(j.keys))
+	for _, key := range j.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// readPublicKeys reads the PEM encoded public keys and certificates in file
+func readPublicKeys(file string) ([]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "RSA PUBLIC KEY":
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found in %s", file)
+	}
+	return keys, nil
+}
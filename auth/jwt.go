@@ -0,0 +1,374 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+Validates bearer tokens which are JSON Web Tokens signed with HS256, RS256
+or ES256. The token is taken from the password, so both bearer tokens and
+basic auth with the token as password work; the username is ignored.
+
+Keys are read from jwt-key-file (PEM public keys or certificates), fetched
+from jwt-jwks-url, or for HS256 read from jwt-hmac-secret-file. Tokens must
+be signed with an algorithm matching the type of the configured keys, and
+must have an expiry (exp claim).
+
+The org, role and admin flag of the user are read from the claims named by
+jwt-org-claim, jwt-role-claim and jwt-admin-claim. Nested claims can be
+referenced by joining the names with dots, e.g. "grafana.org_id".
+*/
+
+var (
+	jwtKeyFile          string
+	jwtHMACSecretFile   string
+	jwtJWKSURL          string
+	jwtJWKSRefresh      time.Duration
+	jwtOrgClaim         string
+	jwtRoleClaim        string
+	jwtAdminClaim       string
+	jwtDefaultRole      string
+	jwtIssuer           string
+	jwtAudience         string
+	jwtLeeway           time.Duration
+	errJWTNotAToken     = errors.New("not a token")
+	errJWTMalformed     = errors.New("malformed token")
+	errJWTSignature     = errors.New("invalid token signature")
+	errJWTUnknownKey    = errors.New("unknown signing key")
+	errJWTUnsupported   = errors.New("unsupported signing algorithm")
+	errJWTExpired       = errors.New("token is expired")
+	errJWTNoExpiry      = errors.New("token has no expiry")
+	errJWTNotYetValid   = errors.New("token is not valid yet")
+	errJWTInvalidClaims = errors.New("invalid token claims")
+)
+
+func init() {
+	flag.StringVar(&jwtKeyFile, "jwt-key-file", "", "path to PEM file containing the RSA or ECDSA public keys or certificates used to verify RS256 and ES256 tokens")
+	flag.StringVar(&jwtHMACSecretFile, "jwt-hmac-secret-file", "", "path to file containing the secret used to verify HS256 tokens")
+	flag.StringVar(&jwtJWKSURL, "jwt-jwks-url", "", "url of a JSON Web Key Set containing the keys used to verify RS256 and ES256 tokens")
+	flag.DurationVar(&jwtJWKSRefresh, "jwt-jwks-refresh-interval", time.Hour, "interval at which the JSON Web Key Set is refreshed")
+	flag.StringVar(&jwtOrgClaim, "jwt-org-claim", "org_id", "claim containing the orgId of the user")
+	flag.StringVar(&jwtRoleClaim, "jwt-role-claim", "role", "claim containing the role of the user")
+	flag.StringVar(&jwtAdminClaim, "jwt-admin-claim", "is_admin", "claim containing whether the user is an admin")
+	flag.StringVar(&jwtDefaultRole, "jwt-default-role", string(gcom.ROLE_VIEWER), "role of users whose token does not contain the role claim")
+	flag.StringVar(&jwtIssuer, "jwt-issuer", "", "required issuer (iss) of tokens. (empty disables the check)")
+	flag.StringVar(&jwtAudience, "jwt-audience", "", "required audience (aud) of tokens. (empty disables the check)")
+	flag.DurationVar(&jwtLeeway, "jwt-leeway", 30*time.Second, "allowed clock skew when checking the exp and nbf claims")
+}
+
+// JWTAuth authenticates users with JSON Web Tokens
+type JWTAuth struct {
+	hmacSecret []byte
+	keys       []crypto.PublicKey
+	jwks       *jwks
+
+	orgClaim    string
+	roleClaim   string
+	adminClaim  string
+	defaultRole gcom.RoleType
+	issuer      string
+	audience    string
+	leeway      time.Duration
+	now         func() time.Time
+}
+
+func NewJWTAuth() *JWTAuth {
+	a := &JWTAuth{
+		orgClaim:    jwtOrgClaim,
+		roleClaim:   jwtRoleClaim,
+		adminClaim:  jwtAdminClaim,
+		defaultRole: gcom.RoleType(jwtDefaultRole),
+		issuer:      jwtIssuer,
+		audience:    jwtAudience,
+		leeway:      jwtLeeway,
+		now:         time.Now,
+	}
+	if !a.defaultRole.IsValid() {
+		log.Fatalf("auth.jwt: invalid jwt-default-role %q", jwtDefaultRole)
+	}
+	if jwtHMACSecretFile != "" {
+		secret, err := ioutil.ReadFile(jwtHMACSecretFile)
+		if err != nil {
+			log.Fatalf("auth.jwt: could not read hmac secret file: %v", err)
+		}
+		a.hmacSecret = bytes.TrimSpace(secret)
+	}
+	if jwtKeyFile != "" {
+		keys, err := readPublicKeys(jwtKeyFile)
+		if err != nil {
+			log.Fatalf("auth.jwt: could not read key file: %v", err)
+		}
+		a.keys = keys
+	}
+	if jwtJWKSURL != "" {
+		a.jwks = newJWKS(jwtJWKSURL, jwtJWKSRefresh)
+	}
+	if len(a.hmacSecret) == 0 && len(a.keys) == 0 && a.jwks == nil {
+		log.Fatal("auth.jwt: one of jwt-key-file, jwt-jwks-url or jwt-hmac-secret-file is required")
+	}
+	return a
+}
+
+func (a *JWTAuth) Auth(username, password string) (*User, error) {
+	if password == AdminKey {
+		return AdminUser, nil
+	}
+	claims, err := a.verify(password)
+	if err == errJWTNotAToken {
+		return nil, ErrUnknownKey
+	}
+	if err != nil {
+		log.Debugf("auth.jwt: rejected token: %v", err)
+		return nil, ErrInvalidCredentials
+	}
+	user, err := a.user(claims)
+	if err != nil {
+		log.Debugf("auth.jwt: rejected token: %v", err)
+		return nil, err
+	}
+	return user, nil
+}
+
+func (a *JWTAuth) Stop() {
+	if a.jwks != nil {
+		a.jwks.stop()
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature and the time based claims of the token and
+// returns its claims.
+func (a *JWTAuth) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTNotAToken
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errJWTNotAToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := a.verifySignature(header, signed, sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (a *JWTAuth) verifySignature(header jwtHeader, signed, sig []byte) error {
+	switch header.Alg {
+	case "HS256":
+		if len(a.hmacSecret) == 0 {
+			return errJWTUnsupported
+		}
+		mac := hmac.New(sha256.New, a.hmacSecret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errJWTSignature
+		}
+		return nil
+	case "RS256", "ES256":
+		hash := sha256.Sum256(signed)
+		for _, key := range a.candidateKeys(header.Alg, header.Kid) {
+			if verifyWithKey(header.Alg, key, hash[:], sig) {
+				return nil
+			}
+		}
+		return errJWTSignature
+	}
+	return errJWTUnsupported
+}
+
+// candidateKeys returns the keys which may have signed a token with the given
+// algorithm and key id. Tokens without a key id, or with one which is not in
+// the JWKS, are checked against all JWKS keys of the type of the algorithm.
+// Only tokens with a key id trigger a refresh of the JWKS.
+func (a *JWTAuth) candidateKeys(alg, kid string) []crypto.PublicKey {
+	if a.jwks == nil {
+		return a.keys
+	}
+	if kid != "" {
+		if key, ok := a.jwks.get(kid); ok {
+			return append([]crypto.PublicKey{key}, a.keys...)
+		}
+	}
+	keys := append([]crypto.PublicKey{}, a.keys...)
+	for _, key := range a.jwks.all() {
+		if keyMatchesAlg(alg, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func keyMatchesAlg(alg string, key crypto.PublicKey) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256"
+	}
+	return false
+}
+
+func verifyWithKey(alg string, key crypto.PublicKey, hash, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || k.Curve.Params().BitSize != 256 || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, hash, r, s)
+	}
+	return false
+}
+
+func (a *JWTAuth) validateClaims(claims map[string]interface{}) error {
+	now := a.now()
+	exp, ok := claims["exp"]
+	if !ok {
+		return errJWTNoExpiry
+	}
+	t, ok := numericClaim(exp)
+	if !ok {
+		return errJWTInvalidClaims
+	}
+	if now.After(time.Unix(t, 0).Add(a.leeway)) {
+		return errJWTExpired
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		t, ok := numericClaim(nbf)
+		if !ok {
+			return errJWTInvalidClaims
+		}
+		if now.Add(a.leeway).Before(time.Unix(t, 0)) {
+			return errJWTNotYetValid
+		}
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return errJWTInvalidClaims
+	}
+	if a.audience != "" && !hasAudience(claims["aud"], a.audience) {
+		return errJWTInvalidClaims
+	}
+	return nil
+}
+
+// user maps the claims to a User
+func (a *JWTAuth) user(claims map[string]interface{}) (*User, error) {
+	org, ok := numericClaim(lookupClaim(claims, a.orgClaim))
+	if !ok || org <= 0 {
+		return nil, ErrInvalidOrgId
+	}
+	user := &User{
+		ID:   int(org),
+		Role: a.defaultRole,
+	}
+	if role, ok := lookupClaim(claims, a.roleClaim).(string); ok {
+		user.Role = gcom.RoleType(role)
+		if !user.Role.IsValid() {
+			return nil, ErrInvalidRole
+		}
+	}
+	switch admin := lookupClaim(claims, a.adminClaim).(type) {
+	case bool:
+		user.IsAdmin = admin
+	case string:
+		user.IsAdmin, _ = strconv.ParseBool(admin)
+	}
+	return user, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// lookupClaim returns the claim with the given name. names containing dots
+// reference nested claims.
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	if v, ok := claims[name]; ok {
+		return v
+	}
+	parts := strings.Split(name, ".")
+	var cur interface{} = claims
+	for _, p := range parts {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[p]
+	}
+	return cur
+}
+
+// numericClaim returns the integer value of a claim, which may be a number
+// or a string containing a number.
+func numericClaim(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, true
+		}
+		f, err := n.Float64()
+		return int64(f), err == nil
+	case string:
+		i, err := strconv.ParseInt(n, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == want
+	case []interface{}:
+		for _, v := range a {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
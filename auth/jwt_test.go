@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuth(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	now := time.Unix(1500000000, 0)
+
+	a := &JWTAuth{
+		hmacSecret:  secret,
+		keys:        []crypto.PublicKey{&rsaKey.PublicKey, &ecKey.PublicKey},
+		orgClaim:    "grafana.org_id",
+		roleClaim:   "role",
+		adminClaim:  "is_admin",
+		defaultRole: gcom.ROLE_VIEWER,
+		audience:    "tsdb-gw",
+		leeway:      time.Minute,
+		now:         func() time.Time { return now },
+	}
+
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"grafana": map[string]interface{}{"org_id": 12},
+			"aud":     []string{"other", "tsdb-gw"},
+			"exp":     now.Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    *User
+		wantErr error
+	}{
+		{
+			name:  "HS256",
+			token: signJWT(t, "HS256", secret, claims(nil)),
+			want:  &User{ID: 12, Role: gcom.ROLE_VIEWER},
+		},
+		{
+			name:  "RS256 with role and admin",
+			token: signJWT(t, "RS256", rsaKey, claims(map[string]interface{}{"role": "MetricsPublisher", "is_admin": true})),
+			want:  &User{ID: 12, Role: gcom.ROLE_METRICS_PUBLISHER, IsAdmin: true},
+		},
+		{
+			name:  "ES256",
+			token: signJWT(t, "ES256", ecKey, claims(nil)),
+			want:  &User{ID: 12, Role: gcom.ROLE_VIEWER},
+		},
+		{
+			name:    "unknown key",
+			token:   signJWT(t, "RS256", otherRSAKey, claims(nil)),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "alg none",
+			token:   signJWT(t, "none", nil, claims(nil)),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "expired",
+			token:   signJWT(t, "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:  "expired within leeway",
+			token: signJWT(t, "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})),
+			want:  &User{ID: 12, Role: gcom.ROLE_VIEWER},
+		},
+		{
+			name:    "no expiry",
+			token:   signJWT(t, "HS256", secret, map[string]interface{}{"grafana": map[string]interface{}{"org_id": 12}, "aud": "tsdb-gw"}),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "not yet valid",
+			token:   signJWT(t, "HS256", secret, claims(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "wrong audience",
+			token:   signJWT(t, "HS256", secret, claims(map[string]interface{}{"aud": "other"})),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "missing org",
+			token:   signJWT(t, "HS256", secret, map[string]interface{}{"aud": "tsdb-gw", "exp": now.Add(time.Hour).Unix()}),
+			wantErr: ErrInvalidOrgId,
+		},
+		{
+			name:    "invalid role",
+			token:   signJWT(t, "HS256", secret, claims(map[string]interface{}{"role": "Superuser"})),
+			wantErr: ErrInvalidRole,
+		},
+		{
+			name:    "not a token",
+			token:   "aaeipgnq",
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name:    "tampered payload",
+			token:   signJWT(t, "HS256", secret, claims(nil)) + "x",
+			wantErr: ErrInvalidCredentials,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.Auth("api_key", tt.token)
+			if err != tt.wantErr {
+				t.Fatalf("Auth() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Auth() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	j := newJWKS(srv.URL, 0)
+	tests := []struct {
+		kid  string
+		want crypto.PublicKey
+	}{
+		{kid: "rsa1", want: &rsaKey.PublicKey},
+		{kid: "ec1", want: &ecKey.PublicKey},
+		{kid: "enc"},
+		{kid: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kid, func(t *testing.T) {
+			got, ok := j.get(tt.kid)
+			if ok != (tt.want != nil) {
+				t.Fatalf("get() ok = %v, want %v", ok, tt.want != nil)
+			}
+			if !ok {
+				return
+			}
+			type equaler interface {
+				Equal(crypto.PublicKey) bool
+			}
+			if !got.(equaler).Equal(tt.want) {
+				t.Errorf("get() returned a different key")
+			}
+		})
+	}
+}
+
+func TestJWKSRefreshOnce(t *testing.T) {
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(`{"keys": [{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": "f83OJ3D2xF1Bg8vub9tLe1gHMzV76e8Tus9uPHvRVEU", "y": "x_FEzRu9m36HLN_tue659LNpXW6pCyStikYjKIWI5a0"}]}`))
+	}))
+	defer srv.Close()
+
+	j := newJWKS(srv.URL, 0)
+	j.refreshMu.Lock()
+	j.lastRefresh = time.Now().Add(-2 * minJWKSRefresh)
+	j.refreshMu.Unlock()
+	atomic.StoreInt32(&fetches, 0)
+
+	// tokens with unknown key ids arriving together trigger a single fetch
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			j.get("unknown")
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+}
+
+func TestJWKSCandidateKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		},
+	}
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(set)
+	}))
+	defer srv.Close()
+
+	now := time.Unix(1500000000, 0)
+	a := &JWTAuth{
+		jwks:        newJWKS(srv.URL, 0),
+		orgClaim:    "org",
+		defaultRole: gcom.ROLE_VIEWER,
+		now:         func() time.Time { return now },
+	}
+	tests := []struct {
+		name        string
+		alg         string
+		kid         string
+		want        crypto.PublicKey
+		wantFetches int32
+	}{
+		{name: "no kid RS256", alg: "RS256", want: &rsaKey.PublicKey},
+		{name: "no kid ES256", alg: "ES256", want: &ecKey.PublicKey},
+		{name: "known kid", alg: "RS256", kid: "rsa1", want: &rsaKey.PublicKey},
+		{name: "unknown kid", alg: "ES256", kid: "rotated", want: &ecKey.PublicKey, wantFetches: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.jwks.refreshMu.Lock()
+			a.jwks.lastRefresh = time.Now().Add(-2 * minJWKSRefresh)
+			a.jwks.refreshMu.Unlock()
+			atomic.StoreInt32(&fetches, 0)
+
+			got := a.candidateKeys(tt.alg, tt.kid)
+			if len(got) != 1 || !got[0].(interface{ Equal(crypto.PublicKey) bool }).Equal(tt.want) {
+				t.Errorf("candidateKeys(%q, %q) = %v, want only the %s key", tt.alg, tt.kid, got, tt.alg)
+			}
+			if n := atomic.LoadInt32(&fetches); n != tt.wantFetches {
+				t.Errorf("JWKS fetched %d times, want %d", n, tt.wantFetches)
+			}
+		})
+	}
+
+	// a token without a kid is verified with the JWKS keys
+	token := signJWT(t, "RS256", rsaKey, map[string]interface{}{"org": 3, "exp": now.Add(time.Hour).Unix()})
+	if got, err := a.Auth("api_key", token); err != nil || got.ID != 3 {
+		t.Errorf("Auth() of token without kid = %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	hashSHA256       = "sha256"
+	hashPBKDF2SHA256 = "pbkdf2-sha256"
+
+	defaultPBKDF2Iterations = 100000
+	pbkdf2SaltLen           = 16
+)
+
+// keyHash is a hashed api key, stored in the auth file in one of the formats
+//
+//	sha256:<hex digest>
+//	pbkdf2-sha256:<iterations>:<base64 salt>:<base64 digest>
+type keyHash struct {
+	alg        string
+	iterations int
+	salt       []byte
+	sum        []byte
+}
+
+func parseKeyHash(s string) (*keyHash, error) {
+	parts := strings.Split(s, ":")
+	switch parts[0] {
+	case hashSHA256:
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid %s hash, expected %s:<hex digest>", hashSHA256, hashSHA256)
+		}
+		sum, err := hex.DecodeString(parts[1])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid %s digest", hashSHA256)
+		}
+		return &keyHash{alg: hashSHA256, sum: sum}, nil
+	case hashPBKDF2SHA256:
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid %s hash, expected %s:<iterations>:<salt>:<digest>", hashPBKDF2SHA256, hashPBKDF2SHA256)
+		}
+		iterations, err := strconv.Atoi(parts[1])
+		if err != nil || iterations < 1 {
+			return nil, fmt.Errorf("invalid %s iterations %q", hashPBKDF2SHA256, parts[1])
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+		if err != nil || len(salt) == 0 {
+			return nil, fmt.Errorf("invalid %s salt", hashPBKDF2SHA256)
+		}
+		sum, err := base64.RawStdEncoding.DecodeString(parts[3])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid %s digest", hashPBKDF2SHA256)
+		}
+		return &keyHash{alg: hashPBKDF2SHA256, iterations: iterations, salt: salt, sum: sum}, nil
+	}
+	return nil, fmt.Errorf("unsupported key hash %q, must be one of %s|%s", parts[0], hashSHA256, hashPBKDF2SHA256)
+}
+
+// newKeyHash hashes key with the given algorithm and a random salt.
+func newKeyHash(alg, key string, iterations int) (*keyHash, error) {
+	switch alg {
+	case hashSHA256:
+		sum := sha256.Sum256([]byte(key))
+		return &keyHash{alg: alg, sum: sum[:]}, nil
+	case hashPBKDF2SHA256:
+		if iterations < 1 {
+			iterations = defaultPBKDF2Iterations
+		}
+		salt := make([]byte, pbkdf2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		h := &keyHash{alg: alg, iterations: iterations, salt: salt}
+		h.sum = h.digest(key)
+		return h, nil
+	}
+	return nil, fmt.Errorf("unsupported key hash %q, must be one of %s|%s", alg, hashSHA256, hashPBKDF2SHA256)
+}
+
+func (h *keyHash) digest(key string) []byte {
+	if h.alg == hashPBKDF2SHA256 {
+		return pbkdf2.Key([]byte(key), h.salt, h.iterations, sha256.Size, sha256.New)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+// matches returns whether key hashes to h
+func (h *keyHash) matches(key string) bool {
+	return subtle.ConstantTimeCompare(h.digest(key), h.sum) == 1
+}
+
+func (h *keyHash) String() string {
+	if h.alg == hashPBKDF2SHA256 {
+		return fmt.Sprintf("%s:%d:%s:%s", h.alg, h.iterations, base64.RawStdEncoding.EncodeToString(h.salt), base64.RawStdEncoding.EncodeToString(h.sum))
+	}
+	return h.alg + ":" + hex.EncodeToString(h.sum)
+}
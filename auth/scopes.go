@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+// Scope is a permission required to access a route
+type Scope string
+
+const (
+	ScopeMetricsRead   Scope = "metrics:read"
+	ScopeMetricsWrite  Scope = "metrics:write"
+	ScopeMetricsDelete Scope = "metrics:delete"
+	ScopeAdmin         Scope = "admin"
+)
+
+// RoleScopes returns the scopes granted by a role
+func RoleScopes(role gcom.RoleType) []Scope {
+	switch role {
+	case gcom.ROLE_VIEWER:
+		return []Scope{ScopeMetricsRead}
+	case gcom.ROLE_METRICS_PUBLISHER:
+		return []Scope{ScopeMetricsWrite}
+	case gcom.ROLE_EDITOR, gcom.ROLE_ADMIN:
+		return []Scope{ScopeMetricsRead, ScopeMetricsWrite, ScopeMetricsDelete}
+	}
+	return nil
+}
+
+// ParseScopes parses a list of scope names
+func ParseScopes(names []string) ([]Scope, error) {
+	scopes := make([]Scope, 0, len(names))
+	for _, n := range names {
+		s := Scope(strings.TrimSpace(n))
+		switch s {
+		case ScopeMetricsRead, ScopeMetricsWrite, ScopeMetricsDelete, ScopeAdmin:
+			scopes = append(scopes, s)
+		default:
+			return nil, fmt.Errorf("invalid scope '%v', must be one of %s|%s|%s|%s", n, ScopeMetricsRead, ScopeMetricsWrite, ScopeMetricsDelete, ScopeAdmin)
+		}
+	}
+	return scopes, nil
+}
+
+// HasScope returns whether the user is granted the scope. Admin users are
+// granted all scopes. Users with explicit scopes, e.g. set per key, are
+// granted only those, other users are granted the scopes of their role.
+func (u *User) HasScope(scope Scope) bool {
+	if u.IsAdmin {
+		return true
+	}
+	scopes := u.Scopes
+	if len(scopes) == 0 {
+		scopes = RoleScopes(u.Role)
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
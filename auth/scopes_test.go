@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/raintank/tsdb-gw/auth/gcom"
+)
+
+func TestUserHasScope(t *testing.T) {
+	tests := []struct {
+		name string
+		user User
+		want map[Scope]bool
+	}{
+		{
+			name: "viewer",
+			user: User{Role: gcom.ROLE_VIEWER},
+			want: map[Scope]bool{ScopeMetricsRead: true},
+		},
+		{
+			name: "publisher",
+			user: User{Role: gcom.ROLE_METRICS_PUBLISHER},
+			want: map[Scope]bool{ScopeMetricsWrite: true},
+		},
+		{
+			name: "editor",
+			user: User{Role: gcom.ROLE_EDITOR},
+			want: map[Scope]bool{ScopeMetricsRead: true, ScopeMetricsWrite: true, ScopeMetricsDelete: true},
+		},
+		{
+			name: "org admin",
+			user: User{Role: gcom.ROLE_ADMIN},
+			want: map[Scope]bool{ScopeMetricsRead: true, ScopeMetricsWrite: true, ScopeMetricsDelete: true},
+		},
+		{
+			name: "admin user",
+			user: User{Role: gcom.ROLE_VIEWER, IsAdmin: true},
+			want: map[Scope]bool{ScopeMetricsRead: true, ScopeMetricsWrite: true, ScopeMetricsDelete: true, ScopeAdmin: true},
+		},
+		{
+			name: "scopes override role",
+			user: User{Role: gcom.ROLE_ADMIN, Scopes: []Scope{ScopeMetricsRead}},
+			want: map[Scope]bool{ScopeMetricsRead: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, s := range []Scope{ScopeMetricsRead, ScopeMetricsWrite, ScopeMetricsDelete, ScopeAdmin} {
+				if got := tt.user.HasScope(s); got != tt.want[s] {
+					t.Errorf("HasScope(%s) = %v, want %v", s, got, tt.want[s])
+				}
+			}
+		})
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	got, err := ParseScopes([]string{"metrics:read", " metrics:delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != ScopeMetricsRead || got[1] != ScopeMetricsDelete {
+		t.Errorf("ParseScopes() = %v", got)
+	}
+	if _, err := ParseScopes([]string{"metrics:all"}); err == nil {
+		t.Errorf("ParseScopes() of invalid scope should fail")
+	}
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/grafana/globalconf"
 	"github.com/raintank/tsdb-gw/api"
+	"github.com/raintank/tsdb-gw/auth"
 	"github.com/raintank/tsdb-gw/ingest"
 	"github.com/raintank/tsdb-gw/publish"
 	cortexPublish "github.com/raintank/tsdb-gw/publish/cortex"
@@ -29,8 +30,8 @@ var (
 	GitHash         = "(none)"
 	showVersion     = flag.Bool("version", false, "print version string")
 	confFile        = flag.String("config", "/etc/gw/cortex-gw.ini", "configuration file path")
-	authPlugin      = flag.String("api-auth-plugin", "grafana-instance", "auth plugin to use. (grafana-instance|file)")
-	enforceRoles    = flag.Bool("enforce-roles", false, "enable role verification during authentication")
+	authPlugin      = flag.String("api-auth-plugin", "grafana-instance", "auth plugin to use, or a comma separated chain of plugins tried in order, e.g. file,grafana-instance. (grafana-instance|file|jwt|cert)")
+	enforceRoles    = flag.Bool("enforce-roles", false, "enforce the scopes granted by the role of users on each route. scopes set per key are always enforced")
 	forward3rdParty = flag.Bool("forward-3rdparty", false, "enable writing to cortex with non standard agents")
 	writeURL        = flag.String("write-url", "http://localhost:9000", "cortex write address. use kubernetes:// for grpc")
 
@@ -38,11 +39,20 @@ var (
 	tracingAddr    = flag.String("tracing-addr", "localhost:6831", "address of the jaeger agent to send data to")
 	metricsAddr    = flag.String("metrics-addr", ":8001", "http service address for the /metrics endpoint")
 
+	shutdownTimeout = flag.Duration("shutdown-timeout", 2*time.Minute, "max time to wait for inputs to stop on shutdown, before giving up")
+
 	persisterAddr    = flag.String("persister-addr", "http://localhost:9001/persist", "url of persister service")
 	persisterEnabled = flag.Bool("persister-enabled", true, "enable the persister service")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-key" {
+		if err := auth.HashKeyCmd(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.Parse()
 
 	// Only try and parse the conf file if it exists
@@ -79,19 +89,22 @@ func main() {
 
 	proxyURL := *writeURL
 
-	var writeProxy *cortexPublish.CortexWriteProxy
+	proxyType := cortexPublish.HTTPProxy
 	if strings.Contains(proxyURL, "kubernetes://") || strings.Contains(proxyURL, "dns://") {
-		writeProxy, err = cortexPublish.NewCortexWriteProxy(cortexPublish.GRPCProxy, proxyURL)
-	} else {
-		writeProxy, err = cortexPublish.NewCortexWriteProxy(cortexPublish.HTTPProxy, proxyURL)
+		proxyType = cortexPublish.GRPCProxy
 	}
 
+	writeProxy, err := cortexPublish.NewCortexWriteProxy(proxyType, proxyURL)
 	if err != nil {
 		log.Fatalf("cannot initialise write proxy: %v", err)
 	}
 
 	if *forward3rdParty {
-		publish.Init(cortexPublish.NewCortexPublisher(proxyURL))
+		publisher, err := cortexPublish.NewCortexPublisher(proxyType, proxyURL)
+		if err != nil {
+			log.Fatalf("cannot initialise cortex publisher: %v", err)
+		}
+		publish.Init(publisher)
 	} else {
 		publish.Init(nil)
 	}
@@ -99,17 +112,21 @@ func main() {
 	if err := cortex.Init(); err != nil {
 		log.Fatalf("could not initialize cortex proxy: %s", err.Error())
 	}
+	if err := auth.InitAuditLog(); err != nil {
+		log.Fatalf("could not open the auth audit log: %s", err)
+	}
 	api := api.New(*authPlugin, app)
 	initRoutes(api, writeProxy, *enforceRoles)
 
-	ms := util.NewMetricsServer(*metricsAddr)
+	// the metrics server is not stopped, so metrics are available while draining
+	util.NewMetricsServer(*metricsAddr)
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	log.Infof("Starting %v ...", app)
 	done := make(chan struct{})
-	inputs := []Stoppable{api.Start(), ms}
+	inputs := []Stoppable{api.Start()}
 	go handleShutdown(done, interrupt, inputs)
 	log.Infof("%v Started", app)
 	<-done
@@ -139,13 +156,16 @@ func handleShutdown(done chan struct{}, interrupt chan os.Signal, inputs []Stopp
 		close(complete)
 	}()
 
-	timer := time.NewTimer(time.Minute * 2)
+	timer := time.NewTimer(*shutdownTimeout)
 	select {
 	case <-timer.C:
-		log.Errorln("shutdown taking too long, giving up waiting on plugins")
+		log.Errorln("shutdown taking too long, giving up waiting on plugins. metrics still being handled are abandoned")
 	case <-complete:
-		log.Infof("shutdown complete")
+		log.Infof("inputs stopped")
 	}
+	// the publisher is stopped last, so everything the inputs accepted is published
+	publish.Stop()
+	log.Infof("shutdown complete")
 	close(done)
 }
 
@@ -158,4 +178,5 @@ func initRoutes(a *api.Api, writeProxy *cortexPublish.CortexWriteProxy, enforceR
 	a.Router.Post("/datadog/intake", a.GenerateHandlers("write", enforceRoles, true, datadog.DataDogIntake)...)
 	a.Router.Post("/opentsdb/api/put", a.GenerateHandlers("write", enforceRoles, false, ingest.OpenTSDBWrite)...)
 	a.Router.Post("/metrics", a.GenerateHandlers("write", enforceRoles, false, ingest.Metrics)...)
+	a.InitAuthCacheRoutes(enforceRoles)
 }
@@ -16,6 +16,7 @@ import (
 	"github.com/grafana/metrictank/stats"
 	"github.com/raintank/dur"
 	"github.com/raintank/tsdb-gw/api"
+	"github.com/raintank/tsdb-gw/auth"
 	"github.com/raintank/tsdb-gw/ingest"
 	"github.com/raintank/tsdb-gw/ingest/carbon"
 	"github.com/raintank/tsdb-gw/ingest/datadog"
@@ -32,8 +33,8 @@ var (
 	GitHash     = "(none)"
 	showVersion = flag.Bool("version", false, "print version string")
 
-	authPlugin   = flag.String("api-auth-plugin", "grafana", "auth plugin to use. (grafana|grafana-instance|file)")
-	enforceRoles = flag.Bool("enforce-roles", false, "enable role verification during authentication")
+	authPlugin   = flag.String("api-auth-plugin", "grafana", "auth plugin to use, or a comma separated chain of plugins tried in order, e.g. file,grafana. (grafana|grafana-instance|file|jwt|cert)")
+	enforceRoles = flag.Bool("enforce-roles", false, "enforce the scopes granted by the role of users on each route. scopes set per key are always enforced")
 	confFile     = flag.String("config", "/etc/gw/tsdb-gw.ini", "configuration file path")
 
 	broker = flag.String("kafka-tcp-addr", "localhost:9092", "kafka tcp address for metrics")
@@ -55,9 +56,18 @@ var (
 	timerangeLimit = flag.String("timerange-limit", "", "define maximum timerange to serve queries for")
 
 	metricsAddr = flag.String("metrics-addr", ":8001", "http service address for the /metrics endpoint")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 2*time.Minute, "max time to wait for inputs to stop on shutdown, before giving up")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-key" {
+		if err := auth.HashKeyCmd(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	flag.Parse()
 
 	// Only try and parse the conf file if it exists
@@ -109,24 +119,29 @@ func main() {
 		limit = dur.MustParseNDuration("timerange-limit", *timerangeLimit)
 	}
 	if err := graphite.Init(*graphiteURL, limit); err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal(err.Error())
 	}
 	if err := metrictank.Init(*metrictankURL); err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal(err.Error())
 	}
 
 	inputs := make([]Stoppable, 0)
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
+	if err := auth.InitAuditLog(); err != nil {
+		log.Fatalf("could not open the auth audit log: %s", err)
+	}
+
 	api := api.New(*authPlugin, app)
 	initRoutes(api, *enforceRoles)
 
-	ms := util.NewMetricsServer(*metricsAddr)
+	// the metrics server is not stopped, so metrics are available while draining
+	util.NewMetricsServer(*metricsAddr)
 
 	log.Infof("Starting %v ...", app)
 	done := make(chan struct{})
-	inputs = append(inputs, api.Start(), carbon.InitCarbon(*enforceRoles), ms)
+	inputs = append(inputs, api.Start(), carbon.InitCarbon(*enforceRoles))
 	go handleShutdown(done, interrupt, inputs)
 	log.Infof("%v Started", app)
 	<-done
@@ -155,13 +170,16 @@ func handleShutdown(done chan struct{}, interrupt chan os.Signal, inputs []Stopp
 		close(complete)
 	}()
 
-	timer := time.NewTimer(time.Minute * 2)
+	timer := time.NewTimer(*shutdownTimeout)
 	select {
 	case <-timer.C:
-		log.Errorln("shutdown taking too long, giving up waiting on plugins")
+		log.Errorln("shutdown taking too long, giving up waiting on plugins. metrics still being handled are abandoned")
 	case <-complete:
-		log.Infof("shutdown complete")
+		log.Infof("inputs stopped")
 	}
+	// the publisher is stopped last, so everything the inputs accepted is published
+	publish.Stop()
+	log.Infof("shutdown complete")
 	close(done)
 }
 
@@ -179,5 +197,8 @@ func initRoutes(a *api.Api, enforceRoles bool) {
 	a.Router.Post("/datadog/api/v1/series", a.GenerateHandlers("write", enforceRoles, true, datadog.DataDogSeries)...)
 	a.Router.Post("/opentsdb/api/put", a.GenerateHandlers("write", enforceRoles, false, ingest.OpenTSDBWrite)...)
 	a.Router.Any("/prometheus/write", a.GenerateHandlers("write", enforceRoles, false, ingest.PrometheusMTWrite)...)
-	a.Router.Post("/metrics/delete", a.GenerateHandlers("write", enforceRoles, false, metrictank.MetrictankProxy("/metrics/delete"))...)
+	a.Router.Post("/metrics/delete", a.GenerateHandlers("delete", enforceRoles, false, metrictank.MetrictankProxy("/metrics/delete"))...)
+	a.Router.Get("/admin/series", a.GenerateHandlers("admin", enforceRoles, false, kafka.ActiveSeries)...)
+	a.Router.Get("/admin/partition", a.GenerateHandlers("admin", enforceRoles, false, kafka.SeriesPartition)...)
+	a.InitAuthCacheRoutes(enforceRoles)
 }
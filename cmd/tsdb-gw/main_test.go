@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type blockingInput struct {
+	release chan struct{}
+	stopped chan struct{}
+}
+
+func (b *blockingInput) Stop() {
+	<-b.release
+	close(b.stopped)
+}
+
+func TestHandleShutdown(t *testing.T) {
+	orig := *shutdownTimeout
+	defer func() { *shutdownTimeout = orig }()
+
+	t.Run("waits for inputs", func(t *testing.T) {
+		*shutdownTimeout = 5 * time.Second
+		done := make(chan struct{})
+		interrupt := make(chan os.Signal, 1)
+		in := &blockingInput{release: make(chan struct{}), stopped: make(chan struct{})}
+		go handleShutdown(done, interrupt, []Stoppable{in})
+		interrupt <- os.Interrupt
+
+		select {
+		case <-done:
+			t.Fatal("shutdown completed before the input stopped")
+		case <-time.After(100 * time.Millisecond):
+		}
+		close(in.release)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("shutdown did not complete after the input stopped")
+		}
+		select {
+		case <-in.stopped:
+		default:
+			t.Error("shutdown completed before the input finished stopping")
+		}
+	})
+
+	t.Run("gives up after the timeout", func(t *testing.T) {
+		*shutdownTimeout = 100 * time.Millisecond
+		done := make(chan struct{})
+		interrupt := make(chan os.Signal, 1)
+		in := &blockingInput{release: make(chan struct{}), stopped: make(chan struct{})}
+		defer close(in.release)
+		go handleShutdown(done, interrupt, []Stoppable{in})
+		interrupt <- os.Interrupt
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("shutdown did not give up on the input")
+		}
+	})
+}
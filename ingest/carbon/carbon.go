@@ -13,17 +13,20 @@ import (
 	"github.com/raintank/schema"
 	"github.com/raintank/tsdb-gw/auth"
 	"github.com/raintank/tsdb-gw/publish"
+	"github.com/raintank/tsdb-gw/publish/limits"
 	"github.com/raintank/tsdb-gw/util"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	metricsReceived          = stats.NewCounterRate32("metrics.carbon.received")
-	metricsValid             = stats.NewCounterRate32("metrics.carbon.valid")
-	metricsRejected          = stats.NewCounterRate32("metrics.carbon.rejected")
-	metricsFailed            = stats.NewCounterRate32("metrics.carbon.failed")
-	metricsDroppedBufferFull = stats.NewCounterRate32("metrics.carbon.dropped_buffer_full")
-	metricsDroppedAuthFail   = stats.NewCounterRate32("metrics.carbon.dropped_auth_fail")
+	metricsReceived           = stats.NewCounterRate32("metrics.carbon.received")
+	metricsValid              = stats.NewCounterRate32("metrics.carbon.valid")
+	metricsRejected           = stats.NewCounterRate32("metrics.carbon.rejected")
+	metricsFailed             = stats.NewCounterRate32("metrics.carbon.failed")
+	metricsDroppedBufferFull  = stats.NewCounterRate32("metrics.carbon.dropped_buffer_full")
+	metricsDroppedAuthFail    = stats.NewCounterRate32("metrics.carbon.dropped_auth_fail")
+	metricsDroppedLimited     = stats.NewCounterRate32("metrics.carbon.dropped_rate_limited")
+	metricsDroppedAuthBlocked = stats.NewCounterRate32("metrics.carbon.dropped_auth_blocked")
 
 	carbonConnections = stats.NewGauge32("carbon.connections")
 
@@ -41,19 +44,26 @@ var (
 func init() {
 	flag.BoolVar(&Enabled, "carbon-enabled", false, "enable carbon input")
 	flag.StringVar(&addr, "carbon-addr", "0.0.0.0:2003", "listen address for carbon input")
-	flag.StringVar(&authPlugin, "carbon-auth-plugin", "file", "auth plugin to use. (grafana|file)")
+	flag.StringVar(&authPlugin, "carbon-auth-plugin", "file", "auth plugin to use, or a comma separated chain of plugins tried in order. (grafana|file|jwt)")
 	flag.DurationVar(&flushInterval, "carbon-flush-interval", time.Second, "maximum time between flushs to kafka")
 	flag.IntVar(&concurrency, "carbon-concurrency", 1, "number of goroutines for handling metrics")
 	flag.IntVar(&bufferSize, "carbon-buffer-size", 100000, "number of metrics to hold in an input buffer. Once this buffer fills metrics will be dropped")
 	flag.BoolVar(&nonBlockingBuffer, "carbon-non-blocking-buffer", false, "dont block trying to write to the input buffer, just drop metrics.")
 }
 
+// carbonLine is a received line, with the address of its source
+type carbonLine struct {
+	buf    []byte
+	source string
+}
+
 type Carbon struct {
 	listener         *input.Listener
 	schemas          *conf.Schemas
-	buf              chan []byte
+	buf              chan carbonLine
 	flushWg          sync.WaitGroup
 	authPlugin       auth.AuthPlugin
+	authGuard        *auth.FailureGuard
 	requirePublisher bool
 }
 
@@ -64,12 +74,14 @@ func InitCarbon(requirePublisher bool) *Carbon {
 
 	c := &Carbon{
 		authPlugin:       auth.GetAuthPlugin(authPlugin),
+		authGuard:        auth.NewFailureGuard("carbon"),
 		requirePublisher: requirePublisher,
-		buf:              make(chan []byte, bufferSize),
+		buf:              make(chan carbonLine, bufferSize),
 	}
 	// note that we use our Carbon ingest plugin directly as Dispatcher
 	c.listener = input.NewListener(addr, 2*time.Minute, input.NewPlain(c))
-	c.listener.HandleConn = handleConn
+	c.listener.HandleConn = c.handleConn
+	c.listener.HandleData = c.handleData
 	err := c.listener.Start()
 	if err != nil {
 		log.Fatal(err)
@@ -87,32 +99,41 @@ func (c *Carbon) Stop() {
 	}
 	// note: this will only return when the handler is done too,
 	// which means invocations of Dispatch() will be done too.
+	log.Info("carbon: closing listener and flushing buffered metrics")
 	c.listener.Stop()
 	close(c.buf)
 	c.flushWg.Wait()
+	log.Info("carbon: flushed buffered metrics")
 }
 
 // IncNumInvalid does not apply for plain text, so is a no-op.
 func (c *Carbon) IncNumInvalid() {
 }
 
+// Dispatch dispatches a line of an unknown source. Lines received by the
+// listener are dispatched with their source by a connDispatcher.
 func (c *Carbon) Dispatch(buf []byte) {
+	c.dispatch(buf, "")
+}
+
+func (c *Carbon) dispatch(buf []byte, source string) {
 	if len(buf) == 0 {
 		return
 	}
 	buf_copy := make([]byte, len(buf))
 	copy(buf_copy, buf)
+	line := carbonLine{buf: buf_copy, source: source}
 	metricsReceived.Inc()
 	if nonBlockingBuffer {
 		select {
-		case c.buf <- buf_copy:
+		case c.buf <- line:
 		default:
 			metricsDroppedBufferFull.Inc()
 			log.Debugln("metric dropped due to full buffer")
 			// maybe we should just close the connection here
 		}
 	} else {
-		c.buf <- buf_copy
+		c.buf <- line
 	}
 }
 
@@ -121,24 +142,34 @@ func (c *Carbon) flush() {
 	buf := make([]*schema.MetricData, 0)
 
 	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
 			err := publish.Publish(buf)
-			if err != nil {
+			valid := len(buf)
+			if rlErr, ok := err.(*limits.RateLimitedError); ok {
+				// the metrics of orgs within their limit have been published,
+				// the others are dropped rather than retried.
+				log.Debugf("dropping metrics. %s", rlErr)
+				metricsDroppedLimited.Add(rlErr.Rejected)
+				valid -= rlErr.Rejected
+			} else if err != nil {
 				log.Errorf("failed to publish metrics. %s", err)
 				metricsFailed.Add(len(buf))
 				continue
 			}
-			metricsValid.Add(len(buf))
+			metricsValid.Add(valid)
 			for _, m := range buf {
 				metricPool.Put(m)
 			}
 			buf = buf[0:0]
-		case b, ok := <-c.buf:
+		case line, ok := <-c.buf:
 			if !ok {
+				c.finalFlush(buf)
 				return
 			}
+			b := line.buf
 			_, _, _, err := m20.ValidatePacket(b, m20.StrictLegacy, m20.NoneM20)
 			if err != nil {
 				log.Debugf("packet rejected with error. %s - %s", err, b)
@@ -148,16 +179,30 @@ func (c *Carbon) flush() {
 
 			parts := bytes.SplitN(b, []byte("."), 2)
 			user, err := c.authPlugin.Auth("api_key", string(parts[0]))
+			ev := auth.NewAuditEvent("carbon", line.source, "api_key", string(parts[0]))
 			if err != nil {
 				log.Debugf("invalid auth key. %s, reason: %v", parts[0], err)
 				metricsDroppedAuthFail.Inc()
+				ev.Decision = auth.AuditError
+				ev.Reason = err.Error()
+				if err == auth.ErrInvalidCredentials || err == auth.ErrUnknownKey || err == auth.ErrInvalidOrgId || err == auth.ErrInvalidInstanceID {
+					ev.Decision = auth.AuditDeny
+					c.authGuard.Failure(line.source)
+				}
+				auth.Audit(ev)
 				continue
 			}
-			if c.requirePublisher && !user.Role.IsPublisher() {
+			ev.SetUser(user)
+			if (c.requirePublisher || len(user.Scopes) > 0) && !user.HasScope(auth.ScopeMetricsWrite) {
 				log.Debugf("invalid auth key. %s, reason: user does not have permissions to publish", parts[0])
 				metricsDroppedAuthFail.Inc()
+				ev.Decision = auth.AuditDeny
+				ev.Reason = "missing scope " + string(auth.ScopeMetricsWrite)
+				auth.Audit(ev)
 				continue
 			}
+			ev.Decision = auth.AuditAllow
+			auth.Audit(ev)
 			md, err := parseMetric(parts[1], c.schemas, user.ID)
 			if err != nil {
 				log.Errorf("could not parse metric %q: %s", string(parts[1]), err)
@@ -168,3 +213,22 @@ func (c *Carbon) flush() {
 		}
 	}
 }
+
+// finalFlush publishes the remaining metrics of a flush routine on shutdown.
+func (c *Carbon) finalFlush(buf []*schema.MetricData) {
+	if len(buf) == 0 {
+		return
+	}
+	err := publish.Publish(buf)
+	if rlErr, ok := err.(*limits.RateLimitedError); ok {
+		metricsDroppedLimited.Add(rlErr.Rejected)
+		metricsValid.Add(len(buf) - rlErr.Rejected)
+		return
+	}
+	if err != nil {
+		metricsFailed.Add(len(buf))
+		log.Errorf("carbon: failed to publish metrics on shutdown, abandoning %d metrics. %s", len(buf), err)
+		return
+	}
+	metricsValid.Add(len(buf))
+}
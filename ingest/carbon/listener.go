@@ -1,21 +1,24 @@
 package carbon
 
 import (
+	"bytes"
 	"net"
 
 	"github.com/graphite-ng/carbon-relay-ng/input"
+	"github.com/raintank/tsdb-gw/auth"
 	log "github.com/sirupsen/logrus"
 )
 
-// handleConn differes from the stock handleConn in 2 ways:
-// 1) it logs connection start and end via Info level. whereas carbon-relay-ng would consider this debug level
-//    (which itself is largely a consequence of the crng stats library creating a new connection to itself at every flush)
-// 2) it helps us do stats our way, with the metrics we care about and the library we use (crng uses a different library)
-func handleConn(l *input.Listener, c net.Conn) {
+// handleConn differes from the stock handleConn in 3 ways:
+//  1. it logs connection start and end via Info level. whereas carbon-relay-ng would consider this debug level
+//     (which itself is largely a consequence of the crng stats library creating a new connection to itself at every flush)
+//  2. it helps us do stats our way, with the metrics we care about and the library we use (crng uses a different library)
+//  3. it tags the metrics with the address of the connection, to lock out sources failing to authenticate
+func (carbon *Carbon) handleConn(l *input.Listener, c net.Conn) {
 	carbonConnections.Inc()
 	log.Infof("%s handler: new tcp connection from %v", l.Handler.Kind(), c.RemoteAddr())
 
-	err := l.Handler.Handle(c)
+	err := input.NewPlain(&connDispatcher{carbon: carbon, source: hostOf(c.RemoteAddr()), conn: c}).Handle(c)
 
 	carbonConnections.Dec()
 
@@ -31,3 +34,53 @@ func handleConn(l *input.Listener, c net.Conn) {
 	}
 	log.Infof("%s handler%s returned. closing conn", l.Handler.Kind(), remoteInfo)
 }
+
+// handleData handles an udp packet, tagging its metrics with the source address.
+func (carbon *Carbon) handleData(l *input.Listener, data []byte, src net.Addr) {
+	err := input.NewPlain(&connDispatcher{carbon: carbon, source: hostOf(src)}).Handle(bytes.NewReader(data))
+	if err != nil {
+		log.Warnf("%s handler: error handling udp packet from %v: %s", l.Handler.Kind(), src, err)
+	}
+}
+
+// connDispatcher dispatches the metrics received from a single source. Once
+// the source is locked out after too many failed authentications, its metrics
+// are dropped and its connection is closed.
+type connDispatcher struct {
+	carbon *Carbon
+	source string
+	conn   net.Conn
+	closed bool
+}
+
+// IncNumInvalid does not apply for plain text, so is a no-op.
+func (d *connDispatcher) IncNumInvalid() {
+}
+
+func (d *connDispatcher) Dispatch(buf []byte) {
+	if blocked, _ := d.carbon.authGuard.Blocked(d.source); blocked {
+		metricsDroppedAuthBlocked.Inc()
+		if d.conn != nil && !d.closed {
+			log.Infof("carbon: closing connection from %s, locked out after too many failed authentications", d.source)
+			ev := auth.NewAuditEvent("carbon", d.source, "", "")
+			ev.Decision = auth.AuditDeny
+			ev.Reason = "source locked out"
+			auth.Audit(ev)
+			d.conn.Close()
+			d.closed = true
+		}
+		return
+	}
+	d.carbon.dispatch(buf, d.source)
+}
+
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
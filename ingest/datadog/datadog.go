@@ -71,6 +71,9 @@ func DataDogSeries(ctx *models.Context) {
 	err = publish.Publish(buf)
 
 	if err != nil {
+		if ingest.RateLimited(ctx, err) {
+			return
+		}
 		log.Errorf("failed to publish datadog series metrics. %s", err)
 		ctx.JSON(500, err)
 		return
@@ -135,6 +138,9 @@ func DataDogCheck(ctx *models.Context) {
 	err = publish.Publish(buf)
 
 	if err != nil {
+		if ingest.RateLimited(ctx, err) {
+			return
+		}
 		log.Errorf("failed to publish datadog metrics. %s", err)
 		ctx.JSON(500, err)
 		return
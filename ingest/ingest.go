@@ -1,8 +1,29 @@
 package ingest
 
 import (
+	"math"
+	"strconv"
+
+	"github.com/raintank/tsdb-gw/api/models"
+	"github.com/raintank/tsdb-gw/publish/limits"
 	"github.com/raintank/tsdb-gw/util"
 )
 
 // MetricPool is a shared buffer for metrics ingested over http
 var MetricPool = util.NewMetricDataPool()
+
+// RateLimited writes a 429 response with a Retry-After header if the publish
+// error was caused by the org exceeding its ingestion rate limit.
+func RateLimited(ctx *models.Context, err error) bool {
+	rlErr, ok := err.(*limits.RateLimitedError)
+	if !ok {
+		return false
+	}
+	retryAfter := int(math.Ceil(rlErr.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	ctx.Resp.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	ctx.JSON(429, rlErr.Error())
+	return true
+}
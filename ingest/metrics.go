@@ -9,27 +9,17 @@ import (
 
 	"github.com/golang/snappy"
 	"github.com/grafana/metrictank/stats"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/raintank/schema"
 	"github.com/raintank/schema/msg"
 	"github.com/raintank/tsdb-gw/api/models"
 	"github.com/raintank/tsdb-gw/publish"
+	"github.com/raintank/tsdb-gw/publish/validate"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	metricsValid    = stats.NewCounterRate32("metrics.http.valid")    // valid metrics received (not necessarily published)
 	metricsRejected = stats.NewCounterRate32("metrics.http.rejected") // invalid metrics received
-
-	discardedSamples = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "gateway",
-			Name:      "invalid_samples_total",
-			Help:      "The total number of samples that were discarded because they are invalid.",
-		},
-		[]string{"reason", "org"},
-	)
 )
 
 func Metrics(ctx *models.Context) {
@@ -86,7 +76,7 @@ func prepareIngest(ctx *models.Context, in []*schema.MetricData, toPublish []*sc
 	metricsValid.Add(len(toPublish))
 	for org, promDiscardsByOrg := range promDiscards {
 		for reason, cnt := range promDiscardsByOrg {
-			discardedSamples.WithLabelValues(reason, strconv.Itoa(org)).Add(float64(cnt))
+			validate.InvalidSamples.WithLabelValues(reason, strconv.Itoa(org)).Add(float64(cnt))
 		}
 	}
 	return toPublish, resp
@@ -128,6 +118,9 @@ func metricsJson(ctx *models.Context) {
 
 	err = publish.Publish(toPublish)
 	if err != nil {
+		if RateLimited(ctx, err) {
+			return
+		}
 		log.Errorf("failed to publish metrics. %s", err)
 		ctx.JSON(500, err)
 		return
@@ -189,6 +182,9 @@ func metricsBinary(ctx *models.Context, compressed bool) {
 
 	err = publish.Publish(toPublish)
 	if err != nil {
+		if RateLimited(ctx, err) {
+			return
+		}
 		log.Errorf("failed to publish metrics. %s", err)
 		ctx.JSON(500, err)
 		return
@@ -66,6 +66,9 @@ func OpenTSDBWrite(ctx *models.Context) {
 			MetricPool.Put(m)
 		}
 		if err != nil {
+			if RateLimited(ctx, err) {
+				return
+			}
 			log.Errorf("failed to publish opentsdb write metrics. %s", err)
 			ctx.JSON(500, err)
 			return
@@ -77,6 +77,9 @@ func PrometheusMTWrite(ctx *models.Context) {
 			MetricPool.Put(m)
 		}
 		if err != nil {
+			if RateLimited(ctx, err) {
+				return
+			}
 			log.Errorf("failed to publish prom write metrics. %s", err)
 			ctx.JSON(500, err)
 			return
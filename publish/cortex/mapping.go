@@ -0,0 +1,263 @@
+package cortex
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	schema "github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ini.v1"
+)
+
+/*
+Reads an ini file containing a section for each mapping rule. Rules are
+evaluated in the order they are defined and the first rule matching a metric
+name is applied. Metrics not matched by any rule keep their name, with dots
+replaced by underscores.
+
+A glob rule matches one node per '*', a regex rule must match the full name.
+Captured values can be referenced as $1, $2, ... in the name and labels.
+
+example:
+------------------
+[dispatcher]
+match = servers.*.dispatcher.*.*
+name = dispatcher_events_total
+labels = host=$1, action=$2, outcome=$3
+
+[requests]
+match_type = regex
+match = ^apps\.([^.]+)\.(.+)$
+name = app_$2
+labels = app=$1
+-------------------
+*/
+
+var (
+	mappingFile = flag.String("mapping-file", "", "path to ini file containing rules to map graphite metric names to prometheus names and labels")
+
+	droppedLabelsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cortex_gw",
+			Subsystem: "publisher",
+			Name:      "dropped_labels_total",
+			Help:      "Total number of labels which were dropped as they could not be converted.",
+		},
+		[]string{"reason"},
+	)
+	renamedLabelsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cortex_gw",
+			Subsystem: "publisher",
+			Name:      "renamed_labels_total",
+			Help:      "Total number of labels which were renamed to be valid prometheus label names.",
+		},
+		[]string{},
+	)
+	mappedMetricsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cortex_gw",
+			Subsystem: "publisher",
+			Name:      "mapped_metrics_total",
+			Help:      "Total number of metrics whose name was translated by a mapping rule.",
+		},
+		[]string{"rule"},
+	)
+)
+
+type mappingRule struct {
+	name   string
+	match  *regexp.Regexp
+	metric string
+	labels []labelTemplate
+}
+
+type labelTemplate struct {
+	name  string
+	value string
+}
+
+// mapper translates graphite metric names into prometheus metric names and labels
+type mapper struct {
+	rules []mappingRule
+}
+
+func loadMapper(file string) (*mapper, error) {
+	conf, err := ini.Load(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not load mapping file %s: %v", file, err)
+	}
+
+	m := &mapper{}
+	for _, section := range conf.Sections() {
+		if section.Name() == "" || section.Name() == "DEFAULT" {
+			continue
+		}
+		rule, err := parseMappingRule(section)
+		if err != nil {
+			return nil, fmt.Errorf("mapping rule %s: %v", section.Name(), err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	log.Infof("loaded %d mapping rules from %s", len(m.rules), file)
+	return m, nil
+}
+
+func parseMappingRule(section *ini.Section) (mappingRule, error) {
+	rule := mappingRule{
+		name:   section.Name(),
+		metric: section.Key("name").String(),
+	}
+
+	match := section.Key("match").String()
+	if match == "" {
+		return rule, fmt.Errorf("no match defined")
+	}
+
+	var err error
+	switch section.Key("match_type").MustString("glob") {
+	case "glob":
+		rule.match, err = globToRegexp(match)
+	case "regex":
+		rule.match, err = regexp.Compile(match)
+	default:
+		return rule, fmt.Errorf("match_type must be one of glob|regex")
+	}
+	if err != nil {
+		return rule, err
+	}
+
+	for _, l := range section.Key("labels").Strings(",") {
+		lv := strings.SplitN(l, "=", 2)
+		if len(lv) < 2 || lv[0] == "" {
+			return rule, fmt.Errorf("invalid label definition %q", l)
+		}
+		rule.labels = append(rule.labels, labelTemplate{name: lv[0], value: lv[1]})
+	}
+	return rule, nil
+}
+
+// globToRegexp converts a graphite glob into a regular expression where each
+// '*' captures the characters of a single node.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	pattern := strings.Replace(regexp.QuoteMeta(glob), `\*`, `([^.]+)`, -1)
+	return regexp.Compile("^" + pattern + "$")
+}
+
+// Map returns the metric name and labels defined by the first rule
+// matching name. ok is false when no rule matched.
+func (m *mapper) Map(name string) (metric string, labels []labelTemplate, ok bool) {
+	if m == nil {
+		return "", nil, false
+	}
+	for _, rule := range m.rules {
+		submatches := rule.match.FindStringSubmatchIndex(name)
+		if submatches == nil {
+			continue
+		}
+		metric = name
+		if rule.metric != "" {
+			metric = string(rule.match.ExpandString(nil, rule.metric, name, submatches))
+		}
+		labels = make([]labelTemplate, 0, len(rule.labels))
+		for _, l := range rule.labels {
+			labels = append(labels, labelTemplate{
+				name:  l.name,
+				value: string(rule.match.ExpandString(nil, l.value, name, submatches)),
+			})
+		}
+		mappedMetricsTotal.WithLabelValues(rule.name).Inc()
+		return metric, labels, true
+	}
+	return "", nil, false
+}
+
+// buildLabels converts the name and tags of the metric into prometheus labels,
+// applying the mapping rules. Labels with an invalid name are renamed, labels
+// without a value are dropped.
+func buildLabels(m *schema.MetricData, mp *mapper) []*prompb.Label {
+	name, mapped, ok := mp.Map(m.Name)
+	if !ok {
+		name = m.Name
+	}
+
+	labels := make([]*prompb.Label, 0, len(m.Tags)+len(mapped)+1)
+	labels = append(labels, &prompb.Label{
+		Name:  "__name__",
+		Value: sanitizeMetricName(name),
+	})
+
+	add := func(name, value string) {
+		if value == "" {
+			log.Debugf("label %q has no value and can not be encoded", name)
+			droppedLabelsTotal.WithLabelValues("empty_value").Inc()
+			return
+		}
+		if strings.HasPrefix(name, "__") {
+			log.Debugf("label %q is reserved and can not be encoded", name)
+			droppedLabelsTotal.WithLabelValues("reserved_name").Inc()
+			return
+		}
+		valid := sanitizeName(name)
+		if valid != name {
+			renamedLabelsTotal.WithLabelValues().Inc()
+		}
+		// labels set by a mapping rule take precedence over tags
+		for _, l := range labels {
+			if l.Name == valid {
+				l.Value = value
+				return
+			}
+		}
+		labels = append(labels, &prompb.Label{
+			Name:  valid,
+			Value: value,
+		})
+	}
+
+	for _, tag := range m.Tags {
+		tv := strings.SplitN(tag, "=", 2)
+		if len(tv) < 2 || tv[0] == "" {
+			log.Debugf("tag %q is not able to be encoded", tag)
+			droppedLabelsTotal.WithLabelValues("invalid_tag").Inc()
+			continue
+		}
+		add(tv[0], tv[1])
+	}
+	for _, l := range mapped {
+		add(l.name, l.value)
+	}
+
+	return labels
+}
+
+// sanitizeName replaces all characters not valid in a prometheus label name
+// with an underscore. Names starting with a digit are prefixed with one.
+func sanitizeName(name string) string {
+	return sanitize(name, false)
+}
+
+// sanitizeMetricName is like sanitizeName but also allows colons, which are
+// valid in metric names.
+func sanitizeMetricName(name string) string {
+	return sanitize(name, true)
+}
+
+func sanitize(name string, allowColon bool) string {
+	out := []byte(name)
+	for i, b := range out {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') || b == '_' || (allowColon && b == ':') {
+			continue
+		}
+		out[i] = '_'
+	}
+	if len(out) > 0 && out[0] >= '0' && out[0] <= '9' {
+		return "_" + string(out)
+	}
+	return string(out)
+}
@@ -0,0 +1,108 @@
+package cortex
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+	schema "github.com/raintank/schema"
+	"gopkg.in/ini.v1"
+)
+
+var testMappings = []byte(`
+[dispatcher]
+match = servers.*.dispatcher.*.*
+name = dispatcher_events_total
+labels = host=$1, action=$2, outcome=$3
+
+[requests]
+match_type = regex
+match = ^apps\.([^.]+)\.(.+)$
+name = app_$2
+labels = app=$1
+`)
+
+func newTestMapper(t *testing.T) *mapper {
+	conf, err := ini.Load(testMappings)
+	if err != nil {
+		t.Fatalf("failed to load test mappings: %v", err)
+	}
+	m := &mapper{}
+	for _, section := range conf.Sections() {
+		if section.Name() == "DEFAULT" {
+			continue
+		}
+		rule, err := parseMappingRule(section)
+		if err != nil {
+			t.Fatalf("failed to parse mapping rule %s: %v", section.Name(), err)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m
+}
+
+func Test_buildLabels(t *testing.T) {
+	mp := newTestMapper(t)
+	tests := []struct {
+		name   string
+		metric *schema.MetricData
+		want   []*prompb.Label
+	}{
+		{
+			name:   "unmapped graphite metric",
+			metric: &schema.MetricData{Name: "some.other-metric"},
+			want: []*prompb.Label{
+				&prompb.Label{Name: "__name__", Value: "some_other_metric"},
+			},
+		},
+		{
+			name:   "glob mapping",
+			metric: &schema.MetricData{Name: "servers.web1.dispatcher.received.ok"},
+			want: []*prompb.Label{
+				&prompb.Label{Name: "__name__", Value: "dispatcher_events_total"},
+				&prompb.Label{Name: "host", Value: "web1"},
+				&prompb.Label{Name: "action", Value: "received"},
+				&prompb.Label{Name: "outcome", Value: "ok"},
+			},
+		},
+		{
+			name:   "glob does not match across nodes",
+			metric: &schema.MetricData{Name: "servers.web1.dispatcher.received.ok.extra"},
+			want: []*prompb.Label{
+				&prompb.Label{Name: "__name__", Value: "servers_web1_dispatcher_received_ok_extra"},
+			},
+		},
+		{
+			name: "regex mapping overrides tags",
+			metric: &schema.MetricData{
+				Name: "apps.shop.requests.count",
+				Tags: []string{"app=other", "env=prod"},
+			},
+			want: []*prompb.Label{
+				&prompb.Label{Name: "__name__", Value: "app_requests_count"},
+				&prompb.Label{Name: "app", Value: "shop"},
+				&prompb.Label{Name: "env", Value: "prod"},
+			},
+		},
+		{
+			name: "invalid tags",
+			metric: &schema.MetricData{
+				Name: "example_metric",
+				Tags: []string{"host-name=web1", "1st=a", "empty=", "novalue", "__name__=x"},
+			},
+			want: []*prompb.Label{
+				&prompb.Label{Name: "__name__", Value: "example_metric"},
+				&prompb.Label{Name: "host_name", Value: "web1"},
+				&prompb.Label{Name: "_1st", Value: "a"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildLabels(tt.metric, mp); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildLabels() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/oxtoacart/bpool"
@@ -53,11 +54,26 @@ func newHTTPWriteProxy(writeURL string) (*httputil.ReverseProxy, error) {
 	}, nil
 }
 
+var (
+	grpcClientsMu sync.Mutex
+	grpcClients   = make(map[string]*server.Client)
+)
+
+// newGRPCWriteProxy returns the httpgrpc client for writeURL. Clients are
+// shared, so the write proxy and the publisher use the same connection.
 func newGRPCWriteProxy(writeURL string) (*server.Client, error) {
+	grpcClientsMu.Lock()
+	defer grpcClientsMu.Unlock()
+
+	if c, ok := grpcClients[writeURL]; ok {
+		return c, nil
+	}
+
 	httpGrpcClient, err := server.NewClient(writeURL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create grpc client: %v", err)
 	}
+	grpcClients[writeURL] = httpGrpcClient
 
 	return httpGrpcClient, nil
 }
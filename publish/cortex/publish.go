@@ -8,26 +8,37 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/jpillora/backoff"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/prompb"
 	schema "github.com/raintank/schema"
 	"github.com/raintank/tsdb-gw/publish"
+	"github.com/raintank/tsdb-gw/util"
 	log "github.com/sirupsen/logrus"
+	"github.com/weaveworks/common/user"
 	"golang.org/x/net/context/ctxhttp"
 )
 
 var (
 	writeBPoolSize  = flag.Int("bpool-size", 100, "max number of byte buffers in the cortex write buffer pool")
 	writeBPoolWidth = flag.Int("bpool-width", 1024, "capacity of byte array provided by cortex write buffer pool")
+	concurrency     = flag.Int("publish-concurrency", 10, "max number of concurrent write requests sent to cortex for a single publish call")
+	maxSamples      = flag.Int("publish-max-samples-per-request", 5000, "max number of samples in a single write request to cortex. larger batches are split. (0 disables splitting)")
+	maxRetries      = flag.Int("publish-max-retries", 3, "max number of times a write request to cortex is retried after a 5xx or 429 response")
+	minBackoff      = flag.Duration("publish-min-backoff", 100*time.Millisecond, "minimum time to wait before retrying a failed write request to cortex")
+	maxBackoff      = flag.Duration("publish-max-backoff", 5*time.Second, "maximum time to wait before retrying a failed write request to cortex")
+	maxRetryTime    = flag.Duration("publish-max-retry-time", 30*time.Second, "maximum total time spent retrying a failed write request to cortex. (0 disables the limit)")
 
 	errBadTag    = errors.New("unable to parse tags")
 	errNoMetrics = errors.New("no metrics provided in write request")
@@ -50,6 +61,37 @@ var (
 		},
 		[]string{},
 	)
+
+	// the per org breakdown of the dropped and succeeded samples is only
+	// recorded if the metrics-org-label setting is enabled, as each org
+	// adds a series.
+	orgDroppedSamplesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cortex_gw",
+			Subsystem: "publisher",
+			Name:      "org_dropped_samples_total",
+			Help:      "Total number of samples which were dropped, by org. Only recorded if metrics-org-label is enabled.",
+		},
+		[]string{"org"},
+	)
+	orgSucceededSamplesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cortex_gw",
+			Subsystem: "publisher",
+			Name:      "org_succeeded_samples_total",
+			Help:      "Total number of samples successfully sent, by org. Only recorded if metrics-org-label is enabled.",
+		},
+		[]string{"org"},
+	)
+	retriedRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "cortex_gw",
+			Subsystem: "publisher",
+			Name:      "retried_requests_total",
+			Help:      "Total number of write requests which were retried.",
+		},
+		[]string{},
+	)
 	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "cortex_gw",
 		Subsystem: "publisher",
@@ -65,18 +107,56 @@ type cortexPublisher struct {
 	url     *url.URL
 	client  *http.Client
 	timeout time.Duration
+
+	// grpc is set when writes are sent to cortex via httpgrpc instead
+	// of plain HTTP.
+	grpc http.Handler
+
+	mapper *mapper
+
+	maxSamples   int
+	maxRetries   int
+	maxRetryTime time.Duration
+	backoff      backoff.Backoff
+
+	// ctx is canceled by Stop, aborting the retries of in-flight requests.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// NewCortexPublisher creates a new cortex publisher.
-func NewCortexPublisher(writeURL string) publish.Publisher {
+// NewCortexPublisher creates a new cortex publisher. The GRPCProxy type sends
+// writes over httpgrpc, sharing the client connection used by the write proxy.
+func NewCortexPublisher(ptype ProxyType, writeURL string) (publish.Publisher, error) {
 	cortexURL, err := url.Parse(writeURL)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("unable to parse cortex write url '%s': %v", writeURL, err)
 	}
 
-	return &cortexPublisher{
-		url: cortexURL,
-		client: &http.Client{
+	c := &cortexPublisher{
+		url:          cortexURL,
+		timeout:      time.Second * 60,
+		maxSamples:   *maxSamples,
+		maxRetries:   *maxRetries,
+		maxRetryTime: *maxRetryTime,
+		backoff: backoff.Backoff{
+			Min:    *minBackoff,
+			Max:    *maxBackoff,
+			Factor: 2,
+			Jitter: true,
+		},
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	if *mappingFile != "" {
+		c.mapper, err = loadMapper(*mappingFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch ptype {
+	case HTTPProxy:
+		c.client = &http.Client{
 			Transport: &http.Transport{
 				MaxIdleConns:        20000,
 				MaxIdleConnsPerHost: 1000,
@@ -84,38 +164,170 @@ func NewCortexPublisher(writeURL string) publish.Publisher {
 				DisableCompression:  true,
 				IdleConnTimeout:     5 * time.Minute,
 			},
-		},
-		timeout: time.Second * 60,
+		}
+	case GRPCProxy:
+		c.grpc, err = newGRPCWriteProxy(writeURL)
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	return c, nil
 }
 
 func (c *cortexPublisher) Publish(metrics []*schema.MetricData) error {
-	start := time.Now()
-	req, err := packageMetrics(metrics)
+	reqs, err := packageMetrics(metrics, c.mapper, c.maxSamples)
 	if err != nil {
 		log.Debugf("unable to package metrics, %v", err)
-		droppedSamplesTotal.WithLabelValues().Add(float64(len(metrics)))
+		dropped := make(map[int]int)
+		for _, m := range metrics {
+			dropped[m.OrgId]++
+		}
+		for org, n := range dropped {
+			countSamples(droppedSamplesTotal, orgDroppedSamplesTotal, org, float64(n))
+		}
 		return err
 	}
 
-	succeededSamplesTotal.WithLabelValues().Add(float64(len(metrics)))
+	// each tenant gets at least one write request. They are sent concurrently,
+	// bounded by the publish-concurrency setting, so that a slow or failing
+	// tenant does not hold up, or hide the success of, the others.
+	limit := *concurrency
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	errs := make([]error, len(reqs))
+	var wg sync.WaitGroup
+	for i := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = c.publishRequest(c.ctx, reqs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var failed publishErrors
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// publishRequest sends a single write request, retrying with a jittered
+// exponential backoff if cortex responds with a 5xx or 429 or can not be
+// reached. All other errors are returned straight away. Retries stop when
+// ctx is done or when the next one would exceed the max retry time.
+func (c *cortexPublisher) publishRequest(ctx context.Context, req writeRequest) error {
+	start := time.Now()
+	samples := float64(len(req.Request.Timeseries))
+	if c.maxRetryTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.maxRetryTime)
+		defer cancel()
+	}
+
+	// ForAttempt is safe for concurrent use, so the shared settings
+	// can be used by all in-flight requests.
+	var err error
+retry:
+	for attempt := 0; ; attempt++ {
+		err = c.Write(req)
+		if err == nil || !recoverable(err) || attempt >= c.maxRetries {
+			break
+		}
+		wait := c.backoff.ForAttempt(float64(attempt))
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			log.Debugf("write request for org %d failed, not retrying as the max retry time would be exceeded. %v", req.orgID, err)
+			break
+		}
+		log.Debugf("write request for org %d failed, retrying in %s. %v", req.orgID, wait, err)
+		retriedRequestsTotal.WithLabelValues().Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			log.Debugf("write request for org %d failed, retries aborted. %v", req.orgID, err)
+			break retry
+		}
+	}
 
-	err = c.Write(req)
 	took := time.Since(start)
 	if err != nil {
+		countSamples(droppedSamplesTotal, orgDroppedSamplesTotal, req.orgID, samples)
 		requestDuration.WithLabelValues("failed").Observe(took.Seconds())
-		return err
+		return fmt.Errorf("org %d: %v", req.orgID, err)
 	}
 
+	countSamples(succeededSamplesTotal, orgSucceededSamplesTotal, req.orgID, samples)
 	requestDuration.WithLabelValues("succeeded").Observe(took.Seconds())
 	return nil
 }
 
+// countSamples adds n to the total, and to the series of the org in byOrg
+// if the per org breakdown is enabled.
+func countSamples(total, byOrg *prometheus.CounterVec, org int, n float64) {
+	total.WithLabelValues().Add(n)
+	if l := util.OrgLabel(org); l != "" {
+		byOrg.WithLabelValues(l).Add(n)
+	}
+}
+
+// writeError is returned by Write when cortex responds with a non 2xx status.
+type writeError struct {
+	statusCode int
+	msg        string
+}
+
+func (e *writeError) Error() string {
+	return e.msg
+}
+
+// recoverable returns whether a failed write request is worth retrying.
+// Requests rejected with a 4xx status, other than 429, will fail again.
+func recoverable(err error) bool {
+	wErr, ok := err.(*writeError)
+	if !ok {
+		// connection errors, timeouts, etc.
+		return true
+	}
+	return wErr.statusCode/100 == 5 || wErr.statusCode == http.StatusTooManyRequests
+}
+
+// publishErrors collects the errors of the individual tenant write requests
+// sent by a single Publish call.
+type publishErrors []error
+
+func (e publishErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d write request(s) failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Stop aborts the retries of in-flight write requests. Requests failing
+// after Stop are not retried.
+func (c *cortexPublisher) Stop() {
+	c.cancel()
+}
+
 func (c *cortexPublisher) Type() string {
 	return "cortex"
 }
 
-// Write sends a batch of samples to the HTTP endpoint.
+// Write sends a batch of samples to the cortex push endpoint, over HTTP or httpgrpc.
 func (c *cortexPublisher) Write(req writeRequest) error {
 	data, err := proto.Marshal(&req.Request)
 	if err != nil {
@@ -135,9 +347,14 @@ func (c *cortexPublisher) Write(req writeRequest) error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 	defer cancel()
 
-	httpResp, err := ctxhttp.Do(ctx, c.client, httpReq)
-	if err != nil {
-		return err
+	var httpResp *http.Response
+	if c.grpc != nil {
+		httpResp = c.writeGRPC(ctx, httpReq, req.orgID)
+	} else {
+		httpResp, err = ctxhttp.Do(ctx, c.client, httpReq)
+		if err != nil {
+			return err
+		}
 	}
 	defer httpResp.Body.Close()
 
@@ -147,45 +364,90 @@ func (c *cortexPublisher) Write(req writeRequest) error {
 		if scanner.Scan() {
 			line = scanner.Text()
 		}
-		err = fmt.Errorf("server returned HTTP status %s: %s", httpResp.Status, line)
+		err = &writeError{
+			statusCode: httpResp.StatusCode,
+			msg:        fmt.Sprintf("server returned HTTP status %s: %s", httpResp.Status, line),
+		}
 	}
 
 	return err
 }
 
+// writeGRPC forwards the request over httpgrpc. Transport errors are turned
+// into a 500 response by the httpgrpc client, so they are retried like any
+// other server error.
+func (c *cortexPublisher) writeGRPC(ctx context.Context, httpReq *http.Request, orgID int) *http.Response {
+	// the httpgrpc client takes the tenant from the context and the
+	// path from the RequestURI, as it expects an incoming request.
+	httpReq = httpReq.WithContext(user.InjectOrgID(ctx, strconv.Itoa(orgID)))
+	httpReq.RequestURI = "/api/prom/push"
+
+	rec := &responseRecorder{header: make(http.Header)}
+	c.grpc.ServeHTTP(rec, httpReq)
+	return rec.response()
+}
+
+// responseRecorder is the http.ResponseWriter the httpgrpc client writes the
+// response of a write request to.
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) response() *http.Response {
+	r.WriteHeader(http.StatusOK)
+	return &http.Response{
+		StatusCode: r.code,
+		Status:     fmt.Sprintf("%d %s", r.code, http.StatusText(r.code)),
+		Header:     r.header,
+		Body:       ioutil.NopCloser(&r.body),
+	}
+}
+
 type writeRequest struct {
 	Request prompb.WriteRequest
 	orgID   int
 }
 
-func packageMetrics(metrics []*schema.MetricData) (writeRequest, error) {
+// packageMetrics converts the metrics into one write request per org, as
+// cortex derives the tenant from the X-Scope-OrgID header of each request.
+// Metric names are translated into labels using the mapper, which may be nil.
+// Requests are returned in the order their org was first seen. If maxSamples
+// is greater than 0, an org's request is split into multiple requests holding
+// no more than maxSamples samples each.
+func packageMetrics(metrics []*schema.MetricData, mp *mapper, maxSamples int) ([]writeRequest, error) {
 	if len(metrics) < 1 {
-		return writeRequest{}, errNoMetrics
+		return nil, errNoMetrics
 	}
 
-	req := prompb.WriteRequest{
-		Timeseries: make([]*prompb.TimeSeries, 0, len(metrics)),
-	}
+	var reqs []writeRequest
+	orgIdx := make(map[int]int)
 	for _, m := range metrics {
-		labels := make([]*prompb.Label, 0, len(m.Tags)+1)
-		labels = append(labels,
-			&prompb.Label{
-				Name:  "__name__",
-				Value: strings.Replace(m.Name, ".", "_", -1),
-			},
-		)
-		for _, tag := range m.Tags {
-			tv := strings.SplitN(tag, "=", 2)
-			if len(tv) < 2 || tv[0] == "" || tv[1] == "" {
-				log.Warnf("tag: '%v' is not able to be encoded", tv)
-				continue
-			}
-			labels = append(labels, &prompb.Label{
-				Name:  tv[0],
-				Value: tv[1],
-			})
+		idx, ok := orgIdx[m.OrgId]
+		if !ok || (maxSamples > 0 && len(reqs[idx].Request.Timeseries) >= maxSamples) {
+			idx = len(reqs)
+			orgIdx[m.OrgId] = idx
+			reqs = append(reqs, writeRequest{orgID: m.OrgId})
 		}
-		req.Timeseries = append(req.Timeseries, &prompb.TimeSeries{
+
+		labels := buildLabels(m, mp)
+		reqs[idx].Request.Timeseries = append(reqs[idx].Request.Timeseries, &prompb.TimeSeries{
 			Labels: labels,
 			Samples: []prompb.Sample{
 				{
@@ -196,8 +458,5 @@ func packageMetrics(metrics []*schema.MetricData) (writeRequest, error) {
 		})
 	}
 
-	return writeRequest{
-		Request: req,
-		orgID:   metrics[0].OrgId,
-	}, nil
+	return reqs, nil
 }
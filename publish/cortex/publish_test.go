@@ -1,26 +1,34 @@
 package cortex
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/prometheus/prompb"
 	schema "github.com/raintank/schema"
+	"github.com/weaveworks/common/user"
 )
 
 func Test_packageMetrics(t *testing.T) {
 	tests := []struct {
-		name    string
-		metrics []*schema.MetricData
-		want    writeRequest
-		wantErr bool
+		name       string
+		metrics    []*schema.MetricData
+		maxSamples int
+		want       []writeRequest
+		wantErr    bool
 	}{
 		{
 			name: "basic metric",
 			metrics: []*schema.MetricData{
 				&schema.MetricData{Name: "example_metric"},
 			},
-			want: writeRequest{
+			want: []writeRequest{{
 				Request: prompb.WriteRequest{
 					Timeseries: []*prompb.TimeSeries{
 						&prompb.TimeSeries{
@@ -33,7 +41,7 @@ func Test_packageMetrics(t *testing.T) {
 						},
 					},
 				},
-			},
+			}},
 			wantErr: false,
 		},
 		{
@@ -41,7 +49,7 @@ func Test_packageMetrics(t *testing.T) {
 			metrics: []*schema.MetricData{
 				&schema.MetricData{Name: "example.metric"},
 			},
-			want: writeRequest{
+			want: []writeRequest{{
 				Request: prompb.WriteRequest{
 					Timeseries: []*prompb.TimeSeries{
 						&prompb.TimeSeries{
@@ -54,7 +62,7 @@ func Test_packageMetrics(t *testing.T) {
 						},
 					},
 				},
-			},
+			}},
 			wantErr: false,
 		},
 		{
@@ -65,7 +73,7 @@ func Test_packageMetrics(t *testing.T) {
 					Tags: []string{"example=tag"},
 				},
 			},
-			want: writeRequest{
+			want: []writeRequest{{
 				Request: prompb.WriteRequest{
 					Timeseries: []*prompb.TimeSeries{
 						&prompb.TimeSeries{
@@ -79,7 +87,7 @@ func Test_packageMetrics(t *testing.T) {
 						},
 					},
 				},
-			},
+			}},
 			wantErr: false,
 		},
 		{
@@ -90,7 +98,7 @@ func Test_packageMetrics(t *testing.T) {
 					Tags: []string{"example="},
 				},
 			},
-			want: writeRequest{
+			want: []writeRequest{{
 				Request: prompb.WriteRequest{
 					Timeseries: []*prompb.TimeSeries{
 						&prompb.TimeSeries{
@@ -103,7 +111,7 @@ func Test_packageMetrics(t *testing.T) {
 						},
 					},
 				},
-			},
+			}},
 			wantErr: false,
 		},
 		{
@@ -114,7 +122,7 @@ func Test_packageMetrics(t *testing.T) {
 					Tags: []string{"example1=tag", "example2=tag"},
 				},
 			},
-			want: writeRequest{
+			want: []writeRequest{{
 				Request: prompb.WriteRequest{
 					Timeseries: []*prompb.TimeSeries{
 						&prompb.TimeSeries{
@@ -129,20 +137,119 @@ func Test_packageMetrics(t *testing.T) {
 						},
 					},
 				},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "multiple orgs",
+			metrics: []*schema.MetricData{
+				&schema.MetricData{Name: "example_metric", OrgId: 2, Value: 1},
+				&schema.MetricData{Name: "example_metric", OrgId: 3, Value: 2},
+				&schema.MetricData{Name: "other_metric", OrgId: 2, Value: 3},
+			},
+			want: []writeRequest{
+				{
+					Request: prompb.WriteRequest{
+						Timeseries: []*prompb.TimeSeries{
+							&prompb.TimeSeries{
+								Labels: []*prompb.Label{
+									&prompb.Label{Name: "__name__", Value: "example_metric"},
+								},
+								Samples: []prompb.Sample{
+									prompb.Sample{Value: 1, Timestamp: 0},
+								},
+							},
+							&prompb.TimeSeries{
+								Labels: []*prompb.Label{
+									&prompb.Label{Name: "__name__", Value: "other_metric"},
+								},
+								Samples: []prompb.Sample{
+									prompb.Sample{Value: 3, Timestamp: 0},
+								},
+							},
+						},
+					},
+					orgID: 2,
+				},
+				{
+					Request: prompb.WriteRequest{
+						Timeseries: []*prompb.TimeSeries{
+							&prompb.TimeSeries{
+								Labels: []*prompb.Label{
+									&prompb.Label{Name: "__name__", Value: "example_metric"},
+								},
+								Samples: []prompb.Sample{
+									prompb.Sample{Value: 2, Timestamp: 0},
+								},
+							},
+						},
+					},
+					orgID: 3,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "split batch",
+			metrics: []*schema.MetricData{
+				&schema.MetricData{Name: "example_metric", OrgId: 2, Value: 1},
+				&schema.MetricData{Name: "example_metric", OrgId: 2, Value: 2},
+				&schema.MetricData{Name: "example_metric", OrgId: 2, Value: 3},
+			},
+			maxSamples: 2,
+			want: []writeRequest{
+				{
+					Request: prompb.WriteRequest{
+						Timeseries: []*prompb.TimeSeries{
+							&prompb.TimeSeries{
+								Labels: []*prompb.Label{
+									&prompb.Label{Name: "__name__", Value: "example_metric"},
+								},
+								Samples: []prompb.Sample{
+									prompb.Sample{Value: 1, Timestamp: 0},
+								},
+							},
+							&prompb.TimeSeries{
+								Labels: []*prompb.Label{
+									&prompb.Label{Name: "__name__", Value: "example_metric"},
+								},
+								Samples: []prompb.Sample{
+									prompb.Sample{Value: 2, Timestamp: 0},
+								},
+							},
+						},
+					},
+					orgID: 2,
+				},
+				{
+					Request: prompb.WriteRequest{
+						Timeseries: []*prompb.TimeSeries{
+							&prompb.TimeSeries{
+								Labels: []*prompb.Label{
+									&prompb.Label{Name: "__name__", Value: "example_metric"},
+								},
+								Samples: []prompb.Sample{
+									prompb.Sample{Value: 3, Timestamp: 0},
+								},
+							},
+						},
+					},
+					orgID: 2,
+				},
 			},
 			wantErr: false,
 		},
 		{
 			name:    "no metrics",
 			metrics: []*schema.MetricData{},
-			want:    writeRequest{},
+			want:    nil,
 			wantErr: true,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := packageMetrics(tt.metrics)
+			got, err := packageMetrics(tt.metrics, nil, tt.maxSamples)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("packageMetrics() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -153,3 +260,152 @@ func Test_packageMetrics(t *testing.T) {
 		})
 	}
 }
+
+func Test_publishRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statusCodes  []int
+		backoff      time.Duration
+		maxRetryTime time.Duration
+		stopped      bool
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{
+			name:         "success",
+			statusCodes:  []int{200},
+			wantAttempts: 1,
+			wantErr:      false,
+		},
+		{
+			name:         "retry server error",
+			statusCodes:  []int{500, 503, 200},
+			wantAttempts: 3,
+			wantErr:      false,
+		},
+		{
+			name:         "retry rate limited",
+			statusCodes:  []int{429, 200},
+			wantAttempts: 2,
+			wantErr:      false,
+		},
+		{
+			name:         "no retry on bad request",
+			statusCodes:  []int{400, 200},
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "retries exhausted",
+			statusCodes:  []int{500, 500, 500, 500, 500},
+			wantAttempts: 3,
+			wantErr:      true,
+		},
+		{
+			name:         "max retry time exceeded",
+			statusCodes:  []int{500, 500, 500, 500, 500},
+			backoff:      time.Second,
+			maxRetryTime: 100 * time.Millisecond,
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			name:         "no retry after stop",
+			statusCodes:  []int{500, 500, 500, 500, 500},
+			backoff:      time.Minute,
+			stopped:      true,
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(tt.statusCodes[n-1])
+			}))
+			defer srv.Close()
+
+			u, _ := url.Parse(srv.URL)
+			c := &cortexPublisher{
+				url:          u,
+				client:       srv.Client(),
+				timeout:      time.Second,
+				maxRetries:   2,
+				maxRetryTime: tt.maxRetryTime,
+			}
+			c.ctx, c.cancel = context.WithCancel(context.Background())
+			if tt.stopped {
+				c.Stop()
+			}
+			c.backoff.Min = time.Millisecond
+			c.backoff.Max = time.Millisecond
+			if tt.backoff > 0 {
+				c.backoff.Min = tt.backoff
+				c.backoff.Max = tt.backoff
+			}
+
+			err := c.Publish([]*schema.MetricData{
+				&schema.MetricData{Name: "example_metric", OrgId: 2},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Publish() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("Publish() attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func Test_writeGRPC(t *testing.T) {
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		wantErr    string
+	}{
+		{
+			name: "success",
+		},
+		{
+			name:       "server error",
+			statusCode: 500,
+			body:       "ingester unavailable\nmore details",
+			wantErr:    "server returned HTTP status 500 Internal Server Error: ingester unavailable",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var orgID string
+			u, _ := url.Parse("http://cortex")
+			c := &cortexPublisher{
+				url:     u,
+				timeout: time.Second,
+				grpc: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					orgID, _ = user.ExtractOrgID(r.Context())
+					if tt.statusCode != 0 {
+						w.WriteHeader(tt.statusCode)
+					}
+					w.Write([]byte(tt.body))
+				}),
+			}
+
+			err := c.Write(writeRequest{orgID: 2})
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Write() error = %v", err)
+			}
+			if tt.wantErr != "" {
+				if wErr, ok := err.(*writeError); !ok || wErr.statusCode != tt.statusCode || wErr.msg != tt.wantErr {
+					t.Errorf("Write() error = %#v, want %d: %s", err, tt.statusCode, tt.wantErr)
+				}
+			}
+			if orgID != "2" {
+				t.Errorf("request sent for org %q, want 2", orgID)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package kafka
+
+import (
+	"github.com/raintank/schema"
+	"github.com/raintank/tsdb-gw/api/models"
+	"github.com/raintank/tsdb-gw/publish/limits"
+)
+
+// OrgSeries is the number of active series of an org and its series limit
+type OrgSeries struct {
+	Active int `json:"active"`
+	Limit  int `json:"limit"`
+}
+
+// ActiveSeries responds with the number of active series and the series limit of each org
+func ActiveSeries(ctx *models.Context) {
+	resp := make(map[uint32]OrgSeries)
+	if keyCache != nil {
+		for org, n := range keyCache.OrgLens() {
+			resp[org] = OrgSeries{
+				Active: n,
+				Limit:  limits.MaxSeries(int(org)),
+			}
+		}
+	}
+	ctx.JSON(200, resp)
+}
+
+// PartitionInfo describes the partition a series is assigned to
+type PartitionInfo struct {
+	Id         string `json:"id"`
+	Key        string `json:"key"`
+	Partition  int32  `json:"partition"`
+	Partitions int32  `json:"partitions"`
+}
+
+// SeriesPartition responds with the partition the series described by the
+// org, name, tag and interval parameters is published to. The number of
+// partitions of the topic can be overridden with the partitions parameter,
+// to plan adding partitions.
+func SeriesPartition(ctx *models.Context) {
+	if partitioner == nil || client == nil {
+		ctx.JSON(503, "metrics publishing is not enabled")
+		return
+	}
+	m := &schema.MetricData{
+		OrgId:    ctx.QueryInt("org"),
+		Name:     ctx.Query("name"),
+		Tags:     ctx.QueryStrings("tag"),
+		Interval: ctx.QueryInt("interval"),
+		Unit:     "unknown",
+		Mtype:    "gauge",
+	}
+	if m.Name == "" {
+		ctx.JSON(400, "name is required")
+		return
+	}
+	if m.Interval == 0 {
+		m.Interval = 1
+	}
+	m.SetId()
+
+	numPartitions := int32(ctx.QueryInt("partitions"))
+	if numPartitions <= 0 {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			ctx.JSON(500, err.Error())
+			return
+		}
+		numPartitions = int32(len(partitions))
+	}
+	partition, err := partitioner.MetricPartition(m, numPartitions)
+	if err != nil {
+		ctx.JSON(400, err.Error())
+		return
+	}
+	ctx.JSON(200, PartitionInfo{
+		Id:         m.Id,
+		Key:        string(partitioner.Key(m, nil)),
+		Partition:  partition,
+		Partitions: numPartitions,
+	})
+}
@@ -0,0 +1,223 @@
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	aggReceived = stats.NewCounterRate32("output.kafka.aggregation.received")
+	aggEmitted  = stats.NewCounterRate32("output.kafka.aggregation.emitted")
+	aggErrors   = stats.NewCounterRate32("output.kafka.aggregation.publish_error")
+	aggLate     = stats.NewCounterRate32("output.kafka.aggregation.late")
+	aggInvalid  = stats.NewCounterRate32("output.kafka.aggregation.invalid")
+
+	errAggregationBacklog = errors.New("aggregated points could not be published yet, try again later")
+)
+
+// aggregation functions
+const (
+	AggLast = "last"
+	AggAvg  = "avg"
+	AggSum  = "sum"
+	AggMax  = "max"
+)
+
+func validAggregation(fn string) error {
+	switch fn {
+	case AggLast, AggAvg, AggSum, AggMax:
+		return nil
+	}
+	return fmt.Errorf("unknown aggregation function %q", fn)
+}
+
+type aggKey struct {
+	mkey schema.MKey
+	ts   int64
+}
+
+// aggPoint holds the state of a single output point
+type aggPoint struct {
+	metric *schema.MetricData
+	sum    float64
+	max    float64
+	count  int
+	last   int64 // timestamp of the point used as the last value
+}
+
+func (p *aggPoint) add(m *schema.MetricData) {
+	p.sum += m.Value
+	if p.count == 0 || m.Value > p.max {
+		p.max = m.Value
+	}
+	if p.count == 0 || m.Time >= p.last {
+		p.metric.Value = m.Value
+		p.last = m.Time
+	}
+	p.count++
+}
+
+func (p *aggPoint) value(fn string) float64 {
+	switch fn {
+	case AggAvg:
+		return p.sum / float64(p.count)
+	case AggSum:
+		return p.sum
+	case AggMax:
+		return p.max
+	}
+	return p.metric.Value
+}
+
+// aggregator buffers the points of each series for the series' interval,
+// as defined by the storage schemas, and emits a single point per interval.
+// Points are emitted once the interval has ended and the wait time has
+// passed, to allow late points to arrive. Points arriving after their
+// interval was emitted are published without aggregation. Points which could not be published are
+// kept and retried on the next flush, and no new points are accepted until
+// they are published.
+type aggregator struct {
+	sync.Mutex
+	fn      string
+	wait    time.Duration
+	schemas *schemasHolder
+	points  map[aggKey]*aggPoint
+	emitted int64                // the intervals ending at or before emitted were flushed
+	pending []*schema.MetricData // flushed points which failed to publish
+	publish func([]*schema.MetricData) error
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newAggregator(fn string, wait time.Duration, schemas *schemasHolder, publish func([]*schema.MetricData) error) *aggregator {
+	return &aggregator{
+		fn:      fn,
+		wait:    wait,
+		schemas: schemas,
+		points:  make(map[aggKey]*aggPoint),
+		publish: publish,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Add buffers the metrics. Points are aggregated over the schema interval
+// of the series, or the metric's interval if it is larger. The interval and
+// id of the metrics are kept, so enabling aggregation does not change the
+// ids of existing series. The buffered metrics are copies, so callers may reuse the passed metrics. Metrics with
+// an invalid id are counted and dropped. Late points, whose interval was
+// already emitted, are returned to be published without aggregation. While
+// flushed points are waiting to be published again, no metrics are added
+// and errAggregationBacklog is returned, so the callers retry them later.
+func (a *aggregator) Add(metrics []*schema.MetricData) ([]*schema.MetricData, error) {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.pending) > 0 {
+		return nil, errAggregationBacklog
+	}
+	var late []*schema.MetricData
+	for _, m := range metrics {
+		aggReceived.Inc()
+		_, s := a.schemas.Get().Match(m.Name, 0)
+		interval := s.Retentions[0].SecondsPerPoint
+		if m.Interval > interval {
+			interval = m.Interval
+		}
+
+		out := *m
+		out.Tags = append([]string(nil), m.Tags...)
+		mkey, err := schema.MKeyFromString(out.Id)
+		if err != nil {
+			aggInvalid.Inc()
+			log.Debugf("dropping metric %s with invalid id %q: %s", m.Name, out.Id, err)
+			continue
+		}
+
+		// align the point to the end of the interval it falls in
+		ts := (m.Time-1)/int64(interval)*int64(interval) + int64(interval)
+		if ts <= a.emitted {
+			aggLate.Inc()
+			late = append(late, m)
+			continue
+		}
+		key := aggKey{mkey, ts}
+		p, ok := a.points[key]
+		if !ok {
+			out.Time = ts
+			p = &aggPoint{metric: &out}
+			a.points[key] = p
+		}
+		p.add(m)
+	}
+	return late, nil
+}
+
+// flush returns the points which failed to publish before and the points
+// whose interval ended before now minus the wait time. Points added
+// afterwards for these intervals are late.
+func (a *aggregator) flush(now time.Time, all bool) []*schema.MetricData {
+	cutoff := now.Add(-a.wait).Unix()
+	a.Lock()
+	ready := a.pending
+	a.pending = nil
+	if cutoff > a.emitted {
+		a.emitted = cutoff
+	}
+	for key, p := range a.points {
+		if !all && key.ts > cutoff {
+			continue
+		}
+		p.metric.Value = p.value(a.fn)
+		ready = append(ready, p.metric)
+		delete(a.points, key)
+	}
+	a.Unlock()
+	return ready
+}
+
+// run periodically publishes the aggregated points, until stop is called.
+func (a *aggregator) run(interval time.Duration) {
+	defer close(a.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := a.emit(a.flush(now, false)); err != nil {
+				log.Errorf("failed to publish aggregated metrics, retrying on the next flush: %s", err)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// stop stops run and waits for it to return. The buffered points are
+// not published.
+func (a *aggregator) stop() {
+	close(a.done)
+	<-a.stopped
+}
+
+// emit publishes the metrics. If publishing fails, they are kept to be
+// returned by the next flush.
+func (a *aggregator) emit(metrics []*schema.MetricData) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if err := a.publish(metrics); err != nil {
+		aggErrors.Add(len(metrics))
+		a.Lock()
+		a.pending = append(a.pending, metrics...)
+		a.Unlock()
+		return fmt.Errorf("%d points: %s", len(metrics), err)
+	}
+	aggEmitted.Add(len(metrics))
+	return nil
+}
@@ -0,0 +1,186 @@
+package kafka
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/schema"
+)
+
+func testSchemas() *schemasHolder {
+	s := conf.NewSchemas([]conf.Schema{
+		{
+			Name:       "10s",
+			Pattern:    regexp.MustCompile(".*"),
+			Retentions: conf.Retentions{conf.NewRetentionMT(10, 3600, 600, 2, 0)},
+		},
+	})
+	h := &schemasHolder{}
+	h.current.Store(&s)
+	return h
+}
+
+func TestAggregator(t *testing.T) {
+	points := []struct {
+		ts    int64
+		value float64
+	}{
+		{ts: 101, value: 3},
+		{ts: 105, value: 7},
+		{ts: 103, value: 2},
+		{ts: 110, value: 4},
+		{ts: 111, value: 1},
+	}
+
+	tests := []struct {
+		fn   string
+		want map[int64]float64
+	}{
+		{fn: AggLast, want: map[int64]float64{110: 4, 120: 1}},
+		{fn: AggAvg, want: map[int64]float64{110: 4, 120: 1}},
+		{fn: AggSum, want: map[int64]float64{110: 16, 120: 1}},
+		{fn: AggMax, want: map[int64]float64{110: 7, 120: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fn, func(t *testing.T) {
+			a := newAggregator(tt.fn, 5*time.Second, testSchemas(), nil)
+			var id string
+			for _, p := range points {
+				m := &schema.MetricData{OrgId: 1, Name: "a.b", Interval: 1, Value: p.value, Time: p.ts, Mtype: "gauge"}
+				m.SetId()
+				id = m.Id
+				if late, err := a.Add([]*schema.MetricData{m}); err != nil || len(late) != 0 {
+					t.Fatalf("Add() = %v, %v, want no late points", late, err)
+				}
+			}
+
+			if got := a.flush(time.Unix(114, 0), false); len(got) != 0 {
+				t.Fatalf("flush() before wait returned %d points, want 0", len(got))
+			}
+			got := a.flush(time.Unix(115, 0), false)
+			if len(got) != 1 {
+				t.Fatalf("flush() returned %d points, want 1", len(got))
+			}
+			got = append(got, a.flush(time.Unix(115, 0), true)...)
+			for _, m := range got {
+				// the interval set by the client is kept, so the series id does not change
+				if m.Interval != 1 || m.Id != id {
+					t.Errorf("point %d has interval %d and id %s, want 1 and %s", m.Time, m.Interval, m.Id, id)
+				}
+				if want, ok := tt.want[m.Time]; !ok || m.Value != want {
+					t.Errorf("point %d = %v, want %v", m.Time, m.Value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAggregatorLateAndInvalid(t *testing.T) {
+	a := newAggregator(AggSum, 5*time.Second, testSchemas(), nil)
+	point := func(ts int64, value float64) *schema.MetricData {
+		m := &schema.MetricData{OrgId: 1, Name: "a.b", Interval: 10, Value: value, Time: ts, Mtype: "gauge"}
+		m.SetId()
+		return m
+	}
+
+	if _, err := a.Add([]*schema.MetricData{point(101, 1)}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	got := a.flush(time.Unix(115, 0), false)
+	if len(got) != 1 || got[0].Time != 110 || got[0].Value != 1 {
+		t.Fatalf("flush() = %v, want a single point 110 = 1", got)
+	}
+
+	late, invalid := aggLate.Peek(), aggInvalid.Peek()
+	bad := &schema.MetricData{Id: "bad", OrgId: 1, Name: "a.c", Interval: 10, Value: 5, Time: 111, Mtype: "gauge"}
+	lateOut, err := a.Add([]*schema.MetricData{point(105, 2), bad, point(111, 3)})
+	if err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	// the late point is returned unaggregated, to be published as is
+	if len(lateOut) != 1 || lateOut[0].Time != 105 || lateOut[0].Value != 2 {
+		t.Errorf("Add() late points = %v, want a single point 105 = 2", lateOut)
+	}
+	if n := aggLate.Peek() - late; n != 1 {
+		t.Errorf("late points = %d, want 1", n)
+	}
+	if n := aggInvalid.Peek() - invalid; n != 1 {
+		t.Errorf("invalid metrics = %d, want 1", n)
+	}
+
+	// the emitted interval is not emitted again
+	got = a.flush(time.Unix(125, 0), true)
+	if len(got) != 1 || got[0].Time != 120 || got[0].Value != 3 {
+		t.Errorf("flush() = %v, want a single point 120 = 3", got)
+	}
+}
+
+func TestAggregatorRetriesFailedPublish(t *testing.T) {
+	var published []*schema.MetricData
+	fail := true
+	a := newAggregator(AggSum, 5*time.Second, testSchemas(), func(metrics []*schema.MetricData) error {
+		if fail {
+			return errors.New("kafka unavailable")
+		}
+		published = append(published, metrics...)
+		return nil
+	})
+	point := func(ts int64) *schema.MetricData {
+		m := &schema.MetricData{OrgId: 1, Name: "a.b", Interval: 10, Value: 1, Time: ts, Mtype: "gauge"}
+		m.SetId()
+		return m
+	}
+
+	if _, err := a.Add([]*schema.MetricData{point(101)}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := a.emit(a.flush(time.Unix(115, 0), false)); err == nil {
+		t.Fatal("emit() should fail")
+	}
+	// new points are refused while the failed points are not published
+	if _, err := a.Add([]*schema.MetricData{point(111)}); err != errAggregationBacklog {
+		t.Fatalf("Add() with failed points error = %v, want %v", err, errAggregationBacklog)
+	}
+
+	fail = false
+	if err := a.emit(a.flush(time.Unix(116, 0), false)); err != nil {
+		t.Fatalf("emit() error = %v", err)
+	}
+	if len(published) != 1 || published[0].Time != 110 || published[0].Value != 1 {
+		t.Fatalf("published %v, want a single point 110 = 1", published)
+	}
+	if _, err := a.Add([]*schema.MetricData{point(111)}); err != nil {
+		t.Errorf("Add() after retry error = %v", err)
+	}
+}
+
+func TestAggregatorStop(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	a := newAggregator(AggSum, 0, testSchemas(), func(metrics []*schema.MetricData) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return nil
+	})
+	go a.run(time.Millisecond)
+	a.stop()
+
+	// nothing is published by run after stop returned
+	m := &schema.MetricData{OrgId: 1, Name: "a.b", Interval: 10, Value: 1, Time: 1, Mtype: "gauge"}
+	m.SetId()
+	if _, err := a.Add([]*schema.MetricData{m}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 0 {
+		t.Errorf("published %d times after stop()", calls)
+	}
+}
@@ -0,0 +1,131 @@
+package kafka
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/schema"
+)
+
+var (
+	intervalDetected = stats.NewCounterRate32("output.kafka.interval_detection.detected")
+	intervalFallback = stats.NewCounterRate32("output.kafka.interval_detection.fallback")
+	intervalSeries   = stats.NewGauge32("output.kafka.interval_detection.series")
+)
+
+// seriesInterval tracks the timestamps of a series to detect its interval
+type seriesInterval struct {
+	last      int64 // timestamp of the last point
+	candidate int   // interval seen in the last consecutive points
+	count     int   // number of consecutive points matching candidate
+	interval  int   // detected interval, 0 until settled
+}
+
+// observe records the timestamp and returns the detected interval, or 0 if
+// the interval has not settled yet.
+func (s *seriesInterval) observe(ts int64, settleAfter int) int {
+	if s.interval != 0 {
+		return s.interval
+	}
+	delta := int(ts - s.last)
+	if s.last == 0 || delta <= 0 {
+		// first point, or a duplicate or out of order point
+		if ts > s.last {
+			s.last = ts
+		}
+		return 0
+	}
+	s.last = ts
+	// allow some jitter in the cadence of the sender
+	if s.candidate != 0 && abs(delta-s.candidate) <= s.candidate/10 {
+		s.count++
+	} else {
+		s.candidate = delta
+		s.count = 1
+	}
+	// count is the number of deltas, which is one less than the number of points
+	if s.count+1 >= settleAfter {
+		s.interval = s.candidate
+	}
+	return s.interval
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// intervalDetector detects the interval of series from the timestamps of
+// consecutive points. To bound memory, it keeps two generations of series:
+// when the current generation is full it becomes the previous one, dropping
+// the series which were not seen during the previous generation.
+type intervalDetector struct {
+	sync.Mutex
+	settleAfter int
+	maxSeries   int
+	current     map[uint64]*seriesInterval
+	previous    map[uint64]*seriesInterval
+}
+
+func newIntervalDetector(settleAfter, maxSeries int) *intervalDetector {
+	if settleAfter < 2 {
+		settleAfter = 2
+	}
+	return &intervalDetector{
+		settleAfter: settleAfter,
+		maxSeries:   maxSeries,
+		current:     make(map[uint64]*seriesInterval),
+		previous:    make(map[uint64]*seriesInterval),
+	}
+}
+
+// seriesKey identifies a series regardless of its interval
+func seriesKey(m *schema.MetricData) uint64 {
+	h := fnv.New64a()
+	var org [4]byte
+	org[0], org[1], org[2], org[3] = byte(m.OrgId), byte(m.OrgId>>8), byte(m.OrgId>>16), byte(m.OrgId>>24)
+	h.Write(org[:])
+	h.Write([]byte(m.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(m.Unit))
+	h.Write([]byte{0})
+	h.Write([]byte(m.Mtype))
+	for _, t := range m.Tags {
+		h.Write([]byte{0})
+		h.Write([]byte(t))
+	}
+	return h.Sum64()
+}
+
+// Observe records the metric's timestamp and returns the detected interval
+// of its series, or false if it has not been detected yet. The tags of the
+// metric must be sorted.
+func (d *intervalDetector) Observe(m *schema.MetricData) (int, bool) {
+	key := seriesKey(m)
+	d.Lock()
+	s, ok := d.current[key]
+	if !ok {
+		s, ok = d.previous[key]
+		if !ok {
+			s = &seriesInterval{}
+		}
+		if len(d.current) >= d.maxSeries/2 {
+			d.previous = d.current
+			d.current = make(map[uint64]*seriesInterval)
+		}
+		d.current[key] = s
+		intervalSeries.Set(len(d.current) + len(d.previous))
+	}
+	interval := s.observe(m.Time, d.settleAfter)
+	d.Unlock()
+
+	if interval == 0 {
+		intervalFallback.Inc()
+		return 0, false
+	}
+	intervalDetected.Inc()
+	return interval, true
+}
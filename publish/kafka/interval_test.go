@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/raintank/schema"
+)
+
+func TestIntervalDetector(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps []int64
+		want       []int // detected interval after each point, 0 if not detected
+	}{
+		{name: "steady", timestamps: []int64{100, 110, 120, 130}, want: []int{0, 0, 10, 10}},
+		{name: "jitter", timestamps: []int64{100, 130, 161, 190}, want: []int{0, 0, 30, 30}},
+		{name: "changing cadence", timestamps: []int64{100, 105, 115, 125}, want: []int{0, 0, 0, 10}},
+		{name: "duplicates and out of order", timestamps: []int64{100, 100, 90, 160, 220}, want: []int{0, 0, 0, 0, 60}},
+		{name: "settled interval is kept", timestamps: []int64{100, 110, 120, 125, 130}, want: []int{0, 0, 10, 10, 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newIntervalDetector(3, 100)
+			for i, ts := range tt.timestamps {
+				m := &schema.MetricData{OrgId: 1, Name: "a.b", Tags: []string{"a=b"}, Time: ts}
+				got, ok := d.Observe(m)
+				if got != tt.want[i] || ok != (tt.want[i] != 0) {
+					t.Errorf("point %d: Observe() = %d, %v, want %d", i, got, ok, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestIntervalDetectorBounded(t *testing.T) {
+	d := newIntervalDetector(2, 10)
+	for i := 0; i < 100; i++ {
+		d.Observe(&schema.MetricData{OrgId: i, Name: "a.b", Time: 100})
+	}
+	if n := len(d.current) + len(d.previous); n > 10 {
+		t.Errorf("detector tracks %d series, want at most 10", n)
+	}
+	// recently seen series survive a generation change
+	d.Observe(&schema.MetricData{OrgId: 99, Name: "a.b", Time: 110})
+	if got, ok := d.Observe(&schema.MetricData{OrgId: 99, Name: "a.b", Time: 120}); !ok || got != 10 {
+		t.Errorf("Observe() = %d, %v, want 10, true", got, ok)
+	}
+}
@@ -1,6 +1,10 @@
 package keycache
 
-import schema "github.com/raintank/schema"
+import (
+	"sync/atomic"
+
+	schema "github.com/raintank/schema"
+)
 
 // Cache is a single-tenant keycache
 // it is sharded for 2 reasons:
@@ -9,6 +13,7 @@ import schema "github.com/raintank/schema"
 // We shard on the first byte of the metric key, which we assume
 // is evenly distributed.
 type Cache struct {
+	size   int64 // number of keys across all shards, so Len is cheap
 	shards [256]Shard
 }
 
@@ -24,20 +29,34 @@ func NewCache() *Cache {
 // Touch marks the key as seen and returns whether it was seen before
 func (c *Cache) Touch(key schema.Key) bool {
 	shard := int(key[0])
-	return c.shards[shard].Touch(key)
+	ok := c.shards[shard].Touch(key)
+	if !ok {
+		atomic.AddInt64(&c.size, 1)
+	}
+	return ok
+}
+
+// TouchLimited is like Touch, but new keys are only added while the cache
+// holds fewer than limit keys. A limit of 0 means no limit.
+// It returns whether the key was seen before and whether it is in the cache.
+// Concurrent callers may push the cache slightly over the limit.
+func (c *Cache) TouchLimited(key schema.Key, limit int) (bool, bool) {
+	if limit > 0 && c.Len() >= limit {
+		shard := int(key[0])
+		if !c.shards[shard].Has(key) {
+			return false, false
+		}
+	}
+	return c.Touch(key), true
 }
 
 // Len returns the length of the cache
 func (c *Cache) Len() int {
-	var sum int
-	for i := 0; i < 256; i++ {
-		sum += c.shards[i].Len()
-	}
-	return sum
+	return int(atomic.LoadInt64(&c.size))
 }
 
 // Clear resets the given shard
 func (c *Cache) Clear(i int) int {
-	c.shards[i].Reset()
-	return c.Len()
+	removed := c.shards[i].Reset()
+	return int(atomic.AddInt64(&c.size, -int64(removed)))
 }
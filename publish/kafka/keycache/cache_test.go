@@ -0,0 +1,49 @@
+package keycache
+
+import (
+	"testing"
+
+	schema "github.com/raintank/schema"
+)
+
+func TestCacheTouchLimited(t *testing.T) {
+	c := NewCache()
+	key := func(b byte) schema.Key {
+		var k schema.Key
+		k[0] = b
+		k[1] = b
+		return k
+	}
+
+	tests := []struct {
+		name         string
+		key          schema.Key
+		limit        int
+		wantSeen     bool
+		wantAccepted bool
+		wantLen      int
+	}{
+		{name: "new key under limit", key: key(1), limit: 2, wantSeen: false, wantAccepted: true, wantLen: 1},
+		{name: "known key", key: key(1), limit: 2, wantSeen: true, wantAccepted: true, wantLen: 1},
+		{name: "second key reaches limit", key: key(2), limit: 2, wantSeen: false, wantAccepted: true, wantLen: 2},
+		{name: "new key over limit", key: key(3), limit: 2, wantSeen: false, wantAccepted: false, wantLen: 2},
+		{name: "known key at limit", key: key(2), limit: 2, wantSeen: true, wantAccepted: true, wantLen: 2},
+		{name: "no limit", key: key(3), limit: 0, wantSeen: false, wantAccepted: true, wantLen: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen, accepted := c.TouchLimited(tt.key, tt.limit)
+			if seen != tt.wantSeen || accepted != tt.wantAccepted {
+				t.Errorf("TouchLimited() = %v, %v, want %v, %v", seen, accepted, tt.wantSeen, tt.wantAccepted)
+			}
+			if c.Len() != tt.wantLen {
+				t.Errorf("Len() = %d, want %d", c.Len(), tt.wantLen)
+			}
+		})
+	}
+
+	if n := c.Clear(1); n != 2 {
+		t.Errorf("Clear() = %d, want 2", n)
+	}
+}
@@ -31,21 +31,33 @@ func NewKeyCache(clearInterval time.Duration) *KeyCache {
 // Touch marks the key as seen and returns whether it was seen before
 // callers should assure that t >= ref and t-ref <= 42 hours
 func (k *KeyCache) Touch(key schema.MKey) bool {
+	return k.getCache(key.Org).Touch(key.Key)
+}
+
+// TouchLimited marks the key as seen unless it is new and the org already
+// has limit keys. A limit of 0 means no limit.
+// It returns whether the key was seen before and whether it was accepted.
+func (k *KeyCache) TouchLimited(key schema.MKey, limit int) (bool, bool) {
+	return k.getCache(key.Org).TouchLimited(key.Key, limit)
+}
+
+// getCache returns the cache of the org, creating it if needed
+func (k *KeyCache) getCache(org uint32) *Cache {
 	k.RLock()
-	cache, ok := k.caches[key.Org]
+	cache, ok := k.caches[org]
 	k.RUnlock()
 	// most likely this branch won't execute
 	if !ok {
 		k.Lock()
 		// check again in case another routine has just added it
-		cache, ok = k.caches[key.Org]
+		cache, ok = k.caches[org]
 		if !ok {
 			cache = NewCache()
-			k.caches[key.Org] = cache
+			k.caches[org] = cache
 		}
 		k.Unlock()
 	}
-	return cache.Touch(key.Key)
+	return cache
 }
 
 // Len returns the size across all orgs
@@ -63,6 +75,17 @@ func (k *KeyCache) Len() int {
 	return sum
 }
 
+// OrgLens returns the number of keys of each org
+func (k *KeyCache) OrgLens() map[uint32]int {
+	k.RLock()
+	lens := make(map[uint32]int, len(k.caches))
+	for org, c := range k.caches {
+		lens[org] = c.Len()
+	}
+	k.RUnlock()
+	return lens
+}
+
 // clear makes sure each org's cache is periodically cleared
 func (k *KeyCache) clear() {
 	tick := time.NewTicker(k.clearInterval)
@@ -35,6 +35,25 @@ func (s *Shard) Touch(key schema.Key) bool {
 	return ok
 }
 
+// Has returns whether the key has been seen, without marking it as seen
+func (s *Shard) Has(key schema.Key) bool {
+	var sub SubKey
+	copy(sub[:], key[1:])
+	s.Lock()
+	_, ok := s.data[sub]
+	s.Unlock()
+	return ok
+}
+
+// Keys calls fn for each key in the shard, with the shard locked
+func (s *Shard) Keys(fn func(sub SubKey)) {
+	s.Lock()
+	for sub := range s.data {
+		fn(sub)
+	}
+	s.Unlock()
+}
+
 // Len returns the length of the shard
 func (s *Shard) Len() int {
 	s.Lock()
@@ -43,9 +62,11 @@ func (s *Shard) Len() int {
 	return l
 }
 
-// Reset resets the shard, making it empty
-func (s *Shard) Reset() {
+// Reset resets the shard, making it empty. It returns the number of keys removed
+func (s *Shard) Reset() int {
 	s.Lock()
+	l := len(s.data)
 	s.data = make(map[SubKey]struct{})
 	s.Unlock()
+	return l
 }
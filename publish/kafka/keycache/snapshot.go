@@ -0,0 +1,164 @@
+package keycache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	schema "github.com/raintank/schema"
+)
+
+// snapshot format:
+// magic (4 bytes) | unix timestamp (int64) | number of keys (uint64)
+// followed by, for each key: org (uint32) | key (16 bytes)
+// all integers are big endian.
+var snapshotMagic = [4]byte{'K', 'C', '0', '1'}
+
+const (
+	snapshotHeaderSize = 20
+	snapshotKeySize    = 20
+)
+
+// ErrSnapshotTooOld is returned when loading a snapshot older than the max age
+var ErrSnapshotTooOld = errors.New("keycache snapshot is too old")
+
+// Save writes all keys in the cache to w, marked as taken at now.
+// It returns the number of keys written.
+func (k *KeyCache) Save(w io.Writer, now time.Time) (int, error) {
+	k.RLock()
+	orgs := make(map[uint32]*Cache, len(k.caches))
+	for org, c := range k.caches {
+		orgs[org] = c
+	}
+	k.RUnlock()
+
+	type entry struct {
+		org uint32
+		key schema.Key
+	}
+	var entries []entry
+	for org, c := range orgs {
+		for i := range c.shards {
+			c.shards[i].Keys(func(sub SubKey) {
+				e := entry{org: org}
+				e.key[0] = byte(i)
+				copy(e.key[1:], sub[:])
+				entries = append(entries, e)
+			})
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(snapshotMagic[:])
+	binary.Write(bw, binary.BigEndian, now.Unix())
+	binary.Write(bw, binary.BigEndian, uint64(len(entries)))
+	var buf [snapshotKeySize]byte
+	for _, e := range entries {
+		binary.BigEndian.PutUint32(buf[:4], e.org)
+		copy(buf[4:], e.key[:])
+		bw.Write(buf[:])
+	}
+	return len(entries), bw.Flush()
+}
+
+// Load adds the keys of the snapshot in r to the cache. Snapshots taken more
+// than maxAge before now are rejected with ErrSnapshotTooOld.
+// It returns the number of keys loaded.
+func (k *KeyCache) Load(r io.Reader, maxAge time.Duration, now time.Time) (int, error) {
+	return k.load(r, -1, maxAge, now)
+}
+
+// load loads the snapshot in r of size bytes, or of unknown size if size
+// is negative. The number of keys in the header is only trusted once it is
+// checked against the size.
+func (k *KeyCache) load(r io.Reader, size int64, maxAge time.Duration, now time.Time) (int, error) {
+	br := bufio.NewReader(r)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return 0, fmt.Errorf("failed to read keycache snapshot header: %s", err)
+	}
+	if magic != snapshotMagic {
+		return 0, errors.New("not a keycache snapshot")
+	}
+	var ts int64
+	var count uint64
+	if err := binary.Read(br, binary.BigEndian, &ts); err != nil {
+		return 0, fmt.Errorf("failed to read keycache snapshot header: %s", err)
+	}
+	if err := binary.Read(br, binary.BigEndian, &count); err != nil {
+		return 0, fmt.Errorf("failed to read keycache snapshot header: %s", err)
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > maxAge || age < 0 {
+		return 0, ErrSnapshotTooOld
+	}
+
+	// read all keys before adding any, so a truncated snapshot is not loaded partially
+	var keys []schema.MKey
+	if size >= 0 {
+		n := size - snapshotHeaderSize
+		if n < 0 || n%snapshotKeySize != 0 || count != uint64(n/snapshotKeySize) {
+			return 0, fmt.Errorf("keycache snapshot of %d bytes does not hold %d keys", size, count)
+		}
+		keys = make([]schema.MKey, 0, count)
+	}
+	var buf [snapshotKeySize]byte
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			return 0, fmt.Errorf("failed to read keycache snapshot: %s", err)
+		}
+		var mkey schema.MKey
+		mkey.Org = binary.BigEndian.Uint32(buf[:4])
+		copy(mkey.Key[:], buf[4:])
+		keys = append(keys, mkey)
+	}
+	for _, mkey := range keys {
+		k.Touch(mkey)
+	}
+	return len(keys), nil
+}
+
+// SaveFile writes a snapshot of the cache to the file at path.
+// The snapshot is written to a temporary file first, so an existing
+// snapshot is only replaced by a complete one.
+func (k *KeyCache) SaveFile(path string) (int, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	n, err := k.Save(tmp, time.Now())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+// LoadFile loads the snapshot at path into the cache. See Load.
+func (k *KeyCache) LoadFile(path string, maxAge time.Duration) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return k.load(f, info.Size(), maxAge, time.Now())
+}
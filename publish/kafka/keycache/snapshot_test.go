@@ -0,0 +1,123 @@
+package keycache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	schema "github.com/raintank/schema"
+)
+
+func TestSnapshot(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	src := NewKeyCache(time.Hour)
+	keys := []schema.MKey{
+		{Org: 1, Key: schema.Key{1, 2, 3}},
+		{Org: 1, Key: schema.Key{200, 2, 3}},
+		{Org: 7, Key: schema.Key{1, 2, 3}},
+	}
+	for _, k := range keys {
+		src.Touch(k)
+	}
+	var buf bytes.Buffer
+	if n, err := src.Save(&buf, now); err != nil || n != len(keys) {
+		t.Fatalf("Save() = %d, %v, want %d, nil", n, err, len(keys))
+	}
+	snapshot := buf.Bytes()
+
+	tests := []struct {
+		name     string
+		data     []byte
+		now      time.Time
+		wantErr  bool
+		wantKeys int
+	}{
+		{name: "fresh snapshot", data: snapshot, now: now.Add(time.Minute), wantKeys: 3},
+		{name: "too old", data: snapshot, now: now.Add(11 * time.Minute), wantErr: true},
+		{name: "truncated", data: snapshot[:len(snapshot)-5], now: now, wantErr: true},
+		{name: "garbage", data: []byte("not a snapshot"), now: now, wantErr: true},
+		{name: "corrupt count", data: withCount(snapshot, 1<<60), now: now, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := NewKeyCache(time.Hour)
+			n, err := dst.Load(bytes.NewReader(tt.data), 10*time.Minute, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n != tt.wantKeys || dst.Len() != tt.wantKeys {
+				t.Errorf("Load() = %d keys, Len() = %d, want %d", n, dst.Len(), tt.wantKeys)
+			}
+			if tt.wantErr {
+				return
+			}
+			for _, k := range keys {
+				if !dst.Touch(k) {
+					t.Errorf("key %v not loaded", k)
+				}
+			}
+		})
+	}
+}
+
+// withCount returns a copy of the snapshot with the number of keys in the
+// header replaced by count.
+func withCount(snapshot []byte, count uint64) []byte {
+	b := append([]byte(nil), snapshot...)
+	binary.BigEndian.PutUint64(b[12:20], count)
+	return b
+}
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keycache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+
+	src := NewKeyCache(time.Hour)
+	src.Touch(schema.MKey{Org: 1, Key: schema.Key{1}})
+	src.Touch(schema.MKey{Org: 2, Key: schema.Key{2}})
+	if n, err := src.SaveFile(path); err != nil || n != 2 {
+		t.Fatalf("SaveFile() = %d, %v, want 2, nil", n, err)
+	}
+	snapshot, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantErr  bool
+		wantKeys int
+	}{
+		{name: "valid", data: snapshot, wantKeys: 2},
+		{name: "truncated key", data: snapshot[:len(snapshot)-5], wantErr: true},
+		{name: "truncated header", data: snapshot[:snapshotHeaderSize-1], wantErr: true},
+		{name: "trailing data", data: append(append([]byte(nil), snapshot...), 1, 2, 3), wantErr: true},
+		{name: "count too large", data: withCount(snapshot, 1<<60), wantErr: true},
+		{name: "count overflows", data: withCount(snapshot, 1<<63+2), wantErr: true},
+		{name: "count too small", data: withCount(snapshot, 1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, tt.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			dst := NewKeyCache(time.Hour)
+			n, err := dst.LoadFile(path, time.Hour)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n != tt.wantKeys || dst.Len() != tt.wantKeys {
+				t.Errorf("LoadFile() = %d keys, Len() = %d, want %d", n, dst.Len(), tt.wantKeys)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package kafka
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/raintank/schema"
+)
+
+// partition schemes, defining which properties of a metric determine its partition
+const (
+	ByOrg            = "byOrg"
+	BySeries         = "bySeries"
+	BySeriesWithTags = "bySeriesWithTags"
+)
+
+// partition hash functions, mapping a partition key to a partition
+const (
+	HashFNV  = "fnv"
+	HashJump = "jump"
+)
+
+// Partitioner assigns metrics to partitions. Orgs may be pinned to a
+// partition, the metrics of other orgs are assigned by hashing their
+// partition key.
+type Partitioner struct {
+	scheme string
+	hash   string
+	pinned map[int]int32
+	fnv    sarama.Partitioner
+}
+
+// NewPartitioner creates a Partitioner. pins is a comma separated list of
+// orgId:partition pairs.
+func NewPartitioner(scheme, hash, pins string) (*Partitioner, error) {
+	switch scheme {
+	case ByOrg, BySeries, BySeriesWithTags:
+	default:
+		return nil, fmt.Errorf("partition scheme must be one of 'byOrg|bySeries|bySeriesWithTags'. got %s", scheme)
+	}
+	switch hash {
+	case HashFNV, HashJump:
+	default:
+		return nil, fmt.Errorf("partition hash must be one of 'fnv|jump'. got %s", hash)
+	}
+	pinned, err := parsePins(pins)
+	if err != nil {
+		return nil, err
+	}
+	return &Partitioner{
+		scheme: scheme,
+		hash:   hash,
+		pinned: pinned,
+		fnv:    sarama.NewHashPartitioner(""),
+	}, nil
+}
+
+func parsePins(pins string) (map[int]int32, error) {
+	pinned := make(map[int]int32)
+	for _, pin := range strings.Split(pins, ",") {
+		pin = strings.TrimSpace(pin)
+		if pin == "" {
+			continue
+		}
+		parts := strings.SplitN(pin, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid partition pin %q. expected orgId:partition", pin)
+		}
+		org, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid orgId in partition pin %q", pin)
+		}
+		partition, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil || partition < 0 {
+			return nil, fmt.Errorf("invalid partition in partition pin %q", pin)
+		}
+		pinned[org] = int32(partition)
+	}
+	return pinned, nil
+}
+
+// Key returns the partition key of the metric, appended to b.
+func (p *Partitioner) Key(m *schema.MetricData, b []byte) []byte {
+	switch p.scheme {
+	case ByOrg:
+		return m.KeyByOrgId(b)
+	case BySeriesWithTags:
+		b = m.KeyBySeries(b)
+		tags := m.Tags
+		if !sort.StringsAreSorted(tags) {
+			// tags may be shared with other metrics, so sort a copy
+			tags = append([]string(nil), tags...)
+			sort.Strings(tags)
+		}
+		for _, t := range tags {
+			b = append(b, ';')
+			b = append(b, t...)
+		}
+		return b
+	}
+	return m.KeyBySeries(b)
+}
+
+// Message returns a message for the metric, which Partition assigns to the metric's partition.
+func (p *Partitioner) Message(m *schema.MetricData, value []byte) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Key:      sarama.ByteEncoder(p.Key(m, nil)),
+		Topic:    topic,
+		Value:    sarama.ByteEncoder(value),
+		Metadata: m.OrgId,
+	}
+}
+
+// MetricPartition returns the partition the metric is assigned to.
+func (p *Partitioner) MetricPartition(m *schema.MetricData, numPartitions int32) (int32, error) {
+	return p.partition(m.OrgId, p.Key(m, nil), numPartitions)
+}
+
+func (p *Partitioner) partition(org int, key []byte, numPartitions int32) (int32, error) {
+	if partition, ok := p.pinned[org]; ok {
+		if partition >= numPartitions {
+			return 0, fmt.Errorf("org %d is pinned to partition %d, but there are only %d partitions", org, partition, numPartitions)
+		}
+		return partition, nil
+	}
+	if p.hash == HashJump {
+		h := fnv.New64a()
+		h.Write(key)
+		return jumpHash(h.Sum64(), numPartitions), nil
+	}
+	return p.fnv.Partition(&sarama.ProducerMessage{Key: sarama.ByteEncoder(key)}, numPartitions)
+}
+
+// Partition implements sarama.Partitioner
+func (p *Partitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	key, err := msg.Key.Encode()
+	if err != nil {
+		return 0, err
+	}
+	org, _ := msg.Metadata.(int)
+	return p.partition(org, key, numPartitions)
+}
+
+// RequiresConsistency implements sarama.Partitioner
+func (p *Partitioner) RequiresConsistency() bool {
+	return true
+}
+
+// jumpHash is the jump consistent hash by Lamping and Veach. When the number
+// of partitions grows, only the keys moving to the new partitions change
+// partition.
+func jumpHash(key uint64, numBuckets int32) int32 {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int32(b)
+}
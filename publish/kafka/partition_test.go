@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"testing"
+
+	p "github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/raintank/schema"
+)
+
+func TestPartitioner(t *testing.T) {
+	a := &schema.MetricData{OrgId: 1, Name: "a.b", Tags: []string{"dc=eu", "host=a"}}
+	b := &schema.MetricData{OrgId: 1, Name: "a.b", Tags: []string{"host=b", "dc=eu"}}
+
+	tests := []struct {
+		name    string
+		scheme  string
+		hash    string
+		pins    string
+		metric  *schema.MetricData
+		wantKey string
+		want    int32
+		wantErr bool
+	}{
+		{name: "bySeries ignores tags", scheme: BySeries, hash: HashFNV, metric: b, wantKey: "a.b", want: 4},
+		{name: "bySeriesWithTags", scheme: BySeriesWithTags, hash: HashFNV, metric: a, wantKey: "a.b;dc=eu;host=a", want: 6},
+		{name: "bySeriesWithTags sorts tags", scheme: BySeriesWithTags, hash: HashFNV, metric: b, wantKey: "a.b;dc=eu;host=b", want: 1},
+		{name: "jump hash", scheme: BySeriesWithTags, hash: HashJump, metric: a, wantKey: "a.b;dc=eu;host=a", want: 0},
+		{name: "pinned org", scheme: BySeries, hash: HashFNV, pins: "2:4, 1:6", metric: a, wantKey: "a.b", want: 6},
+		{name: "pinned to missing partition", scheme: BySeries, hash: HashFNV, pins: "1:8", metric: a, wantKey: "a.b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPartitioner(tt.scheme, tt.hash, tt.pins)
+			if err != nil {
+				t.Fatalf("NewPartitioner() error = %v", err)
+			}
+			if key := string(p.Key(tt.metric, nil)); key != tt.wantKey {
+				t.Errorf("Key() = %q, want %q", key, tt.wantKey)
+			}
+			got, err := p.MetricPartition(tt.metric, 8)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MetricPartition() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("MetricPartition() = %d, want %d", got, tt.want)
+			}
+			// messages must be assigned to the same partition
+			if !tt.wantErr {
+				msgPartition, _ := p.Partition(p.Message(tt.metric, nil), 8)
+				if msgPartition != got {
+					t.Errorf("Partition() = %d, want %d", msgPartition, got)
+				}
+			}
+		})
+	}
+	if b.Tags[0] != "host=b" {
+		t.Errorf("Key() modified the metric's tags")
+	}
+}
+
+// the byOrg and bySeries schemes must keep assigning series to the same
+// partitions as the metrictank partitioner
+func TestPartitionerCompatibility(t *testing.T) {
+	m := &schema.MetricData{OrgId: 3, Name: "some.series.name"}
+	for _, scheme := range []string{ByOrg, BySeries} {
+		mt, err := p.NewKafka(scheme)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ours, err := NewPartitioner(scheme, HashFNV, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := mt.Partition(m, 32)
+		got, _ := ours.MetricPartition(m, 32)
+		if got != want {
+			t.Errorf("%s: MetricPartition() = %d, metrictank partitioner = %d", scheme, got, want)
+		}
+	}
+}
+
+func TestJumpHashStability(t *testing.T) {
+	moved := 0
+	for key := uint64(0); key < 10000; key++ {
+		before := jumpHash(key, 10)
+		after := jumpHash(key, 11)
+		if before != after {
+			if after != 10 {
+				t.Fatalf("key %d moved from %d to %d", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 1500 {
+		t.Errorf("unexpected number of moved keys: %d", moved)
+	}
+}
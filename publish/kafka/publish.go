@@ -3,27 +3,32 @@ package kafka
 import (
 	"errors"
 	"flag"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/grafana/metrictank/conf"
-
 	"github.com/Shopify/sarama"
-	p "github.com/grafana/metrictank/cluster/partitioner"
 	"github.com/grafana/metrictank/stats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/raintank/schema"
 	"github.com/raintank/schema/msg"
 	"github.com/raintank/tsdb-gw/publish/kafka/keycache"
+	"github.com/raintank/tsdb-gw/publish/limits"
 	"github.com/raintank/tsdb-gw/util"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
+	client          sarama.Client
 	producer        sarama.SyncProducer
 	brokers         []string
 	kafkaVersionStr string
 	keyCache        *keycache.KeyCache
 
-	partitioner *p.Kafka
+	partitioner *Partitioner
 	schemasConf string
 
 	publishedMD     = stats.NewCounterRate32("output.kafka.published.metricdata")
@@ -34,40 +39,77 @@ var (
 	sendErrProducer = stats.NewCounterRate32("metrics.send_error.producer")
 	sendErrOther    = stats.NewCounterRate32("metrics.send_error.other")
 
+	keyCacheHits     = stats.NewCounterRate32("output.kafka.keycache.hits")
+	keyCacheMisses   = stats.NewCounterRate32("output.kafka.keycache.misses")
+	keyCacheSize     = stats.NewGauge32("output.kafka.keycache.size")
+	keyCacheHitRatio = stats.NewGauge32("output.kafka.keycache.hit_ratio_percent")
+
+	// hits and misses since the last stats update, to compute the hit ratio
+	recentHits   uint32
+	recentMisses uint32
+
+	activeSeries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "active_series",
+		Help:      "Number of series published per org within the keycache clear interval.",
+	}, []string{"org"})
+
 	topic           string
 	codec           string
 	enabled         bool
 	partitionScheme string
+	partitionHash   string
+	partitionPins   string
 	maxMessages     int
 	v2              bool
 	v2Org           bool
 	v2ClearInterval time.Duration
 	flushFreq       time.Duration
+	aggregation     string
+	aggregationWait time.Duration
+
+	intervalDetection      bool
+	intervalSettlePoints   int
+	intervalMaxSeries      int
+	keyCacheSnapshot       string
+	keyCacheSnapshotMaxAge time.Duration
 
 	bufferPool   = util.NewBufferPool()
 	bufferPool33 = util.NewBufferPool33()
 )
 
 type mtPublisher struct {
-	schemas      *conf.Schemas
+	schemas      *schemasHolder
 	autoInterval bool
-}
+	aggregator   *aggregator
+	detector     *intervalDetector
 
-type Partitioner interface {
-	partition(schema.PartitionedMetric) (int32, []byte, error)
+	// closed is set once the producer is closed, after which
+	// publishing fails rather than sending on the closed producer
+	closeMu sync.RWMutex
+	closed  bool
 }
 
 func init() {
 	flag.StringVar(&topic, "metrics-topic", "mdm", "topic for metrics")
 	flag.StringVar(&codec, "metrics-kafka-comp", "snappy", "compression: none|gzip|snappy")
 	flag.BoolVar(&enabled, "metrics-publish", false, "enable metric publishing")
-	flag.StringVar(&partitionScheme, "metrics-partition-scheme", "bySeries", "method used for paritioning metrics. (byOrg|bySeries)")
+	flag.StringVar(&partitionScheme, "metrics-partition-scheme", "bySeries", "method used for paritioning metrics. (byOrg|bySeries|bySeriesWithTags)")
+	flag.StringVar(&partitionHash, "metrics-partition-hash", "fnv", "hash used to map partition keys to partitions. jump moves fewer series when partitions are added. (fnv|jump)")
+	flag.StringVar(&partitionPins, "metrics-partition-pin", "", "comma separated list of orgId:partition pairs. all metrics of a pinned org are sent to its partition")
 	flag.DurationVar(&flushFreq, "metrics-flush-freq", time.Millisecond*50, "The best-effort frequency of flushes to kafka")
 	flag.IntVar(&maxMessages, "metrics-max-messages", 5000, "The maximum number of messages the producer will send in a single request")
 	flag.StringVar(&schemasConf, "schemas-file", "/etc/gw/storage-schemas.conf", "path to carbon storage-schemas.conf file")
 	flag.BoolVar(&v2, "v2", true, "enable optimized MetricPoint payload")
 	flag.BoolVar(&v2Org, "v2-org", true, "encode org-id in messages")
-	flag.DurationVar(&v2ClearInterval, "v2-clear-interval", time.Hour, "interval after which we always resend a full MetricData")
+	flag.DurationVar(&v2ClearInterval, "v2-clear-interval", time.Hour, "interval after which we always resend a full MetricData. series not seen within this interval are no longer active")
+	flag.StringVar(&aggregation, "metrics-aggregation", "", "aggregate the points of each series into one point per schema interval before publishing. (last|avg|sum|max, empty disables aggregation)")
+	flag.DurationVar(&aggregationWait, "metrics-aggregation-wait", 5*time.Second, "time to wait after the end of an interval for late points before publishing the aggregated point. points arriving later are published without aggregation")
+	flag.BoolVar(&intervalDetection, "metrics-interval-detection", false, "detect the interval of series without one from the timestamps of their points, instead of using the schemas")
+	flag.IntVar(&intervalSettlePoints, "metrics-interval-detection-points", 3, "number of points with a consistent interval after which the interval of a series is detected. the schemas are used until then")
+	flag.IntVar(&intervalMaxSeries, "metrics-interval-detection-max-series", 1000000, "max number of series to track for interval detection")
+	flag.StringVar(&keyCacheSnapshot, "v2-keycache-snapshot-file", "", "file the key cache is saved to on shutdown and loaded from on startup, so MetricPoint messages can be sent right after a restart. (empty disables snapshots)")
+	flag.DurationVar(&keyCacheSnapshotMaxAge, "v2-keycache-snapshot-max-age", 10*time.Minute, "max age of a key cache snapshot to be loaded on startup. should be well below v2-clear-interval")
 	flag.StringVar(&kafkaVersionStr, "kafka-version", "0.10.0.0", "Kafka version in semver format. All brokers must be this version or newer.")
 }
 
@@ -99,15 +141,16 @@ func New(broker string, autoInterval bool) *mtPublisher {
 		autoInterval: autoInterval,
 	}
 
-	if autoInterval {
-		schemas, err := getSchemas(schemasConf)
+	if autoInterval || aggregation != "" {
+		schemas, err := newSchemasHolder(schemasConf)
 		if err != nil {
 			log.Fatalf("failed to load schemas config. %s", err)
 		}
 		mp.schemas = schemas
+		util.WatchFile("schemas", schemasConf, schemas.Load)
 	}
 
-	partitioner, err = p.NewKafka(partitionScheme)
+	partitioner, err = NewPartitioner(partitionScheme, partitionHash, partitionPins)
 	if err != nil {
 		log.Fatalf("failed to initialize partitioner: %s", err)
 	}
@@ -120,6 +163,7 @@ func New(broker string, autoInterval bool) *mtPublisher {
 	config.Producer.Retry.Max = 10                   // Retry up to 10 times to produce the message
 	config.Producer.Compression = getCompression(codec)
 	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = func(string) sarama.Partitioner { return partitioner }
 	config.Producer.Flush.Frequency = flushFreq
 	config.Producer.Flush.MaxMessages = maxMessages
 	config.Version = kafkaVersion
@@ -130,14 +174,33 @@ func New(broker string, autoInterval bool) *mtPublisher {
 
 	brokers = []string{broker}
 
-	producer, err = sarama.NewSyncProducer(brokers, config)
+	client, err = sarama.NewClient(brokers, config)
+	if err != nil {
+		log.Fatalf("failed to initialize kafka client. %s", err)
+	}
+	producer, err = sarama.NewSyncProducerFromClient(client)
 	if err != nil {
 		log.Fatalf("failed to initialize kafka producer. %s", err)
 	}
 
-	if v2 {
-		keyCache = keycache.NewKeyCache(v2ClearInterval)
+	if intervalDetection {
+		mp.detector = newIntervalDetector(intervalSettlePoints, intervalMaxSeries)
+	}
+
+	if aggregation != "" {
+		if err := validAggregation(aggregation); err != nil {
+			log.Fatalf("invalid metrics-aggregation. %s", err)
+		}
+		mp.aggregator = newAggregator(aggregation, aggregationWait, mp.schemas, mp.publish)
+		go mp.aggregator.run(time.Second)
+	}
+
+	// the keycache is also used to track and limit the active series of each org
+	keyCache = keycache.NewKeyCache(v2ClearInterval)
+	if v2 && keyCacheSnapshot != "" {
+		loadKeyCache()
 	}
+	go updateKeyCacheStats()
 
 	return &mp
 }
@@ -152,36 +215,88 @@ func (m *mtPublisher) Publish(metrics []*schema.MetricData) error {
 		return nil
 	}
 
+	if m.aggregator != nil {
+		if err := m.setIntervals(metrics); err != nil {
+			return err
+		}
+		late, err := m.aggregator.Add(metrics)
+		if err != nil {
+			return err
+		}
+		return m.publish(late)
+	}
+	return m.publish(metrics)
+}
+
+// setIntervals sets the interval of metrics without one, using the detected
+// interval of the series if available, and the schemas otherwise. When
+// aggregating, the schema interval is used, as it is the interval of the
+// aggregated points.
+func (m *mtPublisher) setIntervals(metrics []*schema.MetricData) error {
+	for _, metric := range metrics {
+		if metric.Interval != 0 {
+			continue
+		}
+		if !m.autoInterval {
+			log.Error("interval is 0 but can't deduce interval automatically. this should never happen")
+			return errors.New("need to deduce interval but cannot")
+		}
+		if m.detector != nil && m.aggregator == nil {
+			if interval, ok := m.detector.Observe(metric); ok {
+				metric.Interval = interval
+				metric.SetId()
+				continue
+			}
+		}
+		_, s := m.schemas.Get().Match(metric.Name, 0)
+		metric.Interval = s.Retentions[0].SecondsPerPoint
+		metric.SetId()
+	}
+	return nil
+}
+
+func (m *mtPublisher) publish(metrics []*schema.MetricData) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if err := m.setIntervals(metrics); err != nil {
+		return err
+	}
+
 	var err error
 
-	payload := make([]*sarama.ProducerMessage, len(metrics))
+	payload := make([]*sarama.ProducerMessage, 0, len(metrics))
 	pre := time.Now()
 	pubMD := 0
 	pubMP := 0
 	pubMPNO := 0
+	var seriesLimited map[int]int
 
-	for i, metric := range metrics {
-		if metric.Interval == 0 {
-			if m.autoInterval {
-				_, s := m.schemas.Match(metric.Name, 0)
-				metric.Interval = s.Retentions[0].SecondsPerPoint
-				metric.SetId()
-			} else {
-				log.Error("interval is 0 but can't deduce interval automatically. this should never happen")
-				return errors.New("need to deduce interval but cannot")
-			}
-		}
-
+	for _, metric := range metrics {
 		var data []byte
-		if v2 {
+		seen := false
+		if keyCache != nil {
 			var mkey schema.MKey
 			mkey, err = schema.MKeyFromString(metric.Id)
 			if err != nil {
 				return err
 			}
-			ok := keyCache.Touch(mkey)
+			var accepted bool
+			seen, accepted = keyCache.TouchLimited(mkey, limits.MaxSeries(metric.OrgId))
+			if seen {
+				atomic.AddUint32(&recentHits, 1)
+			} else {
+				atomic.AddUint32(&recentMisses, 1)
+			}
+			if !accepted {
+				if seriesLimited == nil {
+					seriesLimited = make(map[int]int)
+				}
+				seriesLimited[metric.OrgId]++
+				continue
+			}
 			// we've seen this key recently. we can use the optimized format
-			if ok {
+			if v2 && seen {
 				data = bufferPool33.Get()
 				mp := schema.MetricPoint{
 					MKey:  mkey,
@@ -199,15 +314,9 @@ func (m *mtPublisher) Publish(metrics []*schema.MetricData) error {
 					_, err = mp.MarshalWithoutOrg28(data[:1])       // Marshal will fill up space between length and cap, i.e. bytes 2-29
 					pubMPNO++
 				}
-			} else {
-				data = bufferPool.Get()
-				data, err = metric.MarshalMsg(data)
-				if err != nil {
-					return err
-				}
-				pubMD++
 			}
-		} else {
+		}
+		if data == nil {
 			data = bufferPool.Get()
 			data, err = metric.MarshalMsg(data)
 			if err != nil {
@@ -216,19 +325,19 @@ func (m *mtPublisher) Publish(metrics []*schema.MetricData) error {
 			pubMD++
 		}
 
-		key, err := partitioner.GetPartitionKey(metric, nil)
-		if err != nil {
-			return err
-		}
-		payload[i] = &sarama.ProducerMessage{
-			Key:   sarama.ByteEncoder(key),
-			Topic: topic,
-			Value: sarama.ByteEncoder(data),
-		}
+		payload = append(payload, partitioner.Message(metric, data))
 
 		messagesSize.Value(len(data))
 	}
 
+	for org, cnt := range seriesLimited {
+		limits.DiscardedSamples.WithLabelValues("series_limit", util.OrgLabel(org)).Add(float64(cnt))
+		log.Debugf("org %d: dropped %d samples of new series exceeding the max series limit", org, cnt)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
 	defer func() {
 		var buf []byte
 		for _, msg := range payload {
@@ -241,7 +350,13 @@ func (m *mtPublisher) Publish(metrics []*schema.MetricData) error {
 		}
 	}()
 
+	m.closeMu.RLock()
+	if m.closed {
+		m.closeMu.RUnlock()
+		return errors.New("kafka publisher is stopped")
+	}
 	err = producer.SendMessages(payload)
+	m.closeMu.RUnlock()
 	if err != nil {
 		if errors, ok := err.(sarama.ProducerErrors); ok {
 			sendErrProducer.Add(len(errors))
@@ -263,6 +378,74 @@ func (m *mtPublisher) Publish(metrics []*schema.MetricData) error {
 	return nil
 }
 
+// updateKeyCacheStats periodically exports the number of active series of
+// each org and the size and hit ratio of the key cache
+func updateKeyCacheStats() {
+	ticker := time.NewTicker(10 * time.Second)
+	for range ticker.C {
+		activeSeries.Reset()
+		size := 0
+		for org, n := range keyCache.OrgLens() {
+			activeSeries.WithLabelValues(strconv.Itoa(int(org))).Set(float64(n))
+			size += n
+		}
+		keyCacheSize.Set(size)
+
+		hits := atomic.SwapUint32(&recentHits, 0)
+		misses := atomic.SwapUint32(&recentMisses, 0)
+		keyCacheHits.Add(int(hits))
+		keyCacheMisses.Add(int(misses))
+		if hits+misses > 0 {
+			keyCacheHitRatio.Set(int(uint64(hits) * 100 / uint64(hits+misses)))
+		}
+	}
+}
+
+// loadKeyCache pre-warms the key cache from the snapshot file
+func loadKeyCache() {
+	n, err := keyCache.LoadFile(keyCacheSnapshot, keyCacheSnapshotMaxAge)
+	switch {
+	case os.IsNotExist(err):
+		log.Infof("no keycache snapshot found at %s", keyCacheSnapshot)
+	case err == keycache.ErrSnapshotTooOld:
+		log.Infof("ignoring keycache snapshot %s as it is older than %s", keyCacheSnapshot, keyCacheSnapshotMaxAge)
+	case err != nil:
+		log.Errorf("failed to load keycache snapshot %s: %s", keyCacheSnapshot, err)
+	default:
+		log.Infof("loaded %d keys from keycache snapshot %s", n, keyCacheSnapshot)
+	}
+}
+
+// Stop publishes any buffered aggregated points, saves the key cache
+// snapshot and closes the producer.
+func (m *mtPublisher) Stop() {
+	if producer == nil {
+		return
+	}
+	if m.aggregator != nil {
+		m.aggregator.stop()
+		if err := m.aggregator.emit(m.aggregator.flush(time.Now(), true)); err != nil {
+			log.Errorf("failed to publish aggregated metrics on shutdown: %s", err)
+		}
+	}
+	if v2 && keyCacheSnapshot != "" {
+		n, err := keyCache.SaveFile(keyCacheSnapshot)
+		if err != nil {
+			log.Errorf("failed to save keycache snapshot %s: %s", keyCacheSnapshot, err)
+		} else {
+			log.Infof("saved %d keys to keycache snapshot %s", n, keyCacheSnapshot)
+		}
+	}
+	m.closeMu.Lock()
+	m.closed = true
+	m.closeMu.Unlock()
+	if err := producer.Close(); err != nil {
+		log.Errorf("failed to close kafka producer: %s", err)
+	}
+	client.Close()
+	log.Info("kafka publisher stopped")
+}
+
 func (*mtPublisher) Type() string {
 	return "Metrictank"
 }
@@ -1,6 +1,8 @@
 package kafka
 
 import (
+	"sync/atomic"
+
 	"github.com/grafana/metrictank/conf"
 )
 
@@ -11,3 +13,30 @@ func getSchemas(file string) (*conf.Schemas, error) {
 	}
 	return &schemas, nil
 }
+
+// schemasHolder holds the current schemas, which are swapped when the
+// schemas file is reloaded
+type schemasHolder struct {
+	file    string
+	current atomic.Value
+}
+
+func newSchemasHolder(file string) (*schemasHolder, error) {
+	h := &schemasHolder{file: file}
+	return h, h.Load()
+}
+
+// Load reads the schemas file, replacing the current schemas if it is valid.
+func (h *schemasHolder) Load() error {
+	schemas, err := getSchemas(h.file)
+	if err != nil {
+		return err
+	}
+	h.current.Store(schemas)
+	return nil
+}
+
+// Get returns the current schemas
+func (h *schemasHolder) Get() *conf.Schemas {
+	return h.current.Load().(*conf.Schemas)
+}
@@ -0,0 +1,150 @@
+package limits
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/raintank/tsdb-gw/util"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ini.v1"
+)
+
+/*
+The limits overrides file is an ini file containing a section for each org
+whose limits differ from the defaults. Settings not defined for an org use
+the default. A rate or max_series of 0 disables that limit for the org.
+
+example:
+------------------
+[10]
+rate = 50000
+burst = 100000
+max_series = 500000
+
+[23]
+rate = 0
+-------------------
+*/
+
+var (
+	overridesFile    string
+	defaultMaxSeries int
+
+	// DiscardedSamples counts the samples rejected by the limits, by reason and
+	// org. The org label is only set if metrics-org-label is enabled, use
+	// util.OrgLabel for its value.
+	DiscardedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "limited_samples_total",
+		Help:      "The total number of samples that were discarded because they exceeded a limit. The org label is only set if metrics-org-label is enabled.",
+	}, []string{"reason", "org"})
+
+	overridesMu sync.RWMutex
+	overrides   map[int]Overrides
+)
+
+func init() {
+	flag.StringVar(&overridesFile, "limits-overrides-file", "", "path to ini file containing per org limit overrides")
+	flag.IntVar(&defaultMaxSeries, "max-series-per-org", 0, "default max number of active series per org. samples of new series beyond the limit are rejected by the kafka publisher. (0 disables the limit)")
+}
+
+// Overrides holds the limits of an org which differ from the defaults.
+type Overrides struct {
+	Rate      *float64
+	Burst     *int
+	MaxSeries *int
+}
+
+// Init loads the overrides file, if configured, and initializes the limiters.
+func Init() error {
+	if overridesFile != "" {
+		if err := reloadOverrides(); err != nil {
+			return err
+		}
+	}
+
+	overridesMu.RLock()
+	initRateLimiter(overrides)
+	overridesMu.RUnlock()
+
+	if overridesFile != "" {
+		util.WatchFile("limits", overridesFile, reloadOverrides)
+	}
+	return nil
+}
+
+// MaxSeries returns the max number of active series for the org, 0 means no limit.
+func MaxSeries(org int) int {
+	overridesMu.RLock()
+	o, ok := overrides[org]
+	overridesMu.RUnlock()
+	if ok && o.MaxSeries != nil {
+		return *o.MaxSeries
+	}
+	return defaultMaxSeries
+}
+
+func setOverrides(o map[int]Overrides) {
+	overridesMu.Lock()
+	overrides = o
+	overridesMu.Unlock()
+	if rateLimiter != nil {
+		rateLimiter.SetOverrides(rateLimits(o))
+	}
+}
+
+func reloadOverrides() error {
+	o, err := loadOverrides(overridesFile)
+	if err != nil {
+		return err
+	}
+	setOverrides(o)
+	log.Infof("loaded limits overrides for %d orgs", len(o))
+	return nil
+}
+
+func loadOverrides(file string) (map[int]Overrides, error) {
+	conf, err := ini.Load(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not load limits overrides file: %v", err)
+	}
+
+	o := make(map[int]Overrides)
+	for _, section := range conf.Sections() {
+		if section.Name() == "" || section.Name() == "DEFAULT" {
+			continue
+		}
+		org, err := strconv.Atoi(section.Name())
+		if err != nil {
+			return nil, fmt.Errorf("limits override section %q is not an orgId", section.Name())
+		}
+		var ov Overrides
+		if section.HasKey("rate") {
+			rate, err := section.Key("rate").Float64()
+			if err != nil {
+				return nil, fmt.Errorf("org %d: invalid rate: %v", org, err)
+			}
+			ov.Rate = &rate
+		}
+		if section.HasKey("burst") {
+			burst, err := section.Key("burst").Int()
+			if err != nil {
+				return nil, fmt.Errorf("org %d: invalid burst: %v", org, err)
+			}
+			ov.Burst = &burst
+		}
+		if section.HasKey("max_series") {
+			maxSeries, err := section.Key("max_series").Int()
+			if err != nil {
+				return nil, fmt.Errorf("org %d: invalid max_series: %v", org, err)
+			}
+			ov.MaxSeries = &maxSeries
+		}
+		o[org] = ov
+	}
+	return o, nil
+}
@@ -0,0 +1,268 @@
+package limits
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	schema "github.com/raintank/schema"
+	"github.com/raintank/tsdb-gw/util"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	rateLimitEnabled bool
+	defaultRate      float64
+	defaultBurst     int
+	replicas         int
+
+	rateLimiter *RateLimiter
+)
+
+func init() {
+	flag.BoolVar(&rateLimitEnabled, "rate-limit-enabled", false, "enable per org ingestion rate limiting")
+	flag.Float64Var(&defaultRate, "rate-limit-rate", 100000, "default number of samples per second an org may publish")
+	flag.IntVar(&defaultBurst, "rate-limit-burst", 200000, "default number of samples an org may publish in a single burst")
+	flag.IntVar(&replicas, "rate-limit-replicas", 1, "number of gateways sharing the configured rate limits. each gateway enforces its share of the limit")
+}
+
+// RateLimitedError is returned when samples were rejected by the rate limiter.
+type RateLimitedError struct {
+	Rejected   int
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("ingestion rate limit exceeded, %d samples rejected", e.Rejected)
+}
+
+// Limit is the rate at which an org may publish samples.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// bucket is a token bucket. Tokens may go negative, so that a batch larger
+// than the burst is accepted once the bucket is full, and paid back before
+// any further samples are accepted.
+type bucket struct {
+	sync.Mutex
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(n int, now time.Time) (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.limit.Rate <= 0 {
+		return true, 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+
+	need := float64(n)
+	if need > float64(b.limit.Burst) {
+		need = float64(b.limit.Burst)
+	}
+	if b.tokens < need {
+		wait := time.Duration((need - b.tokens) / b.limit.Rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens -= float64(n)
+	return true, 0
+}
+
+// refund returns n tokens to the bucket, up to its burst.
+func (b *bucket) refund(n int) {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+}
+
+// RateLimiter enforces per org token bucket limits on the number of samples published.
+type RateLimiter struct {
+	sync.RWMutex
+	defaults  Limit
+	overrides map[int]Limit
+	buckets   map[int]*bucket
+}
+
+// NewRateLimiter creates a RateLimiter using defaults for orgs without an override.
+func NewRateLimiter(defaults Limit, overrides map[int]Limit) *RateLimiter {
+	if overrides == nil {
+		overrides = make(map[int]Limit)
+	}
+	return &RateLimiter{
+		defaults:  defaults,
+		overrides: overrides,
+		buckets:   make(map[int]*bucket),
+	}
+}
+
+func (r *RateLimiter) limit(org int) Limit {
+	if l, ok := r.overrides[org]; ok {
+		return l
+	}
+	return r.defaults
+}
+
+// Allow takes n tokens from the org's bucket. If there are not enough tokens
+// it returns false and the time after which the request may succeed.
+func (r *RateLimiter) Allow(org, n int, now time.Time) (bool, time.Duration) {
+	r.RLock()
+	b, ok := r.buckets[org]
+	r.RUnlock()
+	if !ok {
+		r.Lock()
+		b, ok = r.buckets[org]
+		if !ok {
+			l := r.limit(org)
+			b = &bucket{limit: l, tokens: float64(l.Burst), last: now}
+			r.buckets[org] = b
+		}
+		r.Unlock()
+	}
+	return b.take(n, now)
+}
+
+// Refund returns n tokens taken by Allow to the org's bucket, for samples
+// which were not published after all.
+func (r *RateLimiter) Refund(org, n int) {
+	r.RLock()
+	b, ok := r.buckets[org]
+	r.RUnlock()
+	if ok {
+		b.refund(n)
+	}
+}
+
+// SetOverrides replaces the per org overrides, updating existing buckets.
+func (r *RateLimiter) SetOverrides(overrides map[int]Limit) {
+	r.Lock()
+	r.overrides = overrides
+	for org, b := range r.buckets {
+		l := r.limit(org)
+		b.Lock()
+		b.limit = l
+		b.Unlock()
+	}
+	r.Unlock()
+}
+
+// initRateLimiter creates the rate limiter if rate limiting is enabled.
+func initRateLimiter(o map[int]Overrides) {
+	if !rateLimitEnabled {
+		return
+	}
+	if replicas < 1 {
+		replicas = 1
+	}
+	rateLimiter = NewRateLimiter(share(Limit{Rate: defaultRate, Burst: defaultBurst}), rateLimits(o))
+	log.Infof("rate limiting enabled. default rate=%v burst=%d", defaultRate, defaultBurst)
+}
+
+// rateLimits returns the rate limits of the orgs which override them.
+func rateLimits(o map[int]Overrides) map[int]Limit {
+	limits := make(map[int]Limit)
+	for org, ov := range o {
+		if ov.Rate == nil && ov.Burst == nil {
+			continue
+		}
+		l := Limit{Rate: defaultRate, Burst: defaultBurst}
+		if ov.Rate != nil {
+			l.Rate = *ov.Rate
+		}
+		if ov.Burst != nil {
+			l.Burst = *ov.Burst
+		}
+		limits[org] = share(l)
+	}
+	return limits
+}
+
+// share returns the part of the limit to be enforced by this gateway.
+func share(l Limit) Limit {
+	burst := l.Burst / replicas
+	if burst < 1 {
+		burst = 1
+	}
+	return Limit{
+		Rate:  l.Rate / float64(replicas),
+		Burst: burst,
+	}
+}
+
+// ApplyRateLimit removes the samples of orgs exceeding their rate limit from
+// metrics. If any samples were removed a *RateLimitedError is returned along
+// with the remaining metrics. The passed slice is not modified.
+func ApplyRateLimit(metrics []*schema.MetricData) ([]*schema.MetricData, error) {
+	if rateLimiter == nil || len(metrics) == 0 {
+		return metrics, nil
+	}
+
+	orgCounts := make(map[int]int)
+	for _, m := range metrics {
+		orgCounts[m.OrgId]++
+	}
+
+	now := time.Now()
+	var limited map[int]struct{}
+	var retryAfter time.Duration
+	for org, count := range orgCounts {
+		ok, wait := rateLimiter.Allow(org, count, now)
+		if ok {
+			continue
+		}
+		if limited == nil {
+			limited = make(map[int]struct{})
+		}
+		limited[org] = struct{}{}
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+		DiscardedSamples.WithLabelValues("rate_limited", util.OrgLabel(org)).Add(float64(count))
+	}
+	if len(limited) == 0 {
+		return metrics, nil
+	}
+
+	out := make([]*schema.MetricData, 0, len(metrics))
+	rejected := 0
+	for _, m := range metrics {
+		if _, ok := limited[m.OrgId]; ok {
+			rejected++
+			continue
+		}
+		out = append(out, m)
+	}
+	return out, &RateLimitedError{
+		Rejected:   rejected,
+		RetryAfter: retryAfter,
+	}
+}
+
+// RefundRateLimit returns the tokens taken by ApplyRateLimit for metrics
+// which failed to publish, so orgs are not charged again when the publish
+// is retried.
+func RefundRateLimit(metrics []*schema.MetricData) {
+	if rateLimiter == nil {
+		return
+	}
+	orgCounts := make(map[int]int)
+	for _, m := range metrics {
+		orgCounts[m.OrgId]++
+	}
+	for org, count := range orgCounts {
+		rateLimiter.Refund(org, count)
+	}
+}
@@ -0,0 +1,66 @@
+package limits
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	r := NewRateLimiter(Limit{Rate: 10, Burst: 20}, map[int]Limit{
+		2: {Rate: 0, Burst: 0},
+	})
+
+	tests := []struct {
+		name      string
+		org       int
+		n         int
+		now       time.Time
+		wantOK    bool
+		wantRetry time.Duration
+	}{
+		{name: "within burst", org: 1, n: 15, now: start, wantOK: true},
+		{name: "exceeds remaining tokens", org: 1, n: 10, now: start, wantOK: false, wantRetry: 500 * time.Millisecond},
+		{name: "tokens refilled", org: 1, n: 10, now: start.Add(time.Second), wantOK: true},
+		{name: "other org has own bucket", org: 3, n: 20, now: start, wantOK: true},
+		{name: "batch larger than burst accepted when full", org: 4, n: 50, now: start, wantOK: true},
+		{name: "oversized batch is paid back", org: 4, n: 1, now: start.Add(time.Second), wantOK: false, wantRetry: 2100 * time.Millisecond},
+		{name: "unlimited override", org: 2, n: 1000000, now: start, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, retry := r.Allow(tt.org, tt.n, tt.now)
+			if ok != tt.wantOK {
+				t.Fatalf("Allow() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if retry != tt.wantRetry {
+				t.Errorf("Allow() retry = %v, want %v", retry, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	start := time.Unix(1000, 0)
+	r := NewRateLimiter(Limit{Rate: 10, Burst: 20}, nil)
+
+	if ok, _ := r.Allow(1, 15, start); !ok {
+		t.Fatal("Allow() within burst failed")
+	}
+	// the publish failed, so the retry must not be charged twice
+	r.Refund(1, 15)
+	if ok, _ := r.Allow(1, 15, start); !ok {
+		t.Error("Allow() of retried samples failed after refund")
+	}
+	// refunds do not exceed the burst
+	r.Refund(1, 100)
+	if ok, _ := r.Allow(1, 20, start); !ok {
+		t.Error("Allow() of the burst failed after refund")
+	}
+	if ok, _ := r.Allow(1, 1, start); ok {
+		t.Error("Allow() exceeding the burst succeeded after refund")
+	}
+	// orgs without a bucket are ignored
+	r.Refund(2, 10)
+}
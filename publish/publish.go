@@ -7,6 +7,10 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	schema "github.com/raintank/schema"
 	"github.com/raintank/tsdb-gw/metrics_client"
+	"github.com/raintank/tsdb-gw/publish/limits"
+	"github.com/raintank/tsdb-gw/publish/relabel"
+	"github.com/raintank/tsdb-gw/publish/rollup"
+	"github.com/raintank/tsdb-gw/publish/validate"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -37,13 +41,46 @@ func Init(p Publisher) {
 		publisher = p
 	}
 	log.Infof("using %s publisher", publisher.Type())
+
+	if err := validate.Init(); err != nil {
+		log.Fatalf("failed to initialize validation: %s", err)
+	}
+	if err := relabel.Init(); err != nil {
+		log.Fatalf("failed to initialize relabeling: %s", err)
+	}
+	if err := limits.Init(); err != nil {
+		log.Fatalf("failed to initialize limits: %s", err)
+	}
+	if err := rollup.Init(publish); err != nil {
+		log.Fatalf("failed to initialize rollup rules: %s", err)
+	}
 }
 
+// Publish publishes the metrics. Metrics with an out of range timestamp are
+// discarded or adjusted according to the validation settings. If some orgs
+// exceeded their rate limit, the metrics of the other orgs are still
+// published and a *limits.RateLimitedError is returned.
 func Publish(metrics []*schema.MetricData) error {
+	metrics = validate.Timestamps(metrics)
+	metrics = relabel.Apply(metrics)
+	metrics, limitErr := limits.ApplyRateLimit(metrics)
 	if len(metrics) == 0 {
-		return nil
+		return limitErr
+	}
+
+	if err := publish(metrics); err != nil {
+		// the metrics are retried by the caller, and charged again then
+		limits.RefundRateLimit(metrics)
+		return err
 	}
+	// only published metrics are rolled up, as failed publishes are retried
+	rollup.Observe(metrics)
+	return limitErr
+}
 
+// publish sends the metrics to the publisher, without applying the ingest
+// pipeline. It is used directly for the series produced by rollup rules.
+func publish(metrics []*schema.MetricData) error {
 	if err := publisher.Publish(metrics); err != nil {
 		return err
 	}
@@ -58,6 +95,17 @@ func Publish(metrics []*schema.MetricData) error {
 	return nil
 }
 
+// Stop publishes the pending rollup series, then stops the publisher if it
+// needs stopping. It must be called after all inputs are stopped.
+func Stop() {
+	rollup.Stop(publish)
+	if s, ok := publisher.(interface {
+		Stop()
+	}); ok {
+		s.Stop()
+	}
+}
+
 // nullPublisher drops all metrics passed through the publish interface
 type nullPublisher struct{}
 
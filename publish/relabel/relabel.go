@@ -0,0 +1,335 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	schema "github.com/raintank/schema"
+	"github.com/raintank/tsdb-gw/util"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ini.v1"
+)
+
+/*
+Reads an ini file containing a section for each relabel rule. Rules follow the
+semantics of prometheus' relabel_configs and are applied in the order they
+are defined, to the tags of a metric plus its name as the __name__ label.
+Rules without an orgId apply to all orgs, rules with an orgId only to that
+org. Global rules are applied before org specific rules.
+
+actions: replace (default), keep, drop, hashmod, labelmap, labeldrop, labelkeep
+
+example:
+------------------
+[drop-dd-system]
+action = drop
+source_labels = __name__
+regex = system\..*
+
+[add-cluster]
+orgId = 10
+target_label = cluster
+replacement = prod-eu
+-------------------
+*/
+
+var (
+	configFile string
+
+	droppedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "relabel_dropped_samples_total",
+		Help:      "Number of samples dropped by relabel rules. The org label is only set if metrics-org-label is enabled",
+	}, []string{"org"})
+
+	global []*Rule
+	byOrg  map[int][]*Rule
+)
+
+func init() {
+	flag.StringVar(&configFile, "relabel-config-file", "", "path to ini file containing relabel rules applied to all metrics before publishing")
+}
+
+const (
+	Replace   = "replace"
+	Keep      = "keep"
+	Drop      = "drop"
+	HashMod   = "hashmod"
+	LabelMap  = "labelmap"
+	LabelDrop = "labeldrop"
+	LabelKeep = "labelkeep"
+)
+
+// Rule is a single relabel rule.
+type Rule struct {
+	Name         string
+	OrgID        int
+	SourceLabels []string
+	Separator    string
+	Regex        *regexp.Regexp
+	Modulus      uint64
+	TargetLabel  string
+	Replacement  string
+	Action       string
+}
+
+// Init loads the relabel rules, if a relabel config file is configured.
+func Init() error {
+	if configFile == "" {
+		return nil
+	}
+	conf, err := ini.Load(configFile)
+	if err != nil {
+		return fmt.Errorf("could not load relabel config %s: %v", configFile, err)
+	}
+	rules, err := ParseRules(conf)
+	if err != nil {
+		return err
+	}
+	global, byOrg = splitRules(rules)
+	log.Infof("loaded %d relabel rules from %s", len(rules), configFile)
+	return nil
+}
+
+// ParseRules parses the rules defined in the sections of conf.
+func ParseRules(conf *ini.File) ([]*Rule, error) {
+	var rules []*Rule
+	for _, section := range conf.Sections() {
+		if section.Name() == "" || section.Name() == "DEFAULT" {
+			continue
+		}
+		rule, err := parseRule(section)
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %s: %v", section.Name(), err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRule(section *ini.Section) (*Rule, error) {
+	r := &Rule{
+		Name:        section.Name(),
+		OrgID:       section.Key("orgId").MustInt(0),
+		Separator:   section.Key("separator").MustString(";"),
+		TargetLabel: section.Key("target_label").String(),
+		Replacement: section.Key("replacement").MustString("$1"),
+		Action:      strings.ToLower(section.Key("action").MustString(Replace)),
+		Modulus:     section.Key("modulus").MustUint64(0),
+	}
+	if section.HasKey("source_labels") {
+		r.SourceLabels = section.Key("source_labels").Strings(",")
+	}
+
+	regex, err := regexp.Compile("^(?:" + section.Key("regex").MustString("(.*)") + ")$")
+	if err != nil {
+		return nil, err
+	}
+	r.Regex = regex
+
+	switch r.Action {
+	case Replace:
+		if r.TargetLabel == "" {
+			return nil, fmt.Errorf("target_label is required for action %s", r.Action)
+		}
+	case HashMod:
+		if r.TargetLabel == "" || r.Modulus == 0 {
+			return nil, fmt.Errorf("target_label and modulus are required for action %s", r.Action)
+		}
+	case Keep, Drop:
+		if len(r.SourceLabels) == 0 {
+			return nil, fmt.Errorf("source_labels are required for action %s", r.Action)
+		}
+	case LabelMap, LabelDrop, LabelKeep:
+	default:
+		return nil, fmt.Errorf("unknown action %q", r.Action)
+	}
+	return r, nil
+}
+
+func splitRules(rules []*Rule) ([]*Rule, map[int][]*Rule) {
+	var g []*Rule
+	o := make(map[int][]*Rule)
+	for _, r := range rules {
+		if r.OrgID == 0 {
+			g = append(g, r)
+		} else {
+			o[r.OrgID] = append(o[r.OrgID], r)
+		}
+	}
+	return g, o
+}
+
+// Apply runs the configured relabel rules over the metrics, returning the
+// metrics to publish. The passed slice and its metrics are not modified, the
+// returned metrics are copies, so metrics whose publishing is retried are not
+// relabeled twice.
+func Apply(metrics []*schema.MetricData) []*schema.MetricData {
+	if len(global) == 0 && len(byOrg) == 0 {
+		return metrics
+	}
+
+	out := make([]*schema.MetricData, 0, len(metrics))
+	dropped := make(map[int]int)
+	for _, m := range metrics {
+		c := *m
+		if !Process(&c, global, byOrg[m.OrgId]) {
+			dropped[m.OrgId]++
+			continue
+		}
+		out = append(out, &c)
+	}
+	for org, cnt := range dropped {
+		droppedSamples.WithLabelValues(util.OrgLabel(org)).Add(float64(cnt))
+	}
+	return out
+}
+
+// Process applies the given rule sets to the metric. It returns false if the
+// metric should be dropped. If the name or tags change, the id is updated.
+func Process(m *schema.MetricData, ruleSets ...[]*Rule) bool {
+	lbls := newLabels(m)
+	changed := false
+	for _, rules := range ruleSets {
+		for _, r := range rules {
+			keep, c := r.apply(lbls)
+			if !keep {
+				return false
+			}
+			changed = changed || c
+		}
+	}
+	if !changed {
+		return true
+	}
+
+	name := lbls.values["__name__"]
+	if name == "" {
+		// a metric can not exist without a name
+		return false
+	}
+	m.Name = name
+	m.Tags = lbls.tags()
+	m.SetId()
+	return true
+}
+
+// labels holds the tags of a metric as label name/value pairs.
+// tags without a value are passed through untouched.
+type labels struct {
+	values map[string]string
+	bare   []string
+}
+
+func newLabels(m *schema.MetricData) *labels {
+	l := &labels{
+		values: make(map[string]string, len(m.Tags)+1),
+	}
+	l.values["__name__"] = m.Name
+	for _, t := range m.Tags {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) < 2 {
+			l.bare = append(l.bare, t)
+			continue
+		}
+		l.values[kv[0]] = kv[1]
+	}
+	return l
+}
+
+func (l *labels) tags() []string {
+	tags := make([]string, 0, len(l.values)+len(l.bare))
+	for k, v := range l.values {
+		if k == "__name__" {
+			continue
+		}
+		tags = append(tags, k+"="+v)
+	}
+	return append(tags, l.bare...)
+}
+
+func (l *labels) set(name, value string) {
+	if value == "" {
+		delete(l.values, name)
+		return
+	}
+	l.values[name] = value
+}
+
+// apply runs the rule against the labels. It returns whether the metric
+// should be kept, and whether the labels were changed.
+func (r *Rule) apply(l *labels) (keep bool, changed bool) {
+	values := make([]string, 0, len(r.SourceLabels))
+	for _, name := range r.SourceLabels {
+		values = append(values, l.values[name])
+	}
+	val := strings.Join(values, r.Separator)
+
+	switch r.Action {
+	case Drop:
+		return !r.Regex.MatchString(val), false
+	case Keep:
+		return r.Regex.MatchString(val), false
+	case Replace:
+		indexes := r.Regex.FindStringSubmatchIndex(val)
+		if indexes == nil {
+			return true, false
+		}
+		target := string(r.Regex.ExpandString(nil, r.TargetLabel, val, indexes))
+		if !validLabelName(target) {
+			return true, false
+		}
+		res := string(r.Regex.ExpandString(nil, r.Replacement, val, indexes))
+		l.set(target, res)
+		return true, true
+	case HashMod:
+		sum := md5.Sum([]byte(val))
+		mod := binary.BigEndian.Uint64(sum[8:]) % r.Modulus
+		l.set(r.TargetLabel, strconv.FormatUint(mod, 10))
+		return true, true
+	case LabelMap:
+		mapped := make(map[string]string)
+		for name, value := range l.values {
+			if name == "__name__" || !r.Regex.MatchString(name) {
+				continue
+			}
+			mapped[r.Regex.ReplaceAllString(name, r.Replacement)] = value
+		}
+		for name, value := range mapped {
+			l.set(name, value)
+		}
+		return true, len(mapped) > 0
+	case LabelDrop, LabelKeep:
+		for name := range l.values {
+			if name == "__name__" {
+				continue
+			}
+			if r.Regex.MatchString(name) == (r.Action == LabelDrop) {
+				delete(l.values, name)
+				changed = true
+			}
+		}
+		return true, changed
+	}
+	return true, false
+}
+
+func validLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, b := range []byte(name) {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || b == '_' || (b >= '0' && b <= '9' && i > 0) {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package relabel
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	schema "github.com/raintank/schema"
+	"gopkg.in/ini.v1"
+)
+
+func parseTestRules(t *testing.T, conf string) []*Rule {
+	f, err := ini.Load([]byte(conf))
+	if err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+	rules, err := ParseRules(f)
+	if err != nil {
+		t.Fatalf("failed to parse rules: %v", err)
+	}
+	return rules
+}
+
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    string
+		metric   schema.MetricData
+		wantKeep bool
+		wantName string
+		wantTags []string
+	}{
+		{
+			name: "drop by name",
+			rules: `
+[drop]
+action = drop
+source_labels = __name__
+regex = system\..*
+`,
+			metric:   schema.MetricData{Name: "system.cpu.idle", Tags: []string{"host=a"}},
+			wantKeep: false,
+		},
+		{
+			name: "keep by tag",
+			rules: `
+[keep]
+action = keep
+source_labels = env
+regex = prod
+`,
+			metric:   schema.MetricData{Name: "requests", Tags: []string{"env=prod"}},
+			wantKeep: true,
+			wantName: "requests",
+			wantTags: []string{"env=prod"},
+		},
+		{
+			name: "keep drops non matching",
+			rules: `
+[keep]
+action = keep
+source_labels = env
+regex = prod
+`,
+			metric:   schema.MetricData{Name: "requests", Tags: []string{"env=dev"}},
+			wantKeep: false,
+		},
+		{
+			name: "add static tag",
+			rules: `
+[cluster]
+target_label = cluster
+replacement = prod-eu
+`,
+			metric:   schema.MetricData{Name: "requests", Tags: []string{"host=a"}},
+			wantKeep: true,
+			wantName: "requests",
+			wantTags: []string{"cluster=prod-eu", "host=a"},
+		},
+		{
+			name: "rename series",
+			rules: `
+[rename]
+source_labels = __name__
+regex = old\.(.*)
+target_label = __name__
+replacement = new.$1
+`,
+			metric:   schema.MetricData{Name: "old.requests"},
+			wantKeep: true,
+			wantName: "new.requests",
+			wantTags: []string{},
+		},
+		{
+			name: "labelmap and labeldrop",
+			rules: `
+[map]
+action = labelmap
+regex = dd_(.*)
+replacement = $1
+
+[drop]
+action = labeldrop
+regex = dd_.*
+`,
+			metric:   schema.MetricData{Name: "requests", Tags: []string{"dd_host=a", "env=prod", "standalone"}},
+			wantKeep: true,
+			wantName: "requests",
+			wantTags: []string{"env=prod", "host=a", "standalone"},
+		},
+		{
+			name: "hashmod",
+			rules: `
+[shard]
+action = hashmod
+source_labels = host
+modulus = 1
+target_label = shard
+`,
+			metric:   schema.MetricData{Name: "requests", Tags: []string{"host=a"}},
+			wantKeep: true,
+			wantName: "requests",
+			wantTags: []string{"host=a", "shard=0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.metric
+			keep := Process(&m, parseTestRules(t, tt.rules))
+			if keep != tt.wantKeep {
+				t.Fatalf("Process() keep = %v, want %v", keep, tt.wantKeep)
+			}
+			if !keep {
+				return
+			}
+			sort.Strings(m.Tags)
+			if m.Name != tt.wantName {
+				t.Errorf("Process() name = %v, want %v", m.Name, tt.wantName)
+			}
+			if !reflect.DeepEqual(m.Tags, tt.wantTags) {
+				t.Errorf("Process() tags = %v, want %v", m.Tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+func TestApplyDoesNotModifySharedTags(t *testing.T) {
+	global = parseTestRules(t, `
+[cluster]
+target_label = cluster
+replacement = prod-eu
+`)
+	defer func() { global = nil }()
+
+	tags := []string{"host=a"}
+	in := []*schema.MetricData{
+		{Name: "a", Tags: tags, OrgId: 1},
+		{Name: "b", Tags: tags, OrgId: 1},
+	}
+	out := Apply(in)
+	if len(out) != 2 {
+		t.Fatalf("Apply() returned %d metrics, want 2", len(out))
+	}
+	if !reflect.DeepEqual(tags, []string{"host=a"}) {
+		t.Errorf("Apply() modified shared tags: %v", tags)
+	}
+}
+
+func TestApplyDoesNotModifyMetrics(t *testing.T) {
+	global = parseTestRules(t, `
+[prefix]
+source_labels = __name__
+regex = (.*)
+target_label = __name__
+replacement = prod.$1
+`)
+	defer func() { global = nil }()
+
+	m := &schema.MetricData{Name: "requests", Tags: []string{"host=a"}, OrgId: 1, Interval: 10}
+	m.SetId()
+	id := m.Id
+	// a retried publish applies the rules to the same metrics again
+	for i := 0; i < 2; i++ {
+		out := Apply([]*schema.MetricData{m})
+		if len(out) != 1 || out[0].Name != "prod.requests" {
+			t.Fatalf("Apply() = %v, want prod.requests", out)
+		}
+	}
+	if m.Name != "requests" || m.Id != id {
+		t.Errorf("Apply() modified the metric: %s %s", m.Name, m.Id)
+	}
+}
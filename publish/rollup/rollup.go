@@ -0,0 +1,373 @@
+package rollup
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	schema "github.com/raintank/schema"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/ini.v1"
+)
+
+/*
+Reads an ini file containing a section for each rollup rule. Each rule
+aggregates the points of all series matching its pattern into a new series,
+emitting one point per interval. Points are assigned to intervals by their
+timestamp, and an interval is emitted once wait has passed after its end.
+Rules without an orgId apply to the metrics of every org, producing a rollup
+series per org.
+
+match_type: glob (default) or regex. globs match a single node per *.
+output: name of the rollup series. may reference the pattern's groups as $1.
+function: sum (default), avg, min, max, count or last
+interval: seconds per point of the rollup series (default 60)
+wait: seconds to wait for late points after the end of an interval (default: interval)
+
+example:
+------------------
+[cluster-requests]
+orgId = 1
+match = servers.*.requests
+output = cluster.requests
+function = sum
+interval = 60
+wait = 120
+
+[per-dc]
+match_type = regex
+match = ^servers\.(\w+)-\d+\.cpu$
+output = dc.$1.cpu
+function = avg
+-------------------
+*/
+
+var (
+	rulesFile string
+
+	matchedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "rollup_matched_samples_total",
+		Help:      "Number of samples matched by rollup rules.",
+	}, []string{"rule"})
+	emittedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "rollup_emitted_samples_total",
+		Help:      "Number of rollup samples emitted by rollup rules.",
+	}, []string{"rule"})
+	lateTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "rollup_late_samples_total",
+		Help:      "Number of samples matched by rollup rules after their interval was emitted.",
+	}, []string{"rule"})
+
+	global *Aggregator
+)
+
+func init() {
+	flag.StringVar(&rulesFile, "rollup-rules-file", "", "path to ini file containing rollup rules evaluated on incoming metrics")
+}
+
+// aggregation functions
+const (
+	Sum   = "sum"
+	Avg   = "avg"
+	Min   = "min"
+	Max   = "max"
+	Count = "count"
+	Last  = "last"
+)
+
+// Rule aggregates the series matching a pattern into a new series
+type Rule struct {
+	Name     string
+	OrgID    int
+	Match    *regexp.Regexp
+	Output   string
+	Function string
+	Interval int
+	Wait     time.Duration
+}
+
+// Init loads the rollup rules, if a rules file is configured, and starts
+// emitting the rollup series using publish.
+func Init(publish func([]*schema.MetricData) error) error {
+	if rulesFile == "" {
+		return nil
+	}
+	conf, err := ini.Load(rulesFile)
+	if err != nil {
+		return fmt.Errorf("could not load rollup rules %s: %v", rulesFile, err)
+	}
+	rules, err := ParseRules(conf)
+	if err != nil {
+		return err
+	}
+	global = NewAggregator(rules)
+	go global.run(time.Second, publish)
+	log.Infof("loaded %d rollup rules from %s", len(rules), rulesFile)
+	return nil
+}
+
+// ParseRules parses the rules defined in the sections of conf.
+func ParseRules(conf *ini.File) ([]*Rule, error) {
+	var rules []*Rule
+	for _, section := range conf.Sections() {
+		if section.Name() == "" || section.Name() == "DEFAULT" {
+			continue
+		}
+		rule, err := parseRule(section)
+		if err != nil {
+			return nil, fmt.Errorf("rollup rule %s: %v", section.Name(), err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseRule(section *ini.Section) (*Rule, error) {
+	r := &Rule{
+		Name:     section.Name(),
+		OrgID:    section.Key("orgId").MustInt(0),
+		Output:   section.Key("output").String(),
+		Function: strings.ToLower(section.Key("function").MustString(Sum)),
+		Interval: section.Key("interval").MustInt(60),
+	}
+	r.Wait = time.Duration(section.Key("wait").MustInt(r.Interval)) * time.Second
+
+	match := section.Key("match").String()
+	if match == "" || r.Output == "" {
+		return nil, fmt.Errorf("match and output are required")
+	}
+	if r.Interval <= 0 || r.Wait < 0 {
+		return nil, fmt.Errorf("interval must be positive and wait must not be negative")
+	}
+
+	var err error
+	switch section.Key("match_type").MustString("glob") {
+	case "glob":
+		r.Match, err = regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(match), `\*`, `([^.]+)`, -1) + "$")
+	case "regex":
+		r.Match, err = regexp.Compile(match)
+	default:
+		return nil, fmt.Errorf("unknown match_type %q", section.Key("match_type").String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Function {
+	case Sum, Avg, Min, Max, Count, Last:
+	default:
+		return nil, fmt.Errorf("unknown function %q", r.Function)
+	}
+	return r, nil
+}
+
+// output returns the name of the rollup series the metric is aggregated
+// into, or false if the metric does not match the rule.
+func (r *Rule) output(m *schema.MetricData) (string, bool) {
+	if r.OrgID != 0 && r.OrgID != m.OrgId {
+		return "", false
+	}
+	submatches := r.Match.FindStringSubmatchIndex(m.Name)
+	if submatches == nil {
+		return "", false
+	}
+	return string(r.Match.ExpandString(nil, r.Output, m.Name, submatches)), true
+}
+
+type bucketKey struct {
+	rule   *Rule
+	org    int
+	output string
+	ts     int64
+}
+
+type bucket struct {
+	sum   float64
+	min   float64
+	max   float64
+	count int
+	last  float64
+	lastT int64
+}
+
+func (b *bucket) add(value float64, ts int64) {
+	if b.count == 0 || value < b.min {
+		b.min = value
+	}
+	if b.count == 0 || value > b.max {
+		b.max = value
+	}
+	if b.count == 0 || ts >= b.lastT {
+		b.last = value
+		b.lastT = ts
+	}
+	b.sum += value
+	b.count++
+}
+
+func (b *bucket) value(fn string) float64 {
+	switch fn {
+	case Avg:
+		return b.sum / float64(b.count)
+	case Min:
+		return b.min
+	case Max:
+		return b.max
+	case Count:
+		return float64(b.count)
+	case Last:
+		return b.last
+	}
+	return b.sum
+}
+
+// Aggregator evaluates rollup rules against incoming metrics
+type Aggregator struct {
+	sync.Mutex
+	rules   []*Rule
+	buckets map[bucketKey]*bucket
+	// emitted holds the end of the last emitted interval of each rule, so
+	// points arriving after their interval was emitted can be counted.
+	emitted map[*Rule]int64
+}
+
+// NewAggregator creates an Aggregator for the rules
+func NewAggregator(rules []*Rule) *Aggregator {
+	return &Aggregator{
+		rules:   rules,
+		buckets: make(map[bucketKey]*bucket),
+		emitted: make(map[*Rule]int64),
+	}
+}
+
+// Observe feeds the metrics to the rules of the configured rollup aggregator.
+// The metrics are not modified or retained.
+func Observe(metrics []*schema.MetricData) {
+	if global == nil {
+		return
+	}
+	global.Add(metrics)
+}
+
+// Add adds the metrics matching the rules to the current intervals.
+func (a *Aggregator) Add(metrics []*schema.MetricData) {
+	a.Lock()
+	defer a.Unlock()
+	for _, r := range a.rules {
+		matched := 0
+		late := 0
+		for _, m := range metrics {
+			out, ok := r.output(m)
+			if !ok {
+				continue
+			}
+			matched++
+			// align the point to the end of the interval it falls in
+			ts := (m.Time-1)/int64(r.Interval)*int64(r.Interval) + int64(r.Interval)
+			if ts <= a.emitted[r] {
+				late++
+				continue
+			}
+			key := bucketKey{rule: r, org: m.OrgId, output: out, ts: ts}
+			b, ok := a.buckets[key]
+			if !ok {
+				b = &bucket{}
+				a.buckets[key] = b
+			}
+			b.add(m.Value, m.Time)
+		}
+		if matched > 0 {
+			matchedTotal.WithLabelValues(r.Name).Add(float64(matched))
+		}
+		if late > 0 {
+			lateTotal.WithLabelValues(r.Name).Add(float64(late))
+		}
+	}
+}
+
+// Flush returns the rollup points of the intervals which ended at least the
+// rule's wait before now.
+func (a *Aggregator) Flush(now time.Time) []*schema.MetricData {
+	return a.flush(func(key bucketKey) bool {
+		return key.ts <= now.Add(-key.rule.Wait).Unix()
+	})
+}
+
+// FlushAll returns the rollup points of all intervals, including those which
+// have not ended yet.
+func (a *Aggregator) FlushAll() []*schema.MetricData {
+	return a.flush(func(bucketKey) bool { return true })
+}
+
+func (a *Aggregator) flush(ready func(bucketKey) bool) []*schema.MetricData {
+	var out []*schema.MetricData
+	emitted := make(map[string]int)
+	a.Lock()
+	for key, b := range a.buckets {
+		if !ready(key) {
+			continue
+		}
+		value := b.value(key.rule.Function)
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			delete(a.buckets, key)
+			continue
+		}
+		m := &schema.MetricData{
+			OrgId:    key.org,
+			Name:     key.output,
+			Interval: key.rule.Interval,
+			Value:    value,
+			Unit:     "unknown",
+			Time:     key.ts,
+			Mtype:    "gauge",
+		}
+		m.SetId()
+		out = append(out, m)
+		emitted[key.rule.Name]++
+		if key.ts > a.emitted[key.rule] {
+			a.emitted[key.rule] = key.ts
+		}
+		delete(a.buckets, key)
+	}
+	a.Unlock()
+	for rule, cnt := range emitted {
+		emittedTotal.WithLabelValues(rule).Add(float64(cnt))
+	}
+	return out
+}
+
+// Stop publishes the points of all intervals of the configured rollup aggregator.
+func Stop(publish func([]*schema.MetricData) error) {
+	if global == nil {
+		return
+	}
+	metrics := global.FlushAll()
+	if len(metrics) == 0 {
+		return
+	}
+	if err := publish(metrics); err != nil {
+		log.Errorf("failed to publish %d rollup metrics on shutdown: %s", len(metrics), err)
+	}
+}
+
+func (a *Aggregator) run(interval time.Duration, publish func([]*schema.MetricData) error) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		metrics := a.Flush(now)
+		if len(metrics) == 0 {
+			continue
+		}
+		if err := publish(metrics); err != nil {
+			log.Errorf("failed to publish %d rollup metrics: %s", len(metrics), err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package rollup
+
+import (
+	"testing"
+	"time"
+
+	schema "github.com/raintank/schema"
+	"gopkg.in/ini.v1"
+)
+
+func TestAggregator(t *testing.T) {
+	conf, err := ini.Load([]byte(`
+[cluster]
+orgId = 1
+match = servers.*.requests
+output = cluster.requests
+function = sum
+interval = 60
+wait = 30
+
+[per-dc]
+match_type = regex
+match = ^dc\.(\w+)\.host\d+\.cpu$
+output = dc.$1.cpu
+function = max
+interval = 10
+wait = 0
+`))
+	if err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+	rules, err := ParseRules(conf)
+	if err != nil {
+		t.Fatalf("failed to parse rules: %v", err)
+	}
+	a := NewAggregator(rules)
+
+	a.Add([]*schema.MetricData{
+		{OrgId: 1, Name: "servers.a.requests", Value: 1, Time: 1},
+		{OrgId: 1, Name: "servers.b.requests", Value: 2, Time: 30},
+		{OrgId: 1, Name: "servers.b.requests", Value: 4, Time: 61},
+		{OrgId: 2, Name: "servers.b.requests", Value: 8, Time: 30},
+		{OrgId: 1, Name: "servers.a.b.requests", Value: 16, Time: 30},
+		{OrgId: 2, Name: "dc.eu.host1.cpu", Value: 3, Time: 5},
+		{OrgId: 2, Name: "dc.eu.host2.cpu", Value: 5, Time: 5},
+		{OrgId: 2, Name: "dc.us.host1.cpu", Value: 7, Time: 5},
+	})
+
+	type point struct {
+		org  int
+		name string
+		ts   int64
+	}
+	tests := []struct {
+		name string
+		now  int64
+		want map[point]float64
+	}{
+		{
+			name: "only intervals past their wait",
+			now:  60,
+			want: map[point]float64{
+				{2, "dc.eu.cpu", 10}: 5,
+				{2, "dc.us.cpu", 10}: 7,
+			},
+		},
+		{
+			name: "interval emitted after wait",
+			now:  90,
+			want: map[point]float64{
+				{1, "cluster.requests", 60}: 3,
+			},
+		},
+		{
+			name: "next interval",
+			now:  150,
+			want: map[point]float64{
+				{1, "cluster.requests", 120}: 4,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := a.Flush(time.Unix(tt.now, 0))
+			if len(got) != len(tt.want) {
+				t.Fatalf("Flush() returned %d points, want %d: %v", len(got), len(tt.want), got)
+			}
+			for _, m := range got {
+				want, ok := tt.want[point{m.OrgId, m.Name, m.Time}]
+				if !ok || want != m.Value {
+					t.Errorf("Flush() unexpected point %d %s %d = %v", m.OrgId, m.Name, m.Time, m.Value)
+				}
+				if m.Id == "" {
+					t.Errorf("Flush() point %s has no id", m.Name)
+				}
+			}
+		})
+	}
+
+	// points for intervals which were already emitted are dropped
+	a.Add([]*schema.MetricData{{OrgId: 1, Name: "servers.a.requests", Value: 1, Time: 100}})
+	if got := a.Flush(time.Unix(300, 0)); len(got) != 0 {
+		t.Errorf("Flush() returned late points: %v", got)
+	}
+}
@@ -0,0 +1,164 @@
+package validate
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	schema "github.com/raintank/schema"
+	"github.com/raintank/tsdb-gw/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Reject discards points with a timestamp outside of the accepted window
+	Reject = "reject"
+	// Clamp sets the timestamp of points outside of the accepted window to now
+	Clamp = "clamp"
+
+	ReasonTooOld = "timestamp_too_old"
+	ReasonTooNew = "timestamp_too_new"
+	ReasonMillis = "timestamp_millis"
+)
+
+var (
+	maxAge    time.Duration
+	maxFuture time.Duration
+	action    string
+	convertMs bool
+
+	// InvalidSamples counts the samples discarded because they are invalid, by reason and org.
+	InvalidSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "invalid_samples_total",
+		Help:      "The total number of samples that were discarded because they are invalid.",
+	}, []string{"reason", "org"})
+
+	adjustedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gateway",
+		Name:      "adjusted_samples_total",
+		Help:      "The total number of samples whose timestamp was adjusted because it was out of range. The org label is only set if metrics-org-label is enabled.",
+	}, []string{"reason", "org"})
+)
+
+func init() {
+	flag.DurationVar(&maxAge, "timestamp-max-age", 0, "max age of a point's timestamp. older points are rejected or clamped. (0 disables the check)")
+	flag.DurationVar(&maxFuture, "timestamp-max-future", 0, "max time a point's timestamp may be ahead of the gateway's clock. newer points are rejected or clamped. (0 disables the check)")
+	flag.StringVar(&action, "timestamp-out-of-range", Reject, "what to do with points whose timestamp is out of range. (reject|clamp)")
+	flag.BoolVar(&convertMs, "timestamp-convert-ms", false, "convert timestamps in milliseconds to seconds. timestamps more than 100 times the current unix time are considered to be in milliseconds")
+}
+
+// Init validates the timestamp validation settings.
+func Init() error {
+	switch action {
+	case Reject, Clamp:
+	default:
+		return fmt.Errorf("invalid timestamp-out-of-range action %q", action)
+	}
+	if maxAge < 0 || maxFuture < 0 {
+		return fmt.Errorf("timestamp-max-age and timestamp-max-future must not be negative")
+	}
+	if maxAge > 0 || maxFuture > 0 || convertMs {
+		log.Infof("validating timestamps. max-age=%s max-future=%s out-of-range=%s convert-ms=%t", maxAge, maxFuture, action, convertMs)
+	}
+	return nil
+}
+
+// Window is the range of timestamps accepted relative to now.
+// A zero MaxAge or MaxFuture disables that side of the check. ConvertMs
+// converts timestamps in milliseconds to seconds before they are checked.
+type Window struct {
+	MaxAge    time.Duration
+	MaxFuture time.Duration
+	Action    string
+	ConvertMs bool
+}
+
+// check returns the reason the timestamp is out of range, or an empty string.
+func (w Window) check(ts int64, now time.Time) string {
+	if w.MaxAge > 0 && ts < now.Add(-w.MaxAge).Unix() {
+		return ReasonTooOld
+	}
+	if w.MaxFuture > 0 && ts > now.Add(w.MaxFuture).Unix() {
+		return ReasonTooNew
+	}
+	return ""
+}
+
+// Apply checks the timestamp of the metric. It returns the reason the metric
+// was adjusted or should be dropped, and whether to keep it. Adjusted metrics
+// have their Time updated.
+func (w Window) Apply(m *schema.MetricData, now time.Time) (string, bool) {
+	ts := m.Time
+	converted := w.ConvertMs && isMillis(ts, now)
+	if converted {
+		ts = ts / 1000
+	}
+	reason := w.check(ts, now)
+	if reason == "" {
+		if converted {
+			m.Time = ts
+			return ReasonMillis, true
+		}
+		return "", true
+	}
+	if w.Action == Clamp {
+		m.Time = now.Unix()
+		return reason, true
+	}
+	return reason, false
+}
+
+// isMillis reports whether the timestamp is in milliseconds. In seconds it
+// would be thousands of years ahead of now.
+func isMillis(ts int64, now time.Time) bool {
+	return ts > now.Unix()*100
+}
+
+func (w Window) enabled() bool {
+	return w.MaxAge > 0 || w.MaxFuture > 0 || w.ConvertMs
+}
+
+// Timestamps applies the configured timestamp window to the metrics,
+// returning the metrics to publish. The passed slice is not modified.
+func Timestamps(metrics []*schema.MetricData) []*schema.MetricData {
+	w := Window{
+		MaxAge:    maxAge,
+		MaxFuture: maxFuture,
+		Action:    action,
+		ConvertMs: convertMs,
+	}
+	if !w.enabled() {
+		return metrics
+	}
+	return w.filter(metrics, time.Now())
+}
+
+func (w Window) filter(metrics []*schema.MetricData, now time.Time) []*schema.MetricData {
+	var out []*schema.MetricData
+	for i, m := range metrics {
+		reason, keep := w.Apply(m, now)
+		if keep {
+			if reason != "" {
+				adjustedSamples.WithLabelValues(reason, util.OrgLabel(m.OrgId)).Inc()
+			}
+			if out != nil {
+				out = append(out, m)
+			}
+			continue
+		}
+		InvalidSamples.WithLabelValues(reason, strconv.Itoa(m.OrgId)).Inc()
+		log.Debugf("discarding metric %s of org %d with out of range timestamp %d", m.Name, m.OrgId, m.Time)
+		if out == nil {
+			out = make([]*schema.MetricData, i, len(metrics))
+			copy(out, metrics[:i])
+		}
+	}
+	if out == nil {
+		return metrics
+	}
+	return out
+}
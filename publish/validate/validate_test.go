@@ -0,0 +1,61 @@
+package validate
+
+import (
+	"testing"
+	"time"
+
+	schema "github.com/raintank/schema"
+)
+
+func TestWindowApply(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tests := []struct {
+		name       string
+		window     Window
+		ts         int64
+		wantReason string
+		wantKeep   bool
+		wantTs     int64
+	}{
+		{name: "disabled", window: Window{Action: Reject}, ts: 1, wantKeep: true, wantTs: 1},
+		{name: "in range", window: Window{MaxAge: time.Hour, MaxFuture: time.Minute, Action: Reject}, ts: 1499999000, wantKeep: true, wantTs: 1499999000},
+		{name: "too old", window: Window{MaxAge: time.Hour, Action: Reject}, ts: 1400000000, wantReason: ReasonTooOld, wantKeep: false, wantTs: 1400000000},
+		{name: "too new", window: Window{MaxFuture: time.Minute, Action: Reject}, ts: 1500000061, wantReason: ReasonTooNew, wantKeep: false, wantTs: 1500000061},
+		{name: "clamp", window: Window{MaxFuture: time.Minute, Action: Clamp}, ts: 1600000000, wantReason: ReasonTooNew, wantKeep: true, wantTs: 1500000000},
+		{name: "convert ms", window: Window{MaxFuture: time.Minute, Action: Reject, ConvertMs: true}, ts: 1499999990123, wantReason: ReasonMillis, wantKeep: true, wantTs: 1499999990},
+		{name: "convert ms still out of range", window: Window{MaxAge: time.Hour, MaxFuture: time.Minute, Action: Reject, ConvertMs: true}, ts: 1400000000000, wantReason: ReasonTooOld, wantKeep: false, wantTs: 1400000000000},
+		{name: "convert ms without window", window: Window{ConvertMs: true}, ts: 1400000000123, wantReason: ReasonMillis, wantKeep: true, wantTs: 1400000000},
+		{name: "convert ms with max age only", window: Window{MaxAge: time.Hour, Action: Reject, ConvertMs: true}, ts: 1499999990123, wantReason: ReasonMillis, wantKeep: true, wantTs: 1499999990},
+		{name: "convert ms keeps seconds", window: Window{ConvertMs: true}, ts: 1600000000, wantReason: "", wantKeep: true, wantTs: 1600000000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &schema.MetricData{Time: tt.ts}
+			reason, keep := tt.window.Apply(m, now)
+			if reason != tt.wantReason || keep != tt.wantKeep {
+				t.Errorf("Apply() = %q, %v, want %q, %v", reason, keep, tt.wantReason, tt.wantKeep)
+			}
+			if m.Time != tt.wantTs {
+				t.Errorf("Apply() time = %d, want %d", m.Time, tt.wantTs)
+			}
+		})
+	}
+}
+
+func TestWindowFilter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	w := Window{MaxAge: time.Hour, Action: Reject}
+	in := []*schema.MetricData{
+		{Name: "a", Time: 1500000000},
+		{Name: "b", Time: 1000},
+		{Name: "c", Time: 1500000000},
+	}
+	out := w.filter(in, now)
+	if len(out) != 2 || out[0].Name != "a" || out[1].Name != "c" {
+		t.Fatalf("filter() returned unexpected metrics: %v", out)
+	}
+	if in[1].Name != "b" {
+		t.Errorf("filter() modified the passed slice")
+	}
+}
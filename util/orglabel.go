@@ -0,0 +1,22 @@
+package util
+
+import (
+	"flag"
+	"strconv"
+)
+
+var orgLabel bool
+
+func init() {
+	flag.BoolVar(&orgLabel, "metrics-org-label", false, "break down the sample counters of the validation, relabeling, limits and cortex publisher by org. each org adds series to these metrics")
+}
+
+// OrgLabel returns the value of the org label of the per org sample
+// counters. It is empty, so all orgs share a series, unless the
+// metrics-org-label setting is enabled.
+func OrgLabel(org int) string {
+	if !orgLabel {
+		return ""
+	}
+	return strconv.Itoa(org)
+}
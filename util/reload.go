@@ -0,0 +1,126 @@
+package util
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	reloadInterval time.Duration
+
+	reloadSuccessful = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last reload of the config file was successful.",
+	}, []string{"config"})
+	reloadSuccessTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gateway",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful load of the config file.",
+	}, []string{"config"})
+
+	watchersMu sync.Mutex
+	watchers   []*FileWatcher
+	sighupOnce sync.Once
+)
+
+func init() {
+	flag.DurationVar(&reloadInterval, "config-reload-interval", 30*time.Second, "interval at which config files are checked for changes and reloaded. config files are also reloaded on SIGHUP. (0 disables checking for changes)")
+}
+
+// FileWatcher reloads a config file when it changes, or when the process
+// receives a SIGHUP. If loading fails, the previous config remains in use.
+type FileWatcher struct {
+	sync.Mutex
+	name    string
+	path    string
+	load    func() error
+	modTime time.Time
+}
+
+// WatchFile calls load whenever the file at path changes or a SIGHUP is
+// received. load must only swap in the new config if it is valid.
+// name identifies the config in the reload metrics. The config is assumed
+// to be loaded already.
+func WatchFile(name, path string, load func() error) *FileWatcher {
+	w := &FileWatcher{
+		name: name,
+		path: path,
+		load: load,
+	}
+	if info, err := os.Stat(path); err == nil {
+		w.modTime = info.ModTime()
+	}
+	reloadSuccessful.WithLabelValues(name).Set(1)
+	reloadSuccessTime.WithLabelValues(name).Set(float64(time.Now().Unix()))
+
+	watchersMu.Lock()
+	watchers = append(watchers, w)
+	watchersMu.Unlock()
+	sighupOnce.Do(func() { go handleSighup() })
+
+	if reloadInterval > 0 {
+		go w.poll(reloadInterval)
+	}
+	return w
+}
+
+func (w *FileWatcher) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		info, err := os.Stat(w.path)
+		if err != nil {
+			log.Errorf("could not stat %s file %s: %v", w.name, w.path, err)
+			continue
+		}
+		w.Lock()
+		changed := !info.ModTime().Equal(w.modTime)
+		w.Unlock()
+		if changed {
+			w.Reload()
+		}
+	}
+}
+
+// Reload loads the file, keeping the current config on errors.
+func (w *FileWatcher) Reload() error {
+	w.Lock()
+	defer w.Unlock()
+	// record the modification time before loading, so changes made while
+	// loading are picked up by the next check
+	if info, err := os.Stat(w.path); err == nil {
+		w.modTime = info.ModTime()
+	}
+	if err := w.load(); err != nil {
+		reloadSuccessful.WithLabelValues(w.name).Set(0)
+		log.Errorf("failed to reload %s file %s, keeping current config: %v", w.name, w.path, err)
+		return err
+	}
+	reloadSuccessful.WithLabelValues(w.name).Set(1)
+	reloadSuccessTime.WithLabelValues(w.name).Set(float64(time.Now().Unix()))
+	log.Infof("reloaded %s file %s", w.name, w.path)
+	return nil
+}
+
+func handleSighup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log.Info("received SIGHUP, reloading config files")
+		watchersMu.Lock()
+		ws := make([]*FileWatcher, len(watchers))
+		copy(ws, watchers)
+		watchersMu.Unlock()
+		for _, w := range ws {
+			w.Reload()
+		}
+	}
+}
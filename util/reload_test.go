@@ -0,0 +1,68 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFileWatcherReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "limit.conf")
+
+	// the config is a single number, only swapped in if it is valid
+	limit := 0
+	load := func() error {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		l, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return err
+		}
+		limit = l
+		return nil
+	}
+	write := func(content string) {
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("10\n")
+	if err := load(); err != nil {
+		t.Fatal(err)
+	}
+	w := &FileWatcher{name: "test", path: file, load: load}
+
+	write("ten\n")
+	if err := w.Reload(); err == nil {
+		t.Errorf("Reload() of invalid file should fail")
+	}
+	if limit != 10 {
+		t.Errorf("limit after invalid reload = %d, want 10", limit)
+	}
+
+	write("20\n")
+	if err := w.Reload(); err != nil {
+		t.Errorf("Reload() error = %v", err)
+	}
+	if limit != 20 {
+		t.Errorf("limit after reload = %d, want 20", limit)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.modTime.Equal(info.ModTime()) {
+		t.Errorf("modTime = %v, want %v", w.modTime, info.ModTime())
+	}
+}